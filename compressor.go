@@ -0,0 +1,443 @@
+package gozstd
+
+/*
+#cgo CFLAGS: -O3
+
+#define ZSTD_STATIC_LINKING_ONLY
+#include "zstd.h"
+#include "zstd_errors.h"
+
+#include <stdint.h>  // for uintptr_t
+
+// The following *_wrapper function allows avoiding memory allocations
+// durting calls from Go.
+// See https://github.com/golang/go/issues/24450 .
+
+static size_t ZSTD_decompressStreamBuf_wrapper(uintptr_t ds, uintptr_t dst, size_t dstCapacity, uintptr_t dstPos, uintptr_t src, size_t srcSize, uintptr_t srcPos) {
+    ZSTD_outBuffer outBuf = { (void*)dst, dstCapacity, *(size_t*)dstPos };
+    ZSTD_inBuffer inBuf = { (const void*)src, srcSize, *(size_t*)srcPos };
+    size_t result = ZSTD_decompressStream((ZSTD_DStream*)ds, &outBuf, &inBuf);
+    *(size_t*)dstPos = outBuf.pos;
+    *(size_t*)srcPos = inBuf.pos;
+    return result;
+}
+*/
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"runtime"
+	"unsafe"
+)
+
+// ResetDirective specifies what is reset by Compressor.Reset and Decompressor.Reset.
+type ResetDirective int
+
+const (
+	// ResetSession aborts the current frame, while keeping the parameters.
+	ResetSession ResetDirective = 1 // from zstd.h
+
+	// ResetParameters resets all the parameters to default values
+	// and drops the referenced dictionary.
+	ResetParameters ResetDirective = 2 // from zstd.h
+
+	// ResetSessionAndParameters is equivalent to ResetSession followed by ResetParameters.
+	ResetSessionAndParameters ResetDirective = 3 // from zstd.h
+)
+
+// Compressor is a compression context.
+//
+// Unlike Compress* functions, which use contexts from internal pools,
+// Compressor allows pinning the context to a single goroutine, setting
+// the compression parameters once for multiple Compress calls
+// and controlling when the context memory is freed.
+//
+// Compressor cannot be used from concurrently running goroutines.
+type Compressor struct {
+	cctx *C.ZSTD_CCtx
+
+	// hasParams is set if cctx is configured with params
+	// and must be used via ZSTD_compress2.
+	hasParams bool
+
+	// dict is the dictionary referenced by cctx.
+	dict *CDict
+
+	// memSize is the size of cctx accounted in Stats.
+	memSize int
+
+	// memSizeCalls is the number of refreshMemSize calls.
+	memSizeCalls uint32
+
+	// prefix is set during compressPrefixLevel calls.
+	prefix []byte
+}
+
+// NewCompressor returns new Compressor with DefaultCompressionLevel.
+//
+// Call Release when the Compressor is no longer needed.
+func NewCompressor() *Compressor {
+	c := newCCtx()
+	c.hasParams = true
+	return c
+}
+
+// Compress appends compressed src to dst and returns the result.
+//
+// The parameters set via SetLevel, SetDict and SetParams are used
+// for the compression.
+func (c *Compressor) Compress(dst, src []byte) ([]byte, error) {
+	if c.cctx == nil {
+		return dst, errReleasedCompressor
+	}
+	if c.dict != nil && c.dict.p == nil {
+		return dst, errReleasedCDict
+	}
+	dst, err := compress(c, nil, dst, src, nil, 0)
+	runtime.KeepAlive(c.dict)
+	c.refreshMemSize()
+	return dst, err
+}
+
+// SetLevel sets the compression level for subsequent Compress calls.
+func (c *Compressor) SetLevel(compressionLevel int) error {
+	if c.cctx == nil {
+		return errReleasedCompressor
+	}
+	// Do not validate the compression level, since zstd clamps it
+	// to the supported range.
+	result := C.ZSTD_CCtx_setParameter(c.cctx, C.ZSTD_c_compressionLevel, C.int(compressionLevel))
+	if C.ZSTD_getErrorCode(result) != 0 {
+		return fmt.Errorf("cannot set compressionLevel=%d: %w", compressionLevel, newError(result))
+	}
+	return nil
+}
+
+// SetDict sets the dictionary for subsequent Compress calls.
+//
+// The compression level is obtained from cd. nil cd removes the dictionary.
+// cd must not be released while it is used by c.
+func (c *Compressor) SetDict(cd *CDict) error {
+	if c.cctx == nil {
+		return errReleasedCompressor
+	}
+	if cd != nil && cd.p == nil {
+		return errReleasedCDict
+	}
+	var cdict *C.ZSTD_CDict
+	if cd != nil {
+		cdict = cd.p
+	}
+	result := C.ZSTD_CCtx_refCDict(c.cctx, cdict)
+	if C.ZSTD_getErrorCode(result) != 0 {
+		return fmt.Errorf("cannot use CDict: %w", newError(result))
+	}
+	c.dict = cd
+	return nil
+}
+
+// SetParams replaces all the parameters for subsequent Compress calls
+// with the given params.
+//
+// Unlike Writer, Compress knows the size of src, so it is written into
+// the frame header unless params.DisableContentSize is set.
+// params.Dict must not be released while it is used by c.
+func (c *Compressor) SetParams(params *WriterParams) error {
+	if c.cctx == nil {
+		return errReleasedCompressor
+	}
+	c.dict = nil
+	if err := initCStream((*C.ZSTD_CStream)(c.cctx), *params); err != nil {
+		return err
+	}
+	c.dict = params.Dict
+	return nil
+}
+
+// Reset resets c according to the given directive.
+func (c *Compressor) Reset(directive ResetDirective) error {
+	if c.cctx == nil {
+		return errReleasedCompressor
+	}
+	result := C.ZSTD_CCtx_reset(c.cctx, C.ZSTD_ResetDirective(directive))
+	if C.ZSTD_getErrorCode(result) != 0 {
+		return fmt.Errorf("cannot reset Compressor with directive=%d: %w", directive, newError(result))
+	}
+	if directive&ResetParameters != 0 {
+		c.dict = nil
+	}
+	return nil
+}
+
+// Release releases all the resources occupied by c.
+//
+// c cannot be used after the release.
+func (c *Compressor) Release() {
+	if c.cctx == nil {
+		return
+	}
+	result := C.ZSTD_freeCCtx(c.cctx)
+	ensureNoError("ZSTD_freeCCtx", result)
+	c.cctx = nil
+	c.dict = nil
+	cctxMem.untrack(&c.memSize)
+}
+
+// refreshMemSize updates the size of c accounted in Stats
+// every memSizeRefreshInterval calls starting from the first call,
+// since the compression may allocate memory in the context.
+func (c *Compressor) refreshMemSize() {
+	if c.memSizeCalls%memSizeRefreshInterval == 0 {
+		c.updateMemSize()
+	}
+	c.memSizeCalls++
+}
+
+func (c *Compressor) updateMemSize() {
+	cctxMem.update(&c.memSize, int(C.ZSTD_sizeof_CCtx(c.cctx)))
+}
+
+var errReleasedCompressor = errors.New("cannot use released Compressor")
+
+// Decompressor is a decompression context.
+//
+// Unlike Decompress* functions, which use contexts from internal pools,
+// Decompressor allows pinning the context to a single goroutine, setting
+// the decompression parameters once for multiple Decompress calls
+// and controlling when the context memory is freed.
+//
+// Decompressor cannot be used from concurrently running goroutines.
+type Decompressor struct {
+	dctx *C.ZSTD_DCtx
+
+	// params contains the parameters set via SetDict and SetParams.
+	params ReaderParams
+
+	// memSize is the size of dctx accounted in Stats.
+	memSize int
+
+	// memSizeCalls is the number of refreshMemSize calls.
+	memSizeCalls uint32
+
+	// prefix is set during DecompressWithPrefix calls.
+	prefix []byte
+}
+
+// NewDecompressor returns new Decompressor.
+//
+// Call Release when the Decompressor is no longer needed.
+func NewDecompressor() *Decompressor {
+	return newDCtx()
+}
+
+// Decompress appends decompressed src to dst and returns the result.
+//
+// The parameters set via SetDict and SetParams are used for the decompression.
+// Frames without the decompressed size in the frame header are decompressed
+// by d in streaming mode, while ReaderParams.SkippableFrameHandler
+// and ReaderParams.Dicts are handled by an internal Reader.
+func (d *Decompressor) Decompress(dst, src []byte) ([]byte, error) {
+	if d.dctx == nil {
+		return dst, errReleasedDecompressor
+	}
+	if d.params.Dict != nil && d.params.Dict.p == nil {
+		return dst, errReleasedDDict
+	}
+	dst, err := d.decompress(dst, src)
+	runtime.KeepAlive(d.params.Dict)
+	d.refreshMemSize()
+	return dst, err
+}
+
+func (d *Decompressor) decompress(dst, src []byte) ([]byte, error) {
+	params := &d.params
+	if params.SkippableFrameHandler != nil || params.Dicts != nil {
+		return streamDecompress(dst, src, params.Dict, params, nil)
+	}
+	if params.Format != FormatZstd1 {
+		// ZSTD_findDecompressedSize supports only FormatZstd1.
+		return d.decompressStream(dst, src)
+	}
+	// ZSTD_decompressDCtx doesn't check the window size, so verify it here
+	// in the same way as ZSTD_decompressStream does.
+	if err := checkWindowSize(src, params.WindowLogMax); err != nil {
+		return dst, err
+	}
+	dst, err := decompress(d, nil, dst, src, nil, params.MaxDecompressedSize)
+	if err == errContentSizeUnknown {
+		return d.decompressStream(dst, src)
+	}
+	return dst, err
+}
+
+// decompressStream appends src decompressed in streaming mode to dst
+// and returns the result.
+func (d *Decompressor) decompressStream(dst, src []byte) ([]byte, error) {
+	if len(src) == 0 {
+		return dst, nil
+	}
+	result := C.ZSTD_DCtx_reset(d.dctx, C.ZSTD_reset_session_only)
+	ensureNoError("ZSTD_DCtx_reset", result)
+
+	dstLen := len(dst)
+	maxDstLen := 0
+	if limit := d.params.MaxDecompressedSize; limit > 0 {
+		maxDstLen = dstLen + limit
+	}
+	var scratch [1]byte
+	srcPos := 0
+	for {
+		out := dst
+		if len(dst) == cap(dst) {
+			if maxDstLen > 0 && len(dst) >= maxDstLen {
+				// dst reached the limit. Check whether more data remains.
+				out = scratch[:0]
+			} else {
+				// Grow dst manually, since append may allocate more than maxDstLen bytes.
+				newCap := 2 * cap(dst)
+				if n := len(dst) + int(dstreamOutBufSize); newCap < n {
+					newCap = n
+				}
+				if maxDstLen > 0 && newCap > maxDstLen {
+					newCap = maxDstLen
+				}
+				out = make([]byte, len(dst), newCap)
+				copy(out, dst)
+				dst = out
+			}
+		}
+		var result C.size_t
+		out, srcPos, result = d.decompressStreamBuf(out, src, srcPos)
+		if C.ZSTD_getErrorCode(result) != 0 {
+			return dst[:dstLen], fmt.Errorf("decompression error: %w", newError(result))
+		}
+		if &out[:1][0] == &scratch[0] {
+			if len(out) > 0 {
+				return dst[:dstLen], ErrSizeLimitExceeded
+			}
+		} else {
+			dst = out
+		}
+		if srcPos == len(src) {
+			if result == 0 {
+				// The last frame is decompressed and flushed.
+				return dst, nil
+			}
+			if len(out) < cap(out) {
+				// src ends in the middle of a frame.
+				return dst[:dstLen], fmt.Errorf("decompression error: %w", io.ErrUnexpectedEOF)
+			}
+		}
+	}
+}
+
+// decompressStreamBuf decompresses src starting from srcPos into the free
+// space of dst.
+//
+// It returns dst extended by the decompressed data, the position of
+// the unprocessed data in src and the ZSTD_decompressStream result.
+func (d *Decompressor) decompressStreamBuf(dst, src []byte, srcPos int) ([]byte, int, C.size_t) {
+	dstBuf := dst[:cap(dst)]
+	dstPos := C.size_t(len(dst))
+	srcPosC := C.size_t(srcPos)
+	result := C.ZSTD_decompressStreamBuf_wrapper(
+		C.uintptr_t(uintptr(unsafe.Pointer(d.dctx))),
+		C.uintptr_t(uintptr(unsafe.Pointer(&dstBuf[0]))),
+		C.size_t(len(dstBuf)),
+		C.uintptr_t(uintptr(unsafe.Pointer(&dstPos))),
+		C.uintptr_t(uintptr(unsafe.Pointer(&src[0]))),
+		C.size_t(len(src)),
+		C.uintptr_t(uintptr(unsafe.Pointer(&srcPosC))))
+	// Prevent from GC'ing of dst and src during CGO call above.
+	runtime.KeepAlive(dstBuf)
+	runtime.KeepAlive(src)
+	return dst[:int(dstPos)], int(srcPosC), result
+}
+
+// SetDict sets the dictionary for subsequent Decompress calls.
+//
+// nil dd removes the dictionary. dd must not be released while it is used by d.
+func (d *Decompressor) SetDict(dd *DDict) error {
+	if d.dctx == nil {
+		return errReleasedDecompressor
+	}
+	if dd != nil && dd.p == nil {
+		return errReleasedDDict
+	}
+	var ddict *C.ZSTD_DDict
+	if dd != nil {
+		ddict = dd.p
+	}
+	result := C.ZSTD_DCtx_refDDict(d.dctx, ddict)
+	if C.ZSTD_getErrorCode(result) != 0 {
+		return fmt.Errorf("cannot use DDict: %w", newError(result))
+	}
+	d.params.Dict = dd
+	return nil
+}
+
+// SetParams replaces all the parameters for subsequent Decompress calls
+// with the given params.
+//
+// params.Dict must not be released while it is used by d.
+func (d *Decompressor) SetParams(params *ReaderParams) error {
+	if d.dctx == nil {
+		return errReleasedDecompressor
+	}
+	if params.Dict != nil && params.Dict.p == nil {
+		return errReleasedDDict
+	}
+	d.params = ReaderParams{}
+	if err := initDStream((*C.ZSTD_DStream)(d.dctx), *params); err != nil {
+		return err
+	}
+	d.params = *params
+	return nil
+}
+
+// Reset resets d according to the given directive.
+func (d *Decompressor) Reset(directive ResetDirective) error {
+	if d.dctx == nil {
+		return errReleasedDecompressor
+	}
+	result := C.ZSTD_DCtx_reset(d.dctx, C.ZSTD_ResetDirective(directive))
+	if C.ZSTD_getErrorCode(result) != 0 {
+		return fmt.Errorf("cannot reset Decompressor with directive=%d: %w", directive, newError(result))
+	}
+	if directive&ResetParameters != 0 {
+		d.params = ReaderParams{}
+	}
+	return nil
+}
+
+// Release releases all the resources occupied by d.
+//
+// d cannot be used after the release.
+func (d *Decompressor) Release() {
+	if d.dctx == nil {
+		return
+	}
+	result := C.ZSTD_freeDCtx(d.dctx)
+	ensureNoError("ZSTD_freeDCtx", result)
+	d.dctx = nil
+	d.params = ReaderParams{}
+	dctxMem.untrack(&d.memSize)
+}
+
+// refreshMemSize updates the size of d accounted in Stats
+// every memSizeRefreshInterval calls starting from the first call,
+// since the decompression may allocate memory in the context.
+func (d *Decompressor) refreshMemSize() {
+	if d.memSizeCalls%memSizeRefreshInterval == 0 {
+		d.updateMemSize()
+	}
+	d.memSizeCalls++
+}
+
+func (d *Decompressor) updateMemSize() {
+	dctxMem.update(&d.memSize, int(C.ZSTD_sizeof_DCtx(d.dctx)))
+}
+
+var errReleasedDecompressor = errors.New("cannot use released Decompressor")
@@ -0,0 +1,326 @@
+package gozstd
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+func TestCompressorDecompressor(t *testing.T) {
+	c := NewCompressor()
+	defer c.Release()
+	d := NewDecompressor()
+	defer d.Release()
+
+	for i := 0; i < 10; i++ {
+		data := newTestDocument(rand.Intn(100 * 1024))
+		cd, err := c.Compress(nil, data)
+		if err != nil {
+			t.Fatalf("cannot compress data: %s", err)
+		}
+		plainData, err := d.Decompress(nil, cd)
+		if err != nil {
+			t.Fatalf("cannot decompress data: %s", err)
+		}
+		if !bytes.Equal(plainData, data) {
+			t.Fatalf("unexpected data decompressed; got %d bytes; want %d bytes", len(plainData), len(data))
+		}
+	}
+}
+
+func TestCompressorSetLevel(t *testing.T) {
+	c := NewCompressor()
+	defer c.Release()
+
+	data := newTestDocument(256 * 1024)
+	if err := c.SetLevel(1); err != nil {
+		t.Fatalf("cannot set level: %s", err)
+	}
+	cdFast, err := c.Compress(nil, data)
+	if err != nil {
+		t.Fatalf("cannot compress data: %s", err)
+	}
+
+	// The level is sticky across Compress calls.
+	if err := c.SetLevel(19); err != nil {
+		t.Fatalf("cannot set level: %s", err)
+	}
+	for i := 0; i < 2; i++ {
+		cd, err := c.Compress(nil, data)
+		if err != nil {
+			t.Fatalf("cannot compress data: %s", err)
+		}
+		if len(cd) >= len(cdFast) {
+			t.Fatalf("expecting better compression on level 19; got %d bytes; level 1 gives %d bytes", len(cd), len(cdFast))
+		}
+	}
+
+	// ResetParameters restores the default level.
+	if err := c.Reset(ResetParameters); err != nil {
+		t.Fatalf("cannot reset parameters: %s", err)
+	}
+	cd, err := c.Compress(nil, data)
+	if err != nil {
+		t.Fatalf("cannot compress data: %s", err)
+	}
+	if cdExpected := CompressLevel(nil, data, DefaultCompressionLevel); len(cd) != len(cdExpected) {
+		t.Fatalf("unexpected compressed size after reset; got %d bytes; want %d bytes", len(cd), len(cdExpected))
+	}
+}
+
+func TestCompressorDecompressorDict(t *testing.T) {
+	var samples [][]byte
+	for i := 0; i < 1000; i++ {
+		samples = append(samples, []byte(fmt.Sprintf("sample %d, %d", i, rand.Intn(1000))))
+	}
+	dict := BuildDict(samples, 8*1024)
+	cdict, err := NewCDict(dict)
+	if err != nil {
+		t.Fatalf("cannot create CDict: %s", err)
+	}
+	defer cdict.Release()
+	ddict, err := NewDDict(dict)
+	if err != nil {
+		t.Fatalf("cannot create DDict: %s", err)
+	}
+	defer ddict.Release()
+
+	c := NewCompressor()
+	defer c.Release()
+	d := NewDecompressor()
+	defer d.Release()
+
+	if err := c.SetDict(cdict); err != nil {
+		t.Fatalf("cannot set CDict: %s", err)
+	}
+	if err := d.SetDict(ddict); err != nil {
+		t.Fatalf("cannot set DDict: %s", err)
+	}
+	for _, sample := range samples[:100] {
+		cd, err := c.Compress(nil, sample)
+		if err != nil {
+			t.Fatalf("cannot compress data: %s", err)
+		}
+		if id := DictIDFromFrame(cd); id != cdict.ID() {
+			t.Fatalf("unexpected dict id in frame; got %d; want %d", id, cdict.ID())
+		}
+		plainData, err := d.Decompress(nil, cd)
+		if err != nil {
+			t.Fatalf("cannot decompress data: %s", err)
+		}
+		if !bytes.Equal(plainData, sample) {
+			t.Fatalf("unexpected data decompressed; got %q; want %q", plainData, sample)
+		}
+	}
+
+	// The dictionary must be dropped after the reset.
+	if err := c.Reset(ResetSessionAndParameters); err != nil {
+		t.Fatalf("cannot reset parameters: %s", err)
+	}
+	cd, err := c.Compress(nil, samples[0])
+	if err != nil {
+		t.Fatalf("cannot compress data: %s", err)
+	}
+	if id := DictIDFromFrame(cd); id != 0 {
+		t.Fatalf("unexpected dict id in frame after reset; got %d; want 0", id)
+	}
+	if err := d.Reset(ResetParameters); err != nil {
+		t.Fatalf("cannot reset parameters: %s", err)
+	}
+	cd = CompressDict(nil, samples[0], cdict)
+	if _, err := d.Decompress(nil, cd); err == nil {
+		t.Fatalf("expecting error when decompressing without dictionary")
+	}
+
+	// Released dictionaries cannot be set.
+	cdict2, err := NewCDict(dict)
+	if err != nil {
+		t.Fatalf("cannot create CDict: %s", err)
+	}
+	cdict2.Release()
+	if err := c.SetDict(cdict2); !errors.Is(err, errReleasedCDict) {
+		t.Fatalf("unexpected error for released CDict; got %v; want %v", err, errReleasedCDict)
+	}
+}
+
+func TestCompressorDecompressorParams(t *testing.T) {
+	c := NewCompressor()
+	defer c.Release()
+	d := NewDecompressor()
+	defer d.Release()
+
+	wp := &WriterParams{
+		CompressionLevel:   5,
+		EnableChecksum:     true,
+		DisableContentSize: true,
+		Format:             FormatZstd1Magicless,
+	}
+	if err := c.SetParams(wp); err != nil {
+		t.Fatalf("cannot set params: %s", err)
+	}
+	data := newTestDocument(64 * 1024)
+	rp := &ReaderParams{
+		Format:              FormatZstd1Magicless,
+		MaxDecompressedSize: len(data),
+	}
+	if err := d.SetParams(rp); err != nil {
+		t.Fatalf("cannot set params: %s", err)
+	}
+
+	cd, err := c.Compress(nil, data)
+	if err != nil {
+		t.Fatalf("cannot compress data: %s", err)
+	}
+	if _, err := Decompress(nil, cd); err == nil {
+		t.Fatalf("expecting error when decompressing magicless frame with standard format")
+	}
+	plainData, err := d.Decompress(nil, cd)
+	if err != nil {
+		t.Fatalf("cannot decompress data: %s", err)
+	}
+	if !bytes.Equal(plainData, data) {
+		t.Fatalf("unexpected data decompressed; got %d bytes; want %d bytes", len(plainData), len(data))
+	}
+
+	// Verify MaxDecompressedSize.
+	cd, err = c.Compress(nil, append(data, 'x'))
+	if err != nil {
+		t.Fatalf("cannot compress data: %s", err)
+	}
+	if _, err := d.Decompress(nil, cd); err != ErrSizeLimitExceeded {
+		t.Fatalf("unexpected error; got %v; want %v", err, ErrSizeLimitExceeded)
+	}
+
+	// Verify the params are replaced on subsequent SetParams call.
+	if err := c.SetParams(&WriterParams{EnableChecksum: true}); err != nil {
+		t.Fatalf("cannot set params: %s", err)
+	}
+	cd, err = c.Compress(nil, data)
+	if err != nil {
+		t.Fatalf("cannot compress data: %s", err)
+	}
+	fh, err := ParseFrameHeader(cd)
+	if err != nil {
+		t.Fatalf("cannot parse frame header: %s", err)
+	}
+	if !fh.HasChecksum || fh.ContentSize != uint64(len(data)) {
+		t.Fatalf("unexpected frame header: %+v", fh)
+	}
+
+	// Invalid params.
+	if err := c.SetParams(&WriterParams{WindowLog: 100}); !errors.Is(err, ErrParameterOutOfBound) {
+		t.Fatalf("unexpected error for invalid WindowLog; got %v; want %v", err, ErrParameterOutOfBound)
+	}
+	if err := d.SetParams(&ReaderParams{WindowLogMax: 100}); err == nil {
+		t.Fatalf("expecting non-nil error for invalid WindowLogMax")
+	}
+}
+
+func TestDecompressorContentSizeUnknown(t *testing.T) {
+	c := NewCompressor()
+	defer c.Release()
+	d := NewDecompressor()
+	defer d.Release()
+
+	if err := c.SetParams(&WriterParams{DisableContentSize: true}); err != nil {
+		t.Fatalf("cannot set params: %s", err)
+	}
+	var data, cd []byte
+	for _, n := range []int{1000, 0, 300 * 1024, 10} {
+		chunk := newTestDocument(n)
+		data = append(data, chunk...)
+		var err error
+		cd, err = c.Compress(cd, chunk)
+		if err != nil {
+			t.Fatalf("cannot compress data: %s", err)
+		}
+	}
+	cd = append(cd, Compress(nil, []byte("foobar"))...)
+	data = append(data, "foobar"...)
+	if n, _ := FrameContentSize(cd); n != ContentSizeUnknown {
+		t.Fatalf("unexpected content size; got %d; want %d", n, ContentSizeUnknown)
+	}
+
+	for _, dst := range [][]byte{nil, []byte("prefix"), make([]byte, 0, 100)} {
+		plainData, err := d.Decompress(dst, cd)
+		if err != nil {
+			t.Fatalf("cannot decompress data: %s", err)
+		}
+		if string(plainData[:len(dst)]) != string(dst) {
+			t.Fatalf("unexpected prefix; got %q; want %q", plainData[:len(dst)], dst)
+		}
+		if !bytes.Equal(plainData[len(dst):], data) {
+			t.Fatalf("unexpected data decompressed; got %d bytes; want %d bytes", len(plainData)-len(dst), len(data))
+		}
+	}
+
+	// Truncated frame.
+	if _, err := d.Decompress(nil, cd[:len(cd)/2]); err == nil {
+		t.Fatalf("expecting non-nil error for truncated data")
+	}
+
+	// Verify MaxDecompressedSize.
+	for _, limit := range []int{len(data) - 1, len(data)} {
+		if err := d.SetParams(&ReaderParams{MaxDecompressedSize: limit}); err != nil {
+			t.Fatalf("cannot set params: %s", err)
+		}
+		plainData, err := d.Decompress(nil, cd)
+		if limit < len(data) {
+			if err != ErrSizeLimitExceeded {
+				t.Fatalf("unexpected error; got %v; want %v", err, ErrSizeLimitExceeded)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("cannot decompress data: %s", err)
+		}
+		if cap(plainData) > limit {
+			t.Fatalf("too big capacity for the decompressed data; got %d; want up to %d", cap(plainData), limit)
+		}
+		if !bytes.Equal(plainData, data) {
+			t.Fatalf("unexpected data decompressed; got %d bytes; want %d bytes", len(plainData), len(data))
+		}
+	}
+
+	// Verify WindowLogMax.
+	if err := c.SetParams(&WriterParams{WindowLog: 20, DisableContentSize: true}); err != nil {
+		t.Fatalf("cannot set params: %s", err)
+	}
+	cd, err := c.Compress(nil, data)
+	if err != nil {
+		t.Fatalf("cannot compress data: %s", err)
+	}
+	if err := d.SetParams(&ReaderParams{WindowLogMax: 15}); err != nil {
+		t.Fatalf("cannot set params: %s", err)
+	}
+	if _, err := d.Decompress(nil, cd); !errors.Is(err, ErrFrameParameterWindowTooLarge) {
+		t.Fatalf("unexpected error; got %v; want %v", err, ErrFrameParameterWindowTooLarge)
+	}
+}
+
+func TestCompressorDecompressorRelease(t *testing.T) {
+	c := NewCompressor()
+	c.Release()
+	c.Release()
+	if _, err := c.Compress(nil, []byte("foobar")); err != errReleasedCompressor {
+		t.Fatalf("unexpected error; got %v; want %v", err, errReleasedCompressor)
+	}
+	if err := c.SetLevel(5); err != errReleasedCompressor {
+		t.Fatalf("unexpected error; got %v; want %v", err, errReleasedCompressor)
+	}
+	if err := c.Reset(ResetSession); err != errReleasedCompressor {
+		t.Fatalf("unexpected error; got %v; want %v", err, errReleasedCompressor)
+	}
+
+	d := NewDecompressor()
+	d.Release()
+	d.Release()
+	if _, err := d.Decompress(nil, Compress(nil, []byte("foobar"))); err != errReleasedDecompressor {
+		t.Fatalf("unexpected error; got %v; want %v", err, errReleasedDecompressor)
+	}
+	if err := d.SetParams(&ReaderParams{}); err != errReleasedDecompressor {
+		t.Fatalf("unexpected error; got %v; want %v", err, errReleasedDecompressor)
+	}
+}
@@ -9,6 +9,7 @@ package gozstd
 #define ZDICT_STATIC_LINKING_ONLY
 #include "zdict.h"
 
+#include <stdlib.h>  // for free
 #include <stdint.h>  // for uintptr_t
 
 // The following *_wrapper functions allow avoiding memory allocations
@@ -23,10 +24,43 @@ static ZSTD_DDict* ZSTD_createDDict_wrapper(uintptr_t dictBuffer, size_t dictSiz
 	return ZSTD_createDDict((const void *)dictBuffer, dictSize);
 }
 
+static ZSTD_CDict* ZSTD_createCDictByRef_wrapper(uintptr_t dictBuffer, size_t dictSize, int dictContentType, int compressionLevel) {
+	ZSTD_customMem cmem = { NULL, NULL, NULL };
+	ZSTD_CCtx_params *params = ZSTD_createCCtxParams();
+	if (params == NULL) {
+		return NULL;
+	}
+	ZSTD_CDict *cdict = NULL;
+	if (!ZSTD_isError(ZSTD_CCtxParams_init(params, compressionLevel))) {
+		cdict = ZSTD_createCDict_advanced2((const void *)dictBuffer, dictSize, ZSTD_dlm_byRef, (ZSTD_dictContentType_e)dictContentType, params, cmem);
+	}
+	ZSTD_freeCCtxParams(params);
+	return cdict;
+}
+
+static ZSTD_CDict* ZSTD_createCDict_advanced2_wrapper(uintptr_t dictBuffer, size_t dictSize, uintptr_t params) {
+	ZSTD_customMem cmem = { NULL, NULL, NULL };
+	return ZSTD_createCDict_advanced2((const void *)dictBuffer, dictSize, ZSTD_dlm_byCopy, ZSTD_dct_auto, (const ZSTD_CCtx_params *)params, cmem);
+}
+
+static ZSTD_DDict* ZSTD_createDDictByRef_wrapper(uintptr_t dictBuffer, size_t dictSize, int dictContentType) {
+	ZSTD_customMem cmem = { NULL, NULL, NULL };
+	return ZSTD_createDDict_advanced((const void *)dictBuffer, dictSize, ZSTD_dlm_byRef, (ZSTD_dictContentType_e)dictContentType, cmem);
+}
+
+static unsigned ZDICT_getDictID_wrapper(uintptr_t dictBuffer, size_t dictSize) {
+	return ZDICT_getDictID((const void *)dictBuffer, dictSize);
+}
+
+static unsigned ZSTD_getDictID_fromFrame_wrapper(uintptr_t src, size_t srcSize) {
+	return ZSTD_getDictID_fromFrame((const void *)src, srcSize);
+}
+
 */
 import "C"
 
 import (
+	"errors"
 	"fmt"
 	"runtime"
 	"sync"
@@ -46,23 +80,9 @@ func BuildDict(samples [][]byte, desiredDictLen int) []byte {
 	}
 	dict := make([]byte, desiredDictLen)
 
-	// Calculate the total samples size.
-	samplesBufLen := 0
-	for _, sample := range samples {
-		if len(sample) == 0 {
-			// Skip empty samples.
-			continue
-		}
-		samplesBufLen += len(sample)
-	}
-
 	// Construct flat samplesBuf and samplesSizes.
-	samplesBuf := make([]byte, 0, samplesBufLen)
-	samplesSizes := make([]C.size_t, 0, len(samples))
-	for _, sample := range samples {
-		samplesBuf = append(samplesBuf, sample...)
-		samplesSizes = append(samplesSizes, C.size_t(len(sample)))
-	}
+	samplesBuf, samplesSizes := flattenSamples(samples)
+	samplesBufLen := len(samplesBuf)
 
 	// Add fake samples if the original samples are too small.
 	minSamplesBufLen := int(C.ZDICT_CONTENTSIZE_MIN)
@@ -76,18 +96,16 @@ func BuildDict(samples [][]byte, desiredDictLen int) []byte {
 		samplesBufLen += len(fakeSample)
 	}
 
-	// Run ZDICT_trainFromBuffer under lock, since it looks like it
-	// is unsafe for concurrent usage (it just randomly crashes).
-	// TODO: remove this restriction.
-
-	buildDictLock.Lock()
+	// ZDICT_trainFromBuffer uses fastCOVER algorithm with zero notification level,
+	// so it may run concurrently. See trainLock for details.
+	trainLock.RLock()
 	result := C.ZDICT_trainFromBuffer(
 		unsafe.Pointer(&dict[0]),
 		C.size_t(len(dict)),
 		unsafe.Pointer(&samplesBuf[0]),
 		&samplesSizes[0],
 		C.unsigned(len(samplesSizes)))
-	buildDictLock.Unlock()
+	trainLock.RUnlock()
 	if C.ZDICT_isError(result) != 0 {
 		// Return empty dictionary, since the original samples are too small.
 		return nil
@@ -97,7 +115,296 @@ func BuildDict(samples [][]byte, desiredDictLen int) []byte {
 	return dict[:dictLen]
 }
 
-var buildDictLock sync.Mutex
+// trainLock protects the global state of zstd dictionary trainers.
+//
+// BuildDict used to crash randomly when called concurrently, since old zstd
+// versions trained dictionaries in ZDICT_trainFromBuffer with COVER algorithm,
+// which sorted suffixes via qsort() with the comparator context stored
+// in a global variable. cover.c still does this on platforms without qsort_r(),
+// so COVER training takes the exclusive lock.
+//
+// Both fastcover.c and cover.c store the notification level in the global
+// g_displayLevel on every call, while progress logs update the global g_time.
+// Trainings with zero notification level store only zero in g_displayLevel
+// and never update g_time, so they run concurrently under the read lock.
+// Trainings with non-zero notification level take the exclusive lock.
+var trainLock sync.RWMutex
+
+// DictAlgorithm is the algorithm used for dictionary training.
+type DictAlgorithm int
+
+// The supported dictionary training algorithms.
+const (
+	// DictAlgorithmFastCover is the fastCOVER algorithm. It is used by BuildDict.
+	DictAlgorithmFastCover DictAlgorithm = 0
+	// DictAlgorithmCover is the COVER algorithm. It is slower than fastCOVER,
+	// but may produce better dictionaries. COVER trainings don't run
+	// concurrently with other dictionary trainings, since COVER may rely
+	// on global state depending on the platform.
+	DictAlgorithmCover DictAlgorithm = 1
+)
+
+// DefaultDictSize is the default maximum size of dictionaries built by BuildDictParams.
+const DefaultDictSize = 110 * 1024 // from zstd/programs/zstdcli.c
+
+// DictParams contains parameters for BuildDictParams.
+//
+// Zero values mean the defaults chosen by zstd.
+type DictParams struct {
+	// DictSize is the maximum size of the dictionary.
+	// Special value 0 means 'use DefaultDictSize' in BuildDictParams.
+	// See FinalizeDict for the meaning of zero DictSize there.
+	DictSize int
+
+	// Algorithm is the training algorithm.
+	Algorithm DictAlgorithm
+
+	// K is the segment size. Reasonable range is [16..2048+].
+	// K and D are searched if either of them is zero.
+	K int
+
+	// D is the dmer size. It mustn't exceed K. Reasonable range is [6..16].
+	// K and D are searched if either of them is zero.
+	D int
+
+	// F is log of the size of frequency array in the range [1..31].
+	// It is used only by DictAlgorithmFastCover.
+	F int
+
+	// Steps is the number of steps when searching K and D.
+	// Higher values mean more parameters checked.
+	Steps int
+
+	// SplitPoint is the share of samples used for training when searching
+	// K and D. The rest of samples is used for testing. 1.0 means all
+	// the samples are used for both training and testing.
+	SplitPoint float64
+
+	// Accel is acceleration level in the range [1..10]. Higher values
+	// mean faster and less accurate training.
+	// It is used only by DictAlgorithmFastCover.
+	Accel int
+
+	// Threads is the number of threads used for searching K and D.
+	Threads int
+
+	// CompressionLevel is the compression level the dictionary
+	// is optimized for.
+	CompressionLevel int
+
+	// NotificationLevel is the verbosity level of logs written to stderr:
+	// 0 - none, 1 - errors, 2 - progression, 3 - details, 4 - debug.
+	//
+	// The level is stored in a global variable by zstd, so BuildDictParams
+	// calls with non-zero NotificationLevel don't run concurrently
+	// with other dictionary trainings.
+	NotificationLevel int
+
+	// DictID is the dictionary id. Special value 0 means random id.
+	DictID uint32
+}
+
+// BuildDictParams returns dictionary built from the given samples
+// using the given params.
+//
+// The parameters used for training are returned together with the dictionary.
+// They contain the chosen K and D if they were searched.
+//
+// Calling BuildDictParams with nil params is equivalent to calling it
+// with zero DictParams.
+//
+// The returned dictionary may be passed to NewCDict* and NewDDict.
+func BuildDictParams(samples [][]byte, params *DictParams) ([]byte, *DictParams, error) {
+	if params == nil {
+		params = &DictParams{}
+	}
+	p := *params
+	if p.DictSize == 0 {
+		p.DictSize = DefaultDictSize
+	}
+	if p.DictSize < minDictLen {
+		return nil, nil, fmt.Errorf("DictSize=%d cannot be smaller than %d", p.DictSize, minDictLen)
+	}
+	samplesBuf, samplesSizes := flattenSamples(samples)
+	if len(samplesSizes) == 0 {
+		return nil, nil, fmt.Errorf("samples cannot be empty")
+	}
+	dict := make([]byte, p.DictSize)
+	zParams := C.ZDICT_params_t{
+		compressionLevel:  C.int(p.CompressionLevel),
+		notificationLevel: C.unsigned(p.NotificationLevel),
+		dictID:            C.unsigned(p.DictID),
+	}
+	optimize := p.K == 0 || p.D == 0
+
+	// See trainLock for details.
+	if p.Algorithm == DictAlgorithmCover || p.NotificationLevel != 0 {
+		trainLock.Lock()
+		defer trainLock.Unlock()
+	} else {
+		trainLock.RLock()
+		defer trainLock.RUnlock()
+	}
+
+	var result C.size_t
+	switch p.Algorithm {
+	case DictAlgorithmFastCover:
+		cp := C.ZDICT_fastCover_params_t{
+			k:          C.unsigned(p.K),
+			d:          C.unsigned(p.D),
+			f:          C.unsigned(p.F),
+			steps:      C.unsigned(p.Steps),
+			nbThreads:  C.unsigned(p.Threads),
+			splitPoint: C.double(p.SplitPoint),
+			accel:      C.unsigned(p.Accel),
+			zParams:    zParams,
+		}
+		if optimize {
+			result = C.ZDICT_optimizeTrainFromBuffer_fastCover(
+				unsafe.Pointer(&dict[0]),
+				C.size_t(len(dict)),
+				unsafe.Pointer(&samplesBuf[0]),
+				&samplesSizes[0],
+				C.unsigned(len(samplesSizes)),
+				&cp)
+		} else {
+			result = C.ZDICT_trainFromBuffer_fastCover(
+				unsafe.Pointer(&dict[0]),
+				C.size_t(len(dict)),
+				unsafe.Pointer(&samplesBuf[0]),
+				&samplesSizes[0],
+				C.unsigned(len(samplesSizes)),
+				cp)
+		}
+		p.K = int(cp.k)
+		p.D = int(cp.d)
+		p.F = int(cp.f)
+		p.Steps = int(cp.steps)
+		p.SplitPoint = float64(cp.splitPoint)
+		p.Accel = int(cp.accel)
+	case DictAlgorithmCover:
+		cp := C.ZDICT_cover_params_t{
+			k:          C.unsigned(p.K),
+			d:          C.unsigned(p.D),
+			steps:      C.unsigned(p.Steps),
+			nbThreads:  C.unsigned(p.Threads),
+			splitPoint: C.double(p.SplitPoint),
+			zParams:    zParams,
+		}
+		if optimize {
+			result = C.ZDICT_optimizeTrainFromBuffer_cover(
+				unsafe.Pointer(&dict[0]),
+				C.size_t(len(dict)),
+				unsafe.Pointer(&samplesBuf[0]),
+				&samplesSizes[0],
+				C.unsigned(len(samplesSizes)),
+				&cp)
+		} else {
+			result = C.ZDICT_trainFromBuffer_cover(
+				unsafe.Pointer(&dict[0]),
+				C.size_t(len(dict)),
+				unsafe.Pointer(&samplesBuf[0]),
+				&samplesSizes[0],
+				C.unsigned(len(samplesSizes)),
+				cp)
+		}
+		p.K = int(cp.k)
+		p.D = int(cp.d)
+		p.Steps = int(cp.steps)
+		p.SplitPoint = float64(cp.splitPoint)
+	default:
+		return nil, nil, fmt.Errorf("unsupported Algorithm=%d", p.Algorithm)
+	}
+	if C.ZDICT_isError(result) != 0 {
+		return nil, nil, fmt.Errorf("cannot build dictionary: %w", newError(result))
+	}
+	p.DictID = DictID(dict[:result])
+	return dict[:result], &p, nil
+}
+
+// FinalizeDict returns dictionary built from the given content.
+//
+// The content is used as is, while samples are used for building entropy
+// tables stored in the dictionary header. The most profitable content
+// should be put at the end, since the beginning of the content is truncated
+// if it doesn't fit params.DictSize.
+//
+// Only DictSize, CompressionLevel, NotificationLevel and DictID are used
+// from params. Special value 0 for DictSize means the content size
+// plus the room for dictionary header.
+//
+// Calling FinalizeDict with nil params is equivalent to calling it
+// with zero DictParams.
+//
+// The returned dictionary may be passed to NewCDict* and NewDDict.
+func FinalizeDict(content []byte, samples [][]byte, params *DictParams) ([]byte, error) {
+	if params == nil {
+		params = &DictParams{}
+	}
+	if len(content) == 0 {
+		return nil, fmt.Errorf("content cannot be empty")
+	}
+	dictSize := params.DictSize
+	if dictSize == 0 {
+		dictSize = len(content) + maxDictHeaderLen
+	}
+	if dictSize < minDictLen {
+		dictSize = minDictLen
+	}
+	if dictSize < len(content) {
+		return nil, fmt.Errorf("DictSize=%d cannot be smaller than the content size %d", params.DictSize, len(content))
+	}
+	samplesBuf, samplesSizes := flattenSamples(samples)
+	if len(samplesSizes) == 0 {
+		return nil, fmt.Errorf("samples cannot be empty")
+	}
+
+	dict := make([]byte, dictSize)
+	zParams := C.ZDICT_params_t{
+		compressionLevel:  C.int(params.CompressionLevel),
+		notificationLevel: C.unsigned(params.NotificationLevel),
+		dictID:            C.unsigned(params.DictID),
+	}
+	result := C.ZDICT_finalizeDictionary(
+		unsafe.Pointer(&dict[0]),
+		C.size_t(len(dict)),
+		unsafe.Pointer(&content[0]),
+		C.size_t(len(content)),
+		unsafe.Pointer(&samplesBuf[0]),
+		&samplesSizes[0],
+		C.unsigned(len(samplesSizes)),
+		zParams)
+	if C.ZDICT_isError(result) != 0 {
+		return nil, fmt.Errorf("cannot finalize dictionary: %w", newError(result))
+	}
+	return dict[:result], nil
+}
+
+// maxDictHeaderLen is the maximum size of the dictionary header
+// written by ZDICT_finalizeDictionary.
+const maxDictHeaderLen = 256 // HBUFFSIZE from zstd/lib/dictBuilder/zdict.c
+
+// flattenSamples returns samples concatenated into a flat buffer
+// and the sizes of non-empty samples.
+func flattenSamples(samples [][]byte) ([]byte, []C.size_t) {
+	samplesBufLen := 0
+	for _, sample := range samples {
+		samplesBufLen += len(sample)
+	}
+	samplesBuf := make([]byte, 0, samplesBufLen)
+	samplesSizes := make([]C.size_t, 0, len(samples))
+	for _, sample := range samples {
+		if len(sample) == 0 {
+			// Skip empty samples.
+			continue
+		}
+		samplesBuf = append(samplesBuf, sample...)
+		samplesSizes = append(samplesSizes, C.size_t(len(sample)))
+	}
+	return samplesBuf, samplesSizes
+}
+
+var errReleasedCDict = errors.New("cannot use released CDict")
 
 // CDict is a dictionary used for compression.
 //
@@ -105,6 +412,12 @@ var buildDictLock sync.Mutex
 type CDict struct {
 	p                *C.ZSTD_CDict
 	compressionLevel int
+
+	// buf is the buffer referenced by p if cd is created with NewCDictByRef.
+	buf *DictBuffer
+
+	// memSize is the size of p accounted in Stats.
+	memSize int
 }
 
 // NewCDict creates new CDict from the given dict.
@@ -132,10 +445,138 @@ func NewCDictLevel(dict []byte, compressionLevel int) (*CDict, error) {
 	}
 	// Prevent from GC'ing of dict during CGO call above.
 	runtime.KeepAlive(dict)
+	if cd.p != nil {
+		cdictMem.track(&cd.memSize, int(C.ZSTD_sizeof_CDict(cd.p)))
+	}
 	runtime.SetFinalizer(cd, freeCDict)
 	return cd, nil
 }
 
+// CDictParams contains parameters for NewCDictParams.
+type CDictParams struct {
+	// CompressionLevel is the compression level.
+	// Special value 0 means 'default compression level'.
+	CompressionLevel int
+
+	// The following parameters tune the compression with the dictionary.
+	// Special value 0 means 'use the default value', which depends
+	// on CompressionLevel and on the dictionary size.
+	// See the corresponding fields in WriterParams for details.
+	//
+	// All the parameters except CompressionLevel are validated against
+	// the bounds supported by zstd.
+
+	// WindowLog is the maximum allowed back-reference distance, as a power of 2.
+	WindowLog int
+
+	// Strategy is compression strategy.
+	Strategy Strategy
+
+	// HashLog is the size of the initial probe table, as a power of 2.
+	HashLog int
+
+	// ChainLog is the size of the multi-probe search table, as a power of 2.
+	ChainLog int
+
+	// SearchLog is the number of search attempts, as a power of 2.
+	SearchLog int
+
+	// MinMatch is the minimum size of searched matches.
+	MinMatch int
+
+	// TargetLength impact depends on Strategy.
+	TargetLength int
+
+	// EnableDedicatedDictSearch enables search structures optimized
+	// for compression with the dictionary. This speeds up the compression
+	// at the cost of slower CDict creation and bigger CDict size.
+	//
+	// It is used only for StrategyGreedy, StrategyLazy and StrategyLazy2,
+	// i.e. for compression levels from 5 to 12 by default.
+	// Otherwise it is ignored.
+	EnableDedicatedDictSearch bool
+}
+
+// NewCDictParams creates new CDict from the given dict using the given params.
+//
+// Unlike NewCDictLevel, it allows tuning the parameters used
+// for compression with the dictionary. These parameters supersede
+// the corresponding WriterParams when the returned dict is used.
+//
+// Call Release when the returned dict is no longer used.
+func NewCDictParams(dict []byte, params *CDictParams) (*CDict, error) {
+	if len(dict) == 0 {
+		return nil, fmt.Errorf("dict cannot be empty")
+	}
+	if params == nil {
+		params = &CDictParams{}
+	}
+
+	cctxParams := C.ZSTD_createCCtxParams()
+	if cctxParams == nil {
+		return nil, fmt.Errorf("cannot allocate params for CDict")
+	}
+	defer C.ZSTD_freeCCtxParams(cctxParams)
+	if err := initCDictParams(cctxParams, params); err != nil {
+		return nil, err
+	}
+
+	cdict := C.ZSTD_createCDict_advanced2_wrapper(
+		C.uintptr_t(uintptr(unsafe.Pointer(&dict[0]))),
+		C.size_t(len(dict)),
+		C.uintptr_t(uintptr(unsafe.Pointer(cctxParams))))
+	// Prevent from GC'ing of dict during CGO call above.
+	runtime.KeepAlive(dict)
+	if cdict == nil {
+		return nil, fmt.Errorf("cannot create CDict with params %+v", params)
+	}
+	cd := &CDict{
+		p:                cdict,
+		compressionLevel: params.CompressionLevel,
+	}
+	cdictMem.track(&cd.memSize, int(C.ZSTD_sizeof_CDict(cd.p)))
+	runtime.SetFinalizer(cd, freeCDict)
+	return cd, nil
+}
+
+func initCDictParams(cctxParams *C.ZSTD_CCtx_params, params *CDictParams) error {
+	// Do not validate the compression level, since zstd clamps it
+	// to the supported range.
+	result := C.ZSTD_CCtxParams_init(cctxParams, C.int(params.CompressionLevel))
+	if C.ZSTD_getErrorCode(result) != 0 {
+		return fmt.Errorf("cannot set CompressionLevel=%d: %w", params.CompressionLevel, newError(result))
+	}
+
+	cParams := [...]struct {
+		name  string
+		param C.ZSTD_cParameter
+		value int
+		set   bool
+	}{
+		{"WindowLog", C.ZSTD_c_windowLog, params.WindowLog, params.WindowLog != 0},
+		{"Strategy", C.ZSTD_c_strategy, int(params.Strategy), params.Strategy != 0},
+		{"HashLog", C.ZSTD_c_hashLog, params.HashLog, params.HashLog != 0},
+		{"ChainLog", C.ZSTD_c_chainLog, params.ChainLog, params.ChainLog != 0},
+		{"SearchLog", C.ZSTD_c_searchLog, params.SearchLog, params.SearchLog != 0},
+		{"MinMatch", C.ZSTD_c_minMatch, params.MinMatch, params.MinMatch != 0},
+		{"TargetLength", C.ZSTD_c_targetLength, params.TargetLength, params.TargetLength != 0},
+		{"EnableDedicatedDictSearch", C.ZSTD_c_enableDedicatedDictSearch, 1, params.EnableDedicatedDictSearch},
+	}
+	for _, p := range cParams {
+		if !p.set {
+			continue
+		}
+		if err := checkCParamBounds(p.name, p.param, p.value); err != nil {
+			return err
+		}
+		result := C.ZSTD_CCtxParams_setParameter(cctxParams, p.param, C.int(p.value))
+		if C.ZSTD_getErrorCode(result) != 0 {
+			return fmt.Errorf("cannot set %s=%d: %w", p.name, p.value, newError(result))
+		}
+	}
+	return nil
+}
+
 // Release releases resources occupied by cd.
 //
 // cd cannot be used after the release.
@@ -146,17 +587,46 @@ func (cd *CDict) Release() {
 	result := C.ZSTD_freeCDict(cd.p)
 	ensureNoError("ZSTD_freeCDict", result)
 	cd.p = nil
+	cdictMem.untrack(&cd.memSize)
+	if cd.buf != nil {
+		cd.buf.decRef()
+		cd.buf = nil
+	}
 }
 
 func freeCDict(v interface{}) {
 	v.(*CDict).Release()
 }
 
+// ID returns the dictionary id for cd.
+//
+// Zero is returned for raw content dictionaries and for released cd.
+func (cd *CDict) ID() uint32 {
+	if cd.p == nil {
+		return 0
+	}
+	return uint32(C.ZSTD_getDictID_fromCDict(cd.p))
+}
+
+// SizeOf returns the size of memory occupied by cd in bytes.
+func (cd *CDict) SizeOf() int {
+	if cd.p == nil {
+		return 0
+	}
+	return int(C.ZSTD_sizeof_CDict(cd.p))
+}
+
 // DDict is a dictionary used for decompression.
 //
 // A single DDict may be re-used in concurrently running goroutines.
 type DDict struct {
 	p *C.ZSTD_DDict
+
+	// buf is the buffer referenced by p if dd is created with NewDDictByRef.
+	buf *DictBuffer
+
+	// memSize is the size of p accounted in Stats.
+	memSize int
 }
 
 // NewDDict creates new DDict from the given dict.
@@ -174,6 +644,9 @@ func NewDDict(dict []byte) (*DDict, error) {
 	}
 	// Prevent from GC'ing of dict during CGO call above.
 	runtime.KeepAlive(dict)
+	if dd.p != nil {
+		ddictMem.track(&dd.memSize, int(C.ZSTD_sizeof_DDict(dd.p)))
+	}
 	runtime.SetFinalizer(dd, freeDDict)
 	return dd, nil
 }
@@ -189,8 +662,302 @@ func (dd *DDict) Release() {
 	result := C.ZSTD_freeDDict(dd.p)
 	ensureNoError("ZSTD_freeDDict", result)
 	dd.p = nil
+	ddictMem.untrack(&dd.memSize)
+	if dd.buf != nil {
+		dd.buf.decRef()
+		dd.buf = nil
+	}
 }
 
 func freeDDict(v interface{}) {
 	v.(*DDict).Release()
 }
+
+// ID returns the dictionary id for dd.
+//
+// Zero is returned for raw content dictionaries and for released dd.
+func (dd *DDict) ID() uint32 {
+	if dd.p == nil {
+		return 0
+	}
+	return uint32(C.ZSTD_getDictID_fromDDict(dd.p))
+}
+
+// SizeOf returns the size of memory occupied by dd in bytes.
+func (dd *DDict) SizeOf() int {
+	if dd.p == nil {
+		return 0
+	}
+	return int(C.ZSTD_sizeof_DDict(dd.p))
+}
+
+// DictContentType is the type of dictionary content.
+type DictContentType int
+
+// The supported dictionary content types.
+const (
+	// DictContentAuto treats the dictionary as a full zstd dictionary
+	// if it starts with the dictionary magic number. Otherwise it is treated
+	// as a raw content dictionary. This is what NewCDict* and NewDDict do.
+	DictContentAuto DictContentType = 0 // from zstd.h
+	// DictContentRaw treats the dictionary as a raw content dictionary.
+	DictContentRaw DictContentType = 1 // from zstd.h
+	// DictContentFull requires a full zstd dictionary, such as the one
+	// returned by BuildDict*.
+	DictContentFull DictContentType = 2 // from zstd.h
+)
+
+// DictBuffer holds dictionary contents in C memory.
+//
+// NewCDict* and NewDDict copy the dictionary contents into every created dict.
+// Dicts created with NewCDictByRef and NewDDictByRef reference DictBuffer
+// instead, so a single copy of big dictionary may be shared among
+// multiple dicts.
+type DictBuffer struct {
+	mu       sync.Mutex
+	p        unsafe.Pointer
+	size     int
+	refs     int
+	released bool
+}
+
+// NewDictBuffer copies dict into new DictBuffer.
+//
+// dict may be modified or dropped after the call.
+//
+// Call Release when the returned DictBuffer is no longer needed.
+// The memory is freed after all the dicts referencing it are released.
+func NewDictBuffer(dict []byte) (*DictBuffer, error) {
+	if len(dict) == 0 {
+		return nil, fmt.Errorf("dict cannot be empty")
+	}
+	db := &DictBuffer{
+		p:    C.CBytes(dict),
+		size: len(dict),
+	}
+	runtime.SetFinalizer(db, freeDictBuffer)
+	return db, nil
+}
+
+// Release releases db.
+//
+// db cannot be used for creating new dicts after the release.
+// The dicts created from db remain usable until they are released.
+func (db *DictBuffer) Release() {
+	db.mu.Lock()
+	db.released = true
+	if db.refs == 0 {
+		db.free()
+	}
+	db.mu.Unlock()
+}
+
+// Len returns the size of dictionary contents in db.
+func (db *DictBuffer) Len() int {
+	return db.size
+}
+
+func freeDictBuffer(v interface{}) {
+	v.(*DictBuffer).Release()
+}
+
+func (db *DictBuffer) incRef() (unsafe.Pointer, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.released {
+		return nil, errReleasedDictBuffer
+	}
+	db.refs++
+	return db.p, nil
+}
+
+func (db *DictBuffer) decRef() {
+	db.mu.Lock()
+	db.refs--
+	if db.refs == 0 && db.released {
+		db.free()
+	}
+	db.mu.Unlock()
+}
+
+func (db *DictBuffer) free() {
+	C.free(db.p)
+	db.p = nil
+}
+
+var errReleasedDictBuffer = errors.New("cannot use released DictBuffer")
+
+// NewCDictByRef creates new CDict referencing the contents of db
+// using the given compressionLevel and dictContentType.
+//
+// Unlike NewCDictLevel, the dictionary contents isn't copied.
+// db remains in use until the returned dict is released.
+//
+// Call Release when the returned dict is no longer used.
+func NewCDictByRef(db *DictBuffer, compressionLevel int, dictContentType DictContentType) (*CDict, error) {
+	p, err := db.incRef()
+	if err != nil {
+		return nil, err
+	}
+	cdict := C.ZSTD_createCDictByRef_wrapper(
+		C.uintptr_t(uintptr(p)),
+		C.size_t(db.size),
+		C.int(dictContentType),
+		C.int(compressionLevel))
+	if cdict == nil {
+		db.decRef()
+		return nil, fmt.Errorf("cannot create CDict with dictContentType=%d", dictContentType)
+	}
+	cd := &CDict{
+		p:                cdict,
+		compressionLevel: compressionLevel,
+		buf:              db,
+	}
+	cdictMem.track(&cd.memSize, int(C.ZSTD_sizeof_CDict(cd.p)))
+	runtime.SetFinalizer(cd, freeCDict)
+	return cd, nil
+}
+
+// NewDDictByRef creates new DDict referencing the contents of db
+// using the given dictContentType.
+//
+// Unlike NewDDict, the dictionary contents isn't copied.
+// db remains in use until the returned dict is released.
+//
+// Call Release when the returned dict is no longer needed.
+func NewDDictByRef(db *DictBuffer, dictContentType DictContentType) (*DDict, error) {
+	p, err := db.incRef()
+	if err != nil {
+		return nil, err
+	}
+	ddict := C.ZSTD_createDDictByRef_wrapper(
+		C.uintptr_t(uintptr(p)),
+		C.size_t(db.size),
+		C.int(dictContentType))
+	if ddict == nil {
+		db.decRef()
+		return nil, fmt.Errorf("cannot create DDict with dictContentType=%d", dictContentType)
+	}
+	dd := &DDict{
+		p:   ddict,
+		buf: db,
+	}
+	ddictMem.track(&dd.memSize, int(C.ZSTD_sizeof_DDict(dd.p)))
+	runtime.SetFinalizer(dd, freeDDict)
+	return dd, nil
+}
+
+// DictID returns the dictionary id stored in dict.
+//
+// Zero is returned if dict isn't a valid zstd dictionary,
+// i.e. it is a raw content dictionary.
+func DictID(dict []byte) uint32 {
+	if len(dict) == 0 {
+		return 0
+	}
+	id := C.ZDICT_getDictID_wrapper(
+		C.uintptr_t(uintptr(unsafe.Pointer(&dict[0]))),
+		C.size_t(len(dict)))
+	// Prevent from GC'ing of dict during CGO call above.
+	runtime.KeepAlive(dict)
+	return uint32(id)
+}
+
+// DictIDFromFrame returns the id of the dictionary required
+// for decompressing the first frame in src.
+//
+// Zero is returned if the frame doesn't need a dictionary,
+// if the dictionary id isn't stored in the frame header
+// (see WriterParams.DisableDictID) or if src doesn't start with
+// a valid frame header. Use ParseFrameHeader for distinguishing
+// between these cases.
+func DictIDFromFrame(src []byte) uint32 {
+	if len(src) == 0 {
+		return 0
+	}
+	id := C.ZSTD_getDictID_fromFrame_wrapper(
+		C.uintptr_t(uintptr(unsafe.Pointer(&src[0]))),
+		C.size_t(len(src)))
+	// Prevent from GC'ing of src during CGO call above.
+	runtime.KeepAlive(src)
+	return uint32(id)
+}
+
+// DictRegistry maps dictionary ids to DDicts.
+//
+// Set ReaderParams.Dicts to DictRegistry in order to decompress frames
+// compressed with distinct dictionaries. The dictionary for every frame
+// is selected by the dictionary id stored in the frame header.
+//
+// DictRegistry may be used concurrently from multiple goroutines.
+// Dictionaries may be added to DictRegistry while it is in use.
+type DictRegistry struct {
+	mu    sync.RWMutex
+	dicts map[uint32]*DDict
+}
+
+// NewDictRegistry returns new DictRegistry containing the given dicts.
+func NewDictRegistry(dicts ...*DDict) (*DictRegistry, error) {
+	dr := &DictRegistry{
+		dicts: make(map[uint32]*DDict, len(dicts)),
+	}
+	for _, dd := range dicts {
+		if err := dr.Add(dd); err != nil {
+			return nil, err
+		}
+	}
+	return dr, nil
+}
+
+// Add adds dd to dr.
+//
+// dd replaces the previously added dictionary with the same id.
+// Dictionaries without id, such as raw content dictionaries,
+// cannot be added to dr.
+func (dr *DictRegistry) Add(dd *DDict) error {
+	if dd.p == nil {
+		return errReleasedDDict
+	}
+	id := dd.ID()
+	if id == 0 {
+		return fmt.Errorf("cannot add dictionary without id to DictRegistry")
+	}
+	dr.mu.Lock()
+	dr.dicts[id] = dd
+	dr.mu.Unlock()
+	return nil
+}
+
+// Remove removes dictionary with the given id from dr.
+//
+// The removed dictionary mustn't be released until all the Readers
+// using dr are released or reset, since they may still reference it.
+func (dr *DictRegistry) Remove(id uint32) {
+	dr.mu.Lock()
+	delete(dr.dicts, id)
+	dr.mu.Unlock()
+}
+
+// Get returns dictionary with the given id from dr.
+//
+// nil is returned if dr doesn't contain dictionary with the given id.
+func (dr *DictRegistry) Get(id uint32) *DDict {
+	dr.mu.RLock()
+	dd := dr.dicts[id]
+	dr.mu.RUnlock()
+	return dd
+}
+
+// MissingDictError is returned when the frame requires a dictionary,
+// which is missing in ReaderParams.Dicts.
+type MissingDictError struct {
+	// DictID is the id of the missing dictionary.
+	DictID uint32
+}
+
+// Error implements error interface.
+func (e *MissingDictError) Error() string {
+	return fmt.Sprintf("missing dictionary with id=%d", e.DictID)
+}
+
+var errReleasedDDict = errors.New("cannot use released DDict")
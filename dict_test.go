@@ -1,7 +1,11 @@
 package gozstd
 
 import (
+	"bytes"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"math/rand"
 	"testing"
 	"time"
@@ -105,3 +109,668 @@ func testBuildDict(t *testing.T, samples [][]byte, desiredDictLen int) {
 		}
 	}
 }
+
+func TestDictRegistry(t *testing.T) {
+	var dicts [2][]byte
+	var cds [2]*CDict
+	var dds [2]*DDict
+	for i := range dicts {
+		var samples [][]byte
+		for j := 0; j < 1000; j++ {
+			samples = append(samples, []byte(fmt.Sprintf("sample %d for dict %d", j, i)))
+		}
+		dicts[i] = BuildDict(samples, 8*1024)
+		cd, err := NewCDict(dicts[i])
+		if err != nil {
+			t.Fatalf("cannot create CDict: %s", err)
+		}
+		defer cd.Release()
+		cds[i] = cd
+		dd, err := NewDDict(dicts[i])
+		if err != nil {
+			t.Fatalf("cannot create DDict: %s", err)
+		}
+		defer dd.Release()
+		dds[i] = dd
+	}
+
+	// Compress frames with distinct dicts.
+	var cd, plainData []byte
+	for i := 0; i < 10; i++ {
+		data := []byte(fmt.Sprintf("sample %d for dict %d", i, i%3))
+		switch i % 3 {
+		case 0, 1:
+			cd = CompressDict(cd, data, cds[i%3])
+		default:
+			cd = Compress(cd, data)
+		}
+		plainData = append(plainData, data...)
+	}
+
+	dr, err := NewDictRegistry(dds[0])
+	if err != nil {
+		t.Fatalf("cannot create DictRegistry: %s", err)
+	}
+	params := &ReaderParams{
+		Dicts: dr,
+	}
+
+	// The second dict is missing.
+	_, err = DecompressParams(nil, cd, params)
+	var mde *MissingDictError
+	if !errors.As(err, &mde) {
+		t.Fatalf("unexpected error; got %v; want MissingDictError", err)
+	}
+	if id := DictID(dicts[1]); mde.DictID != id {
+		t.Fatalf("unexpected DictID in MissingDictError; got %d; want %d", mde.DictID, id)
+	}
+
+	zr := NewReaderParams(bytes.NewReader(cd), params)
+	defer zr.Release()
+	if _, err := ioutil.ReadAll(zr); !errors.As(err, &mde) {
+		t.Fatalf("unexpected error; got %v; want MissingDictError", err)
+	}
+
+	// Add the missing dict to the registry in use.
+	if err := dr.Add(dds[1]); err != nil {
+		t.Fatalf("cannot add dict to DictRegistry: %s", err)
+	}
+	zr.Reset(bytes.NewReader(cd), nil)
+	data, err := ioutil.ReadAll(zr)
+	if err != nil {
+		t.Fatalf("cannot read data: %s", err)
+	}
+	if !bytes.Equal(data, plainData) {
+		t.Fatalf("unexpected data read; got\n%q; want\n%q", data, plainData)
+	}
+	data, err = DecompressParams(nil, cd, params)
+	if err != nil {
+		t.Fatalf("cannot decompress data: %s", err)
+	}
+	if !bytes.Equal(data, plainData) {
+		t.Fatalf("unexpected data decompressed; got\n%q; want\n%q", data, plainData)
+	}
+
+	// Remove the dict.
+	dr.Remove(mde.DictID)
+	if dd := dr.Get(mde.DictID); dd != nil {
+		t.Fatalf("unexpected dict returned after removal")
+	}
+	if _, err := DecompressParams(nil, cd, params); !errors.As(err, &mde) {
+		t.Fatalf("unexpected error; got %v; want MissingDictError", err)
+	}
+}
+
+func TestDictRegistryRemoveReleasedDict(t *testing.T) {
+	var cds [2]*CDict
+	var dds [2]*DDict
+	for i := range dds {
+		var samples [][]byte
+		for j := 0; j < 1000; j++ {
+			samples = append(samples, []byte(fmt.Sprintf("sample %d for rotated dict %d", j, i)))
+		}
+		dict := BuildDict(samples, 8*1024)
+		cd, err := NewCDict(dict)
+		if err != nil {
+			t.Fatalf("cannot create CDict: %s", err)
+		}
+		defer cd.Release()
+		cds[i] = cd
+		dd, err := NewDDict(dict)
+		if err != nil {
+			t.Fatalf("cannot create DDict: %s", err)
+		}
+		dds[i] = dd
+	}
+	defer dds[1].Release()
+	if dds[0].ID() == dds[1].ID() {
+		t.Fatalf("dictionaries must have distinct ids; got %d", dds[0].ID())
+	}
+
+	dr, err := NewDictRegistry(dds[0])
+	if err != nil {
+		t.Fatalf("cannot create DictRegistry: %s", err)
+	}
+	params := &ReaderParams{
+		Dicts: dr,
+	}
+	for i := range dds {
+		if i > 0 {
+			// Rotate the dictionary. The pooled Readers mustn't reference
+			// the released dictionary.
+			dr.Remove(dds[i-1].ID())
+			dds[i-1].Release()
+			if err := dr.Add(dds[i]); err != nil {
+				t.Fatalf("cannot add dict to DictRegistry: %s", err)
+			}
+		}
+		data := []byte(fmt.Sprintf("sample %d for rotated dict %d", i, i))
+		cd := CompressDict(nil, data, cds[i])
+		for j := 0; j < 10; j++ {
+			plainData, err := DecompressParams(nil, cd, params)
+			if err != nil {
+				t.Fatalf("cannot decompress data with dict #%d: %s", i, err)
+			}
+			if !bytes.Equal(plainData, data) {
+				t.Fatalf("unexpected data decompressed; got %q; want %q", plainData, data)
+			}
+		}
+	}
+}
+
+func TestDictRegistryInvalidDict(t *testing.T) {
+	dr, err := NewDictRegistry()
+	if err != nil {
+		t.Fatalf("cannot create DictRegistry: %s", err)
+	}
+
+	// Raw content dictionaries have no id.
+	dd, err := NewDDict([]byte("raw content dictionary"))
+	if err != nil {
+		t.Fatalf("cannot create DDict: %s", err)
+	}
+	if err := dr.Add(dd); err == nil {
+		t.Fatalf("expecting non-nil error when adding dict without id")
+	}
+	dd.Release()
+	if err := dr.Add(dd); err == nil {
+		t.Fatalf("expecting non-nil error when adding released dict")
+	}
+}
+
+func TestDictIDs(t *testing.T) {
+	var samples [][]byte
+	for i := 0; i < 1000; i++ {
+		samples = append(samples, []byte(fmt.Sprintf("sample %d", i)))
+	}
+	dict := BuildDict(samples, 8*1024)
+	id := DictID(dict)
+	if id == 0 {
+		t.Fatalf("expecting non-zero dict id")
+	}
+	if n := binary.LittleEndian.Uint32(dict[4:]); id != n {
+		t.Fatalf("unexpected dict id; got %d; want %d", id, n)
+	}
+
+	cd, err := NewCDict(dict)
+	if err != nil {
+		t.Fatalf("cannot create CDict: %s", err)
+	}
+	dd, err := NewDDict(dict)
+	if err != nil {
+		t.Fatalf("cannot create DDict: %s", err)
+	}
+	if cd.ID() != id {
+		t.Fatalf("unexpected CDict id; got %d; want %d", cd.ID(), id)
+	}
+	if dd.ID() != id {
+		t.Fatalf("unexpected DDict id; got %d; want %d", dd.ID(), id)
+	}
+	if cd.SizeOf() < len(dict) {
+		t.Fatalf("too small CDict size; got %d; want at least %d", cd.SizeOf(), len(dict))
+	}
+	if dd.SizeOf() < len(dict) {
+		t.Fatalf("too small DDict size; got %d; want at least %d", dd.SizeOf(), len(dict))
+	}
+
+	src := []byte("sample 123")
+	if n := DictIDFromFrame(CompressDict(nil, src, cd)); n != id {
+		t.Fatalf("unexpected dict id in frame; got %d; want %d", n, id)
+	}
+	if n := DictIDFromFrame(Compress(nil, src)); n != 0 {
+		t.Fatalf("unexpected dict id in frame without dict; got %d; want 0", n)
+	}
+	if n := DictIDFromFrame(nil); n != 0 {
+		t.Fatalf("unexpected dict id for empty src; got %d; want 0", n)
+	}
+
+	cd.Release()
+	dd.Release()
+	if cd.ID() != 0 || cd.SizeOf() != 0 {
+		t.Fatalf("unexpected id=%d, size=%d for released CDict", cd.ID(), cd.SizeOf())
+	}
+	if dd.ID() != 0 || dd.SizeOf() != 0 {
+		t.Fatalf("unexpected id=%d, size=%d for released DDict", dd.ID(), dd.SizeOf())
+	}
+
+	// Raw content dictionaries have no id.
+	rawDict := []byte("raw content dictionary")
+	if n := DictID(rawDict); n != 0 {
+		t.Fatalf("unexpected id for raw content dict; got %d; want 0", n)
+	}
+	if n := DictID(nil); n != 0 {
+		t.Fatalf("unexpected id for empty dict; got %d; want 0", n)
+	}
+}
+
+func TestDictByRef(t *testing.T) {
+	var samples [][]byte
+	for i := 0; i < 1000; i++ {
+		samples = append(samples, []byte(fmt.Sprintf(`{"id":%d,"name":"sample %d"}`, i, i)))
+	}
+	dict := BuildDict(samples, 8*1024)
+	id := DictID(dict)
+
+	db, err := NewDictBuffer(dict)
+	if err != nil {
+		t.Fatalf("cannot create DictBuffer: %s", err)
+	}
+	if db.Len() != len(dict) {
+		t.Fatalf("unexpected DictBuffer length; got %d; want %d", db.Len(), len(dict))
+	}
+
+	// The dict contents must be copied into DictBuffer.
+	dictCopy := append([]byte{}, dict...)
+	for i := range dict {
+		dict[i] = 0
+	}
+
+	for _, dictContentType := range []DictContentType{DictContentAuto, DictContentFull, DictContentRaw} {
+		cd, err := NewCDictByRef(db, 5, dictContentType)
+		if err != nil {
+			t.Fatalf("cannot create CDict with dictContentType=%d: %s", dictContentType, err)
+		}
+		dd, err := NewDDictByRef(db, dictContentType)
+		if err != nil {
+			t.Fatalf("cannot create DDict with dictContentType=%d: %s", dictContentType, err)
+		}
+		idExpected := id
+		if dictContentType == DictContentRaw {
+			idExpected = 0
+		}
+		if cd.ID() != idExpected {
+			t.Fatalf("unexpected CDict id for dictContentType=%d; got %d; want %d", dictContentType, cd.ID(), idExpected)
+		}
+		if dd.ID() != idExpected {
+			t.Fatalf("unexpected DDict id for dictContentType=%d; got %d; want %d", dictContentType, dd.ID(), idExpected)
+		}
+		if dictContentType == DictContentAuto {
+			// Dicts created by reference mustn't contain a copy of the dictionary.
+			cdCopy, err := NewCDictLevel(dictCopy, 5)
+			if err != nil {
+				t.Fatalf("cannot create CDict: %s", err)
+			}
+			if n := cdCopy.SizeOf() - cd.SizeOf(); n < len(dictCopy) {
+				t.Fatalf("too small CDict size difference; got %d; want at least %d", n, len(dictCopy))
+			}
+			cdCopy.Release()
+			ddCopy, err := NewDDict(dictCopy)
+			if err != nil {
+				t.Fatalf("cannot create DDict: %s", err)
+			}
+			if n := ddCopy.SizeOf() - dd.SizeOf(); n < len(dictCopy) {
+				t.Fatalf("too small DDict size difference; got %d; want at least %d", n, len(dictCopy))
+			}
+			ddCopy.Release()
+		}
+		for _, sample := range samples[:10] {
+			data, err := DecompressDict(nil, CompressDict(nil, sample, cd), dd)
+			if err != nil {
+				t.Fatalf("cannot decompress data: %s", err)
+			}
+			if !bytes.Equal(data, sample) {
+				t.Fatalf("unexpected data decompressed; got %q; want %q", data, sample)
+			}
+		}
+		cd.Release()
+		dd.Release()
+	}
+
+	// Dicts created by reference must be compatible with dicts created by copy.
+	cd, err := NewCDictByRef(db, DefaultCompressionLevel, DictContentAuto)
+	if err != nil {
+		t.Fatalf("cannot create CDict: %s", err)
+	}
+	ddCopy, err := NewDDict(dictCopy)
+	if err != nil {
+		t.Fatalf("cannot create DDict: %s", err)
+	}
+	defer ddCopy.Release()
+	data, err := DecompressDict(nil, CompressDict(nil, samples[0], cd), ddCopy)
+	if err != nil {
+		t.Fatalf("cannot decompress data: %s", err)
+	}
+	if !bytes.Equal(data, samples[0]) {
+		t.Fatalf("unexpected data decompressed; got %q; want %q", data, samples[0])
+	}
+
+	// DictBuffer must remain alive until all the dicts referencing it are released.
+	db.Release()
+	if db.p == nil {
+		t.Fatalf("DictBuffer mustn't be freed while it is referenced by CDict")
+	}
+	if _, err := NewDDictByRef(db, DictContentAuto); err == nil {
+		t.Fatalf("expecting non-nil error when creating DDict from released DictBuffer")
+	}
+	data, err = DecompressDict(nil, CompressDict(nil, samples[1], cd), ddCopy)
+	if err != nil {
+		t.Fatalf("cannot decompress data: %s", err)
+	}
+	if !bytes.Equal(data, samples[1]) {
+		t.Fatalf("unexpected data decompressed; got %q; want %q", data, samples[1])
+	}
+	cd.Release()
+	if db.p != nil {
+		t.Fatalf("DictBuffer must be freed after releasing all the dicts")
+	}
+}
+
+func TestDictByRefInvalid(t *testing.T) {
+	if _, err := NewDictBuffer(nil); err == nil {
+		t.Fatalf("expecting non-nil error for empty dict")
+	}
+	db, err := NewDictBuffer([]byte("raw content dictionary"))
+	if err != nil {
+		t.Fatalf("cannot create DictBuffer: %s", err)
+	}
+	defer db.Release()
+	if _, err := NewCDictByRef(db, DefaultCompressionLevel, DictContentFull); err == nil {
+		t.Fatalf("expecting non-nil error when creating CDict from raw content with DictContentFull")
+	}
+	if _, err := NewDDictByRef(db, DictContentFull); err == nil {
+		t.Fatalf("expecting non-nil error when creating DDict from raw content with DictContentFull")
+	}
+	if db.refs != 0 {
+		t.Fatalf("unexpected DictBuffer refs after failed dict creation; got %d; want 0", db.refs)
+	}
+}
+
+func TestCDictParams(t *testing.T) {
+	var samples [][]byte
+	for i := 0; i < 1000; i++ {
+		samples = append(samples, []byte(fmt.Sprintf(`{"id":%d,"name":"sample %d","value":%d}`, i, i, rand.Intn(100000))))
+	}
+	dict := BuildDict(samples, 8*1024)
+	dd, err := NewDDict(dict)
+	if err != nil {
+		t.Fatalf("cannot create DDict: %s", err)
+	}
+	defer dd.Release()
+
+	for _, params := range []*CDictParams{
+		nil,
+		{CompressionLevel: 5},
+		{CompressionLevel: 7, EnableDedicatedDictSearch: true},
+		{CompressionLevel: 19, EnableDedicatedDictSearch: true},
+		{WindowLog: 20, Strategy: StrategyLazy2, HashLog: 18, ChainLog: 18, SearchLog: 4, MinMatch: 5, TargetLength: 32},
+	} {
+		cd, err := NewCDictParams(dict, params)
+		if err != nil {
+			t.Fatalf("cannot create CDict with params %+v: %s", params, err)
+		}
+		if cd.ID() != DictID(dict) {
+			t.Fatalf("unexpected CDict id; got %d; want %d", cd.ID(), DictID(dict))
+		}
+		for _, sample := range samples[:10] {
+			data, err := DecompressDict(nil, CompressDict(nil, sample, cd), dd)
+			if err != nil {
+				t.Fatalf("cannot decompress data: %s", err)
+			}
+			if !bytes.Equal(data, sample) {
+				t.Fatalf("unexpected data decompressed; got %q; want %q", data, sample)
+			}
+		}
+
+		// Verify stream compression with the dict.
+		var bb bytes.Buffer
+		zw := NewWriterDict(&bb, cd)
+		src := bytes.Join(samples[:100], nil)
+		if _, err := zw.Write(src); err != nil {
+			t.Fatalf("cannot write data: %s", err)
+		}
+		if err := zw.Close(); err != nil {
+			t.Fatalf("cannot close writer: %s", err)
+		}
+		zw.Release()
+		data, err := DecompressDict(nil, bb.Bytes(), dd)
+		if err != nil {
+			t.Fatalf("cannot decompress stream data: %s", err)
+		}
+		if !bytes.Equal(data, src) {
+			t.Fatalf("unexpected stream data decompressed; got %d bytes; want %d bytes", len(data), len(src))
+		}
+		cd.Release()
+	}
+}
+
+func TestCDictParamsInvalid(t *testing.T) {
+	dict := []byte(newTestString(1024, 3))
+	if _, err := NewCDictParams(nil, nil); err == nil {
+		t.Fatalf("expecting non-nil error for empty dict")
+	}
+	for _, params := range []*CDictParams{
+		{WindowLog: 100},
+		{Strategy: 100},
+		{HashLog: 1},
+		{MinMatch: 100},
+	} {
+		if _, err := NewCDictParams(dict, params); !errors.Is(err, ErrParameterOutOfBound) {
+			t.Fatalf("unexpected error for params %+v; got %v; want %v", params, err, ErrParameterOutOfBound)
+		}
+	}
+}
+
+func TestBuildDictParams(t *testing.T) {
+	var samples [][]byte
+	for i := 0; i < 1000; i++ {
+		samples = append(samples, []byte(fmt.Sprintf(`{"id":%d,"name":"sample %d","value":%d}`, i, i, rand.Intn(100000))))
+	}
+	for _, params := range []*DictParams{
+		{DictSize: 4096},
+		{DictSize: 4096, K: 64, D: 8},
+		{DictSize: 4096, K: 64, D: 8, F: 18, Accel: 5, CompressionLevel: 10},
+		{DictSize: 4096, Steps: 8, SplitPoint: 0.5, Threads: 2},
+		{DictSize: 4096, Algorithm: DictAlgorithmCover},
+		{DictSize: 4096, Algorithm: DictAlgorithmCover, K: 64, D: 8, DictID: 123456},
+		{DictSize: 4096, Algorithm: DictAlgorithmCover, Steps: 4, SplitPoint: 0.8},
+	} {
+		dict, chosenParams, err := BuildDictParams(samples, params)
+		if err != nil {
+			t.Fatalf("cannot build dict with params %+v: %s", params, err)
+		}
+		if len(dict) == 0 || len(dict) > params.DictSize {
+			t.Fatalf("unexpected dict size for params %+v; got %d; want (0..%d]", params, len(dict), params.DictSize)
+		}
+		if chosenParams.K == 0 || chosenParams.D == 0 {
+			t.Fatalf("expecting non-zero K and D in chosen params %+v", chosenParams)
+		}
+		if params.K != 0 && (chosenParams.K != params.K || chosenParams.D != params.D) {
+			t.Fatalf("unexpected K, D in chosen params; got %d, %d; want %d, %d", chosenParams.K, chosenParams.D, params.K, params.D)
+		}
+		if chosenParams.DictID != DictID(dict) {
+			t.Fatalf("unexpected DictID in chosen params; got %d; want %d", chosenParams.DictID, DictID(dict))
+		}
+		if params.DictID != 0 && chosenParams.DictID != params.DictID {
+			t.Fatalf("unexpected DictID; got %d; want %d", chosenParams.DictID, params.DictID)
+		}
+		testCompressDecompressWithDict(t, dict, samples[:10])
+	}
+}
+
+func testCompressDecompressWithDict(t *testing.T, dict []byte, samples [][]byte) {
+	t.Helper()
+
+	cd, err := NewCDict(dict)
+	if err != nil {
+		t.Fatalf("cannot create CDict: %s", err)
+	}
+	defer cd.Release()
+	dd, err := NewDDict(dict)
+	if err != nil {
+		t.Fatalf("cannot create DDict: %s", err)
+	}
+	defer dd.Release()
+	for _, sample := range samples {
+		data, err := DecompressDict(nil, CompressDict(nil, sample, cd), dd)
+		if err != nil {
+			t.Fatalf("cannot decompress data: %s", err)
+		}
+		if !bytes.Equal(data, sample) {
+			t.Fatalf("unexpected data decompressed; got %q; want %q", data, sample)
+		}
+	}
+}
+
+func TestBuildDictParamsInvalid(t *testing.T) {
+	samples := [][]byte{[]byte("foo"), []byte("bar")}
+	for _, params := range []*DictParams{
+		{DictSize: 4096},
+		{DictSize: 4096, Algorithm: DictAlgorithmCover, K: 64, D: 8},
+		{DictSize: 10},
+		{DictSize: 4096, Algorithm: 123},
+	} {
+		if _, _, err := BuildDictParams(samples, params); err == nil {
+			t.Fatalf("expecting non-nil error for params %+v", params)
+		}
+	}
+	if _, _, err := BuildDictParams(nil, &DictParams{DictSize: 4096}); err == nil {
+		t.Fatalf("expecting non-nil error for empty samples")
+	}
+}
+
+func TestBuildDictParamsNil(t *testing.T) {
+	var samples [][]byte
+	for i := 0; i < 1000; i++ {
+		samples = append(samples, []byte(fmt.Sprintf(`{"id":%d,"name":"sample %d","value":%d}`, i, i, rand.Intn(100000))))
+	}
+	dict, p, err := BuildDictParams(samples, nil)
+	if err != nil {
+		t.Fatalf("cannot build dict with nil params: %s", err)
+	}
+	if p.DictSize != DefaultDictSize {
+		t.Fatalf("unexpected DictSize; got %d; want %d", p.DictSize, DefaultDictSize)
+	}
+	if len(dict) == 0 || len(dict) > DefaultDictSize {
+		t.Fatalf("unexpected dict size; got %d; want (0..%d]", len(dict), DefaultDictSize)
+	}
+	testCompressDecompressWithDict(t, dict, samples[:10])
+}
+
+func TestFinalizeDict(t *testing.T) {
+	var samples [][]byte
+	var bb bytes.Buffer
+	for i := 0; i < 1000; i++ {
+		sample := fmt.Sprintf(`{"id":%d,"name":"sample %d","value":%d}`, i, i, rand.Intn(100000))
+		samples = append(samples, []byte(sample))
+		if i%20 == 0 {
+			bb.WriteString(sample)
+		}
+	}
+	content := bb.Bytes()
+	for _, params := range []*DictParams{
+		nil,
+		{},
+		{DictID: 123456},
+		{DictSize: 4096, CompressionLevel: 10, DictID: 42},
+		{DictSize: len(content)},
+	} {
+		dict, err := FinalizeDict(content, samples, params)
+		if err != nil {
+			t.Fatalf("cannot finalize dict with params %+v: %s", params, err)
+		}
+		if params == nil {
+			params = &DictParams{}
+		}
+		if params.DictSize > 0 && len(dict) > params.DictSize {
+			t.Fatalf("too big dict for params %+v; got %d bytes; want up to %d bytes", params, len(dict), params.DictSize)
+		}
+		if params.DictSize != len(content) && !bytes.HasSuffix(dict, content) {
+			t.Fatalf("dict for params %+v must end with the content", params)
+		}
+		id := DictID(dict)
+		if id == 0 {
+			t.Fatalf("expecting non-zero DictID for params %+v", params)
+		}
+		if params.DictID != 0 && id != params.DictID {
+			t.Fatalf("unexpected DictID; got %d; want %d", id, params.DictID)
+		}
+		testCompressDecompressWithDict(t, dict, samples[:10])
+	}
+}
+
+func TestFinalizeDictInvalid(t *testing.T) {
+	samples := [][]byte{[]byte("foo"), []byte("bar")}
+	if _, err := FinalizeDict(nil, samples, &DictParams{}); err == nil {
+		t.Fatalf("expecting non-nil error for empty content")
+	}
+	if _, err := FinalizeDict([]byte("foobar"), nil, &DictParams{}); err == nil {
+		t.Fatalf("expecting non-nil error for empty samples")
+	}
+	content := []byte(newTestString(1000, 3))
+	if _, err := FinalizeDict(content, samples, &DictParams{DictSize: 500}); err == nil {
+		t.Fatalf("expecting non-nil error for DictSize smaller than content")
+	}
+}
+
+func TestBuildDictConcurrent(t *testing.T) {
+	const workers = 16
+
+	samplesFunc := func(n int) [][]byte {
+		var samples [][]byte
+		for i := 0; i < 500; i++ {
+			samples = append(samples, []byte(fmt.Sprintf(`{"tenant":%d,"id":%d,"name":"sample %d"}`, n, i, i*n)))
+		}
+		return samples
+	}
+	paramsList := []*DictParams{
+		{DictSize: 2048, K: 64, D: 8},
+		{DictSize: 2048, Algorithm: DictAlgorithmCover, K: 64, D: 8},
+		{DictSize: 2048, Algorithm: DictAlgorithmCover, Steps: 4},
+		{DictSize: 1024, K: 64, D: 8, NotificationLevel: 1},
+	}
+
+	// Build the expected dictionaries serially.
+	type result struct {
+		dict       []byte
+		dictParams [][]byte
+	}
+	expected := make([]result, workers)
+	for n := range expected {
+		samples := samplesFunc(n)
+		expected[n].dict = BuildDict(samples, 2048)
+		for _, params := range paramsList {
+			dict, _, err := BuildDictParams(samples, params)
+			if err != nil {
+				t.Fatalf("cannot build dict with params %+v: %s", params, err)
+			}
+			expected[n].dictParams = append(expected[n].dictParams, dict)
+		}
+	}
+
+	// Build the same dictionaries concurrently.
+	ch := make(chan error, workers)
+	for n := 0; n < workers; n++ {
+		go func(n int) {
+			samples := samplesFunc(n)
+			for i := 0; i < 3; i++ {
+				dict := BuildDict(samples, 2048)
+				if !bytes.Equal(dict, expected[n].dict) {
+					ch <- fmt.Errorf("unexpected dict built by worker %d", n)
+					return
+				}
+				for j, params := range paramsList {
+					dict, _, err := BuildDictParams(samples, params)
+					if err != nil {
+						ch <- fmt.Errorf("cannot build dict with params %+v: %w", params, err)
+						return
+					}
+					if !bytes.Equal(dict, expected[n].dictParams[j]) {
+						ch <- fmt.Errorf("unexpected dict built by worker %d with params %+v", n, params)
+						return
+					}
+				}
+			}
+			ch <- nil
+		}(n)
+	}
+	for n := 0; n < workers; n++ {
+		select {
+		case err := <-ch:
+			if err != nil {
+				t.Fatalf("error in concurrent test: %s", err)
+			}
+		case <-time.After(time.Minute):
+			t.Fatalf("timeout in concurrent test")
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package gozstd
+
+/*
+#define ZSTD_STATIC_LINKING_ONLY
+#include "zstd.h"
+#include "zstd_errors.h"
+*/
+import "C"
+
+// ErrorCode is zstd error code.
+type ErrorCode int
+
+// String returns human-readable description for ec.
+func (ec ErrorCode) String() string {
+	errCStr := C.ZSTD_getErrorString(C.ZSTD_ErrorCode(ec))
+	return C.GoString(errCStr)
+}
+
+// Error is an error returned by zstd.
+//
+// Errors returned by gozstd functions may wrap Error. Use errors.Is
+// for checking whether the returned error has the given code:
+//
+//	if errors.Is(err, gozstd.ErrChecksumWrong) {
+//		// handle checksum mismatch
+//	}
+type Error struct {
+	// Code is zstd error code.
+	Code ErrorCode
+}
+
+// Error implements error interface.
+func (e *Error) Error() string {
+	return e.Code.String()
+}
+
+// Is returns true if target is Error with the same Code as e.
+func (e *Error) Is(target error) bool {
+	te, ok := target.(*Error)
+	return ok && te.Code == e.Code
+}
+
+// The following errors may be used with errors.Is for checking
+// the code of the returned Error.
+var (
+	ErrGeneric                         = newErrorCode(C.ZSTD_error_GENERIC)
+	ErrPrefixUnknown                   = newErrorCode(C.ZSTD_error_prefix_unknown)
+	ErrVersionUnsupported              = newErrorCode(C.ZSTD_error_version_unsupported)
+	ErrFrameParameterUnsupported       = newErrorCode(C.ZSTD_error_frameParameter_unsupported)
+	ErrFrameParameterWindowTooLarge    = newErrorCode(C.ZSTD_error_frameParameter_windowTooLarge)
+	ErrCorruption                      = newErrorCode(C.ZSTD_error_corruption_detected)
+	ErrChecksumWrong                   = newErrorCode(C.ZSTD_error_checksum_wrong)
+	ErrLiteralsHeaderWrong             = newErrorCode(C.ZSTD_error_literals_headerWrong)
+	ErrDictionaryCorrupted             = newErrorCode(C.ZSTD_error_dictionary_corrupted)
+	ErrDictionaryWrong                 = newErrorCode(C.ZSTD_error_dictionary_wrong)
+	ErrDictionaryCreationFailed        = newErrorCode(C.ZSTD_error_dictionaryCreation_failed)
+	ErrParameterUnsupported            = newErrorCode(C.ZSTD_error_parameter_unsupported)
+	ErrParameterCombinationUnsupported = newErrorCode(C.ZSTD_error_parameter_combination_unsupported)
+	ErrParameterOutOfBound             = newErrorCode(C.ZSTD_error_parameter_outOfBound)
+	ErrTableLogTooLarge                = newErrorCode(C.ZSTD_error_tableLog_tooLarge)
+	ErrMaxSymbolValueTooLarge          = newErrorCode(C.ZSTD_error_maxSymbolValue_tooLarge)
+	ErrMaxSymbolValueTooSmall          = newErrorCode(C.ZSTD_error_maxSymbolValue_tooSmall)
+	ErrStabilityConditionNotRespected  = newErrorCode(C.ZSTD_error_stabilityCondition_notRespected)
+	ErrStageWrong                      = newErrorCode(C.ZSTD_error_stage_wrong)
+	ErrInitMissing                     = newErrorCode(C.ZSTD_error_init_missing)
+	ErrMemoryAllocation                = newErrorCode(C.ZSTD_error_memory_allocation)
+	ErrWorkSpaceTooSmall               = newErrorCode(C.ZSTD_error_workSpace_tooSmall)
+	ErrDstSizeTooSmall                 = newErrorCode(C.ZSTD_error_dstSize_tooSmall)
+	ErrSrcSizeWrong                    = newErrorCode(C.ZSTD_error_srcSize_wrong)
+	ErrDstBufferNull                   = newErrorCode(C.ZSTD_error_dstBuffer_null)
+	ErrNoForwardProgressDestFull       = newErrorCode(C.ZSTD_error_noForwardProgress_destFull)
+	ErrNoForwardProgressInputEmpty     = newErrorCode(C.ZSTD_error_noForwardProgress_inputEmpty)
+)
+
+func newErrorCode(code C.ZSTD_ErrorCode) *Error {
+	return &Error{
+		Code: ErrorCode(code),
+	}
+}
+
+// newError returns Error for the given result of zstd function call.
+//
+// The result must contain an error.
+func newError(result C.size_t) *Error {
+	return newErrorCode(C.ZSTD_getErrorCode(result))
+}
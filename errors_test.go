@@ -0,0 +1,99 @@
+package gozstd
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"testing"
+)
+
+func TestErrorIs(t *testing.T) {
+	err := fmt.Errorf("foo: %w", &Error{Code: ErrChecksumWrong.Code})
+	if !errors.Is(err, ErrChecksumWrong) {
+		t.Fatalf("expecting %q to match ErrChecksumWrong", err)
+	}
+	if errors.Is(err, ErrCorruption) {
+		t.Fatalf("unexpected match of %q with ErrCorruption", err)
+	}
+	var e *Error
+	if !errors.As(err, &e) {
+		t.Fatalf("cannot obtain Error from %q", err)
+	}
+	if e.Code != ErrChecksumWrong.Code {
+		t.Fatalf("unexpected error code; got %d; want %d", e.Code, ErrChecksumWrong.Code)
+	}
+	if e.Error() != e.Code.String() {
+		t.Fatalf("unexpected error message; got %q; want %q", e.Error(), e.Code.String())
+	}
+}
+
+func TestDecompressErrorCodes(t *testing.T) {
+	var samples [][]byte
+	for i := 0; i < 1000; i++ {
+		samples = append(samples, []byte(fmt.Sprintf("this is sample number %d", i)))
+	}
+	dict := BuildDict(samples, 8*1024)
+	cd, err := NewCDict(dict)
+	if err != nil {
+		t.Fatalf("cannot create CDict: %s", err)
+	}
+	defer cd.Release()
+
+	// Missing dictionary.
+	data := []byte(newTestString(1024, 3))
+	cdata := CompressDict(nil, data, cd)
+	if _, err := Decompress(nil, cdata); !errors.Is(err, ErrDictionaryWrong) {
+		t.Fatalf("unexpected error for missing dictionary; got %v; want %v", err, ErrDictionaryWrong)
+	}
+	if err := StreamDecompress(ioutil.Discard, bytes.NewReader(cdata)); !errors.Is(err, ErrDictionaryWrong) {
+		t.Fatalf("unexpected error for missing dictionary in StreamDecompress; got %v; want %v", err, ErrDictionaryWrong)
+	}
+
+	// Unknown frame magic.
+	if _, err := Decompress(nil, []byte("invalid compressed data")); !errors.Is(err, ErrPrefixUnknown) {
+		t.Fatalf("unexpected error for invalid data; got %v; want %v", err, ErrPrefixUnknown)
+	}
+	zr := NewReader(bytes.NewReader([]byte("invalid compressed data")))
+	defer zr.Release()
+	if _, err := ioutil.ReadAll(zr); !errors.Is(err, ErrPrefixUnknown) {
+		t.Fatalf("unexpected error for invalid data in Reader; got %v; want %v", err, ErrPrefixUnknown)
+	}
+
+	// Too big window.
+	var bb bytes.Buffer
+	zw := NewWriterParams(&bb, &WriterParams{
+		WindowLog: DefaultWindowLogMax + 1,
+	})
+	defer zw.Release()
+	if _, err := zw.Write(data); err != nil {
+		t.Fatalf("cannot write data: %s", err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("cannot close zw: %s", err)
+	}
+	zr.Reset(&bb, nil)
+	if _, err := ioutil.ReadAll(zr); !errors.Is(err, ErrFrameParameterWindowTooLarge) {
+		t.Fatalf("unexpected error for too big window; got %v; want %v", err, ErrFrameParameterWindowTooLarge)
+	}
+}
+
+func TestReaderUnderlyingErrorWrapped(t *testing.T) {
+	errReader := errors.New("reader error")
+	zr := NewReader(&errorReader{err: errReader})
+	defer zr.Release()
+	if _, err := ioutil.ReadAll(zr); !errors.Is(err, errReader) {
+		t.Fatalf("unexpected error; got %v; want %v", err, errReader)
+	}
+	if err := StreamDecompress(ioutil.Discard, &errorReader{err: errReader}); !errors.Is(err, errReader) {
+		t.Fatalf("unexpected error in StreamDecompress; got %v; want %v", err, errReader)
+	}
+}
+
+type errorReader struct {
+	err error
+}
+
+func (er *errorReader) Read(p []byte) (int, error) {
+	return 0, er.err
+}
@@ -0,0 +1,261 @@
+package gozstd
+
+/*
+#define ZSTD_STATIC_LINKING_ONLY
+#include "zstd.h"
+#include "zstd_errors.h"
+
+#include <stdint.h>  // for uintptr_t
+
+// The following *_wrapper functions allow avoiding memory allocations
+// durting calls from Go.
+// See https://github.com/golang/go/issues/24450 .
+
+static size_t ZSTD_getFrameHeader_wrapper(uintptr_t zfh, uintptr_t src, size_t srcSize) {
+    return ZSTD_getFrameHeader((ZSTD_FrameHeader*)zfh, (const void*)src, srcSize);
+}
+
+static size_t ZSTD_findFrameCompressedSize_wrapper(uintptr_t src, size_t srcSize) {
+    return ZSTD_findFrameCompressedSize((const void*)src, srcSize);
+}
+
+static size_t ZSTD_writeSkippableFrame_wrapper(uintptr_t dst, size_t dstCapacity, uintptr_t src, size_t srcSize, unsigned magicVariant) {
+    return ZSTD_writeSkippableFrame((void*)dst, dstCapacity, (const void*)src, srcSize, magicVariant);
+}
+
+static size_t ZSTD_readSkippableFrame_wrapper(uintptr_t dst, size_t dstCapacity, uintptr_t magicVariant, uintptr_t src, size_t srcSize) {
+    return ZSTD_readSkippableFrame((void*)dst, dstCapacity, (unsigned*)magicVariant, (const void*)src, srcSize);
+}
+*/
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"unsafe"
+)
+
+// ContentSizeUnknown is stored in FrameHeader.ContentSize
+// if the frame header doesn't contain the decompressed size.
+//
+// This is the case for frames created by Writer
+// or with WriterParams.DisableContentSize set.
+const ContentSizeUnknown = ^uint64(0)
+
+// FrameHeader contains information from zstd frame header.
+type FrameHeader struct {
+	// ContentSize is the decompressed size of the frame.
+	//
+	// It equals to ContentSizeUnknown if the frame header doesn't contain it.
+	// It contains the payload size for skippable frames.
+	ContentSize uint64
+
+	// WindowSize is the window size required for decompressing the frame.
+	//
+	// Frames with big window sizes may require big amounts of memory
+	// during decompression. See also ReaderParams.WindowLogMax.
+	WindowSize uint64
+
+	// DictID is the id of the dictionary required for decompressing the frame.
+	//
+	// It equals to zero if the frame doesn't require a dictionary
+	// or if the dictionary id isn't stored in the frame header.
+	DictID uint32
+
+	// HasChecksum is set if the frame ends with content checksum.
+	HasChecksum bool
+
+	// SingleSegment is set if the frame must be decompressed into a single buffer
+	// of ContentSize bytes.
+	SingleSegment bool
+
+	// HeaderSize is the size of the frame header in bytes.
+	HeaderSize int
+
+	// Skippable is set for skippable frames.
+	//
+	// Skippable frames contain arbitrary user data, which is ignored
+	// during decompression.
+	Skippable bool
+
+	// MagicVariant is the magic number variant in the range [0..15]
+	// for skippable frames.
+	MagicVariant uint32
+}
+
+// ParseFrameHeader parses the header of the first frame in src.
+//
+// src may contain only the beginning of the frame. The header
+// is parsed without decompressing the frame.
+func ParseFrameHeader(src []byte) (FrameHeader, error) {
+	var zfh C.ZSTD_FrameHeader
+	var fh FrameHeader
+	var srcPtr uintptr
+	if len(src) > 0 {
+		srcPtr = uintptr(unsafe.Pointer(&src[0]))
+	}
+	result := C.ZSTD_getFrameHeader_wrapper(
+		C.uintptr_t(uintptr(unsafe.Pointer(&zfh))),
+		C.uintptr_t(srcPtr),
+		C.size_t(len(src)))
+	// Prevent from GC'ing of src during CGO call above.
+	runtime.KeepAlive(src)
+	if C.ZSTD_getErrorCode(result) != 0 {
+		return fh, fmt.Errorf("cannot parse frame header: %w", newError(result))
+	}
+	if result > 0 {
+		return fh, fmt.Errorf("cannot parse frame header: src must contain at least %d bytes; got %d bytes: %w",
+			int(result), len(src), ErrSrcSizeWrong)
+	}
+
+	fh.ContentSize = uint64(zfh.frameContentSize)
+	fh.WindowSize = uint64(zfh.windowSize)
+	fh.HeaderSize = int(zfh.headerSize)
+	if zfh.frameType == C.ZSTD_skippableFrame {
+		fh.Skippable = true
+		fh.MagicVariant = uint32(zfh.dictID)
+		return fh, nil
+	}
+	fh.DictID = uint32(zfh.dictID)
+	fh.HasChecksum = zfh.checksumFlag != 0
+
+	// ZSTD_getFrameHeader doesn't expose Single_Segment_flag,
+	// so read it from Frame_Header_Descriptor, which follows the 4-byte magic.
+	// See https://github.com/facebook/zstd/blob/dev/doc/zstd_compression_format.md#frame_header_descriptor
+	fh.SingleSegment = src[4]&(1<<5) != 0
+	return fh, nil
+}
+
+// FrameContentSize returns the decompressed size of the first frame in src.
+//
+// ContentSizeUnknown is returned if the frame header doesn't contain
+// the decompressed size. Zero is returned for skippable frames.
+func FrameContentSize(src []byte) (uint64, error) {
+	fh, err := ParseFrameHeader(src)
+	if err != nil {
+		return 0, err
+	}
+	if fh.Skippable {
+		return 0, nil
+	}
+	return fh.ContentSize, nil
+}
+
+// FindFrameCompressedSize returns the size of the first frame in src.
+//
+// src must contain the whole frame. The frame may be either zstd frame
+// or skippable frame.
+func FindFrameCompressedSize(src []byte) (int, error) {
+	n, err := findFrameCompressedSize(src)
+	if err != nil {
+		return 0, fmt.Errorf("cannot find frame size: %w", err)
+	}
+	return n, nil
+}
+
+func findFrameCompressedSize(src []byte) (int, error) {
+	var srcPtr uintptr
+	if len(src) > 0 {
+		srcPtr = uintptr(unsafe.Pointer(&src[0]))
+	}
+	result := C.ZSTD_findFrameCompressedSize_wrapper(
+		C.uintptr_t(srcPtr), C.size_t(len(src)))
+	// Prevent from GC'ing of src during CGO call above.
+	runtime.KeepAlive(src)
+	if C.ZSTD_getErrorCode(result) != 0 {
+		return 0, newError(result)
+	}
+	return int(result), nil
+}
+
+// SkippableFrameHeaderSize is the size of skippable frame header in bytes.
+const SkippableFrameHeaderSize = 8 // from zstd.h
+
+// MaxSkippableMagicVariant is the maximum magic number variant for skippable frames.
+const MaxSkippableMagicVariant = 15
+
+// WriteSkippableFrame appends skippable frame containing the given payload to dst
+// and returns the result.
+//
+// magicVariant must be in the range [0..MaxSkippableMagicVariant].
+// Skippable frames are ignored by decompressors, so they may be used
+// for storing arbitrary metadata alongside the compressed data.
+// See ReadSkippableFrame and ReaderParams.SkippableFrameHandler
+// for reading the payload back.
+func WriteSkippableFrame(dst []byte, magicVariant uint32, payload []byte) ([]byte, error) {
+	dstLen := len(dst)
+	frameSize := SkippableFrameHeaderSize + len(payload)
+	if n := dstLen + frameSize - cap(dst); n > 0 {
+		dst = append(dst[:cap(dst)], make([]byte, n)...)
+	}
+	var payloadPtr uintptr
+	if len(payload) > 0 {
+		payloadPtr = uintptr(unsafe.Pointer(&payload[0]))
+	}
+	result := C.ZSTD_writeSkippableFrame_wrapper(
+		C.uintptr_t(uintptr(unsafe.Pointer(&dst[:cap(dst)][dstLen]))),
+		C.size_t(frameSize),
+		C.uintptr_t(payloadPtr),
+		C.size_t(len(payload)),
+		C.uint(magicVariant))
+	// Prevent from GC'ing of dst and payload during CGO call above.
+	runtime.KeepAlive(dst)
+	runtime.KeepAlive(payload)
+	if C.ZSTD_getErrorCode(result) != 0 {
+		return dst[:dstLen], fmt.Errorf("cannot write skippable frame with magicVariant=%d: %w", magicVariant, newError(result))
+	}
+	return dst[:dstLen+int(result)], nil
+}
+
+// ReadSkippableFrame appends the payload of the skippable frame at the start
+// of src to dst and returns the result together with the frame magic variant.
+//
+// src must contain the whole skippable frame.
+// Use FindFrameCompressedSize for determining the frame size.
+func ReadSkippableFrame(dst, src []byte) ([]byte, uint32, error) {
+	fh, err := ParseFrameHeader(src)
+	if err != nil {
+		return dst, 0, err
+	}
+	if !fh.Skippable {
+		return dst, 0, errNotSkippableFrame
+	}
+	payloadSize := int(fh.ContentSize)
+	if payloadSize > len(src)-SkippableFrameHeaderSize {
+		return dst, 0, fmt.Errorf("cannot read skippable frame: src must contain at least %d bytes; got %d bytes: %w",
+			SkippableFrameHeaderSize+payloadSize, len(src), ErrSrcSizeWrong)
+	}
+
+	dstLen := len(dst)
+	if n := dstLen + payloadSize - cap(dst); n > 0 {
+		dst = append(dst[:cap(dst)], make([]byte, n)...)
+	}
+	var dstPtr uintptr
+	if cap(dst) > dstLen {
+		dstPtr = uintptr(unsafe.Pointer(&dst[:cap(dst)][dstLen]))
+	}
+	var magicVariant C.uint
+	result := C.ZSTD_readSkippableFrame_wrapper(
+		C.uintptr_t(dstPtr),
+		C.size_t(payloadSize),
+		C.uintptr_t(uintptr(unsafe.Pointer(&magicVariant))),
+		C.uintptr_t(uintptr(unsafe.Pointer(&src[0]))),
+		C.size_t(len(src)))
+	// Prevent from GC'ing of dst and src during CGO call above.
+	runtime.KeepAlive(dst)
+	runtime.KeepAlive(src)
+	if C.ZSTD_getErrorCode(result) != 0 {
+		return dst[:dstLen], 0, fmt.Errorf("cannot read skippable frame: %w", newError(result))
+	}
+	return dst[:dstLen+int(result)], uint32(magicVariant), nil
+}
+
+var errNotSkippableFrame = errors.New("cannot read skippable frame: src doesn't start with skippable frame")
+
+// isSkippableFrameMagic returns true if magic is the magic number of skippable frame.
+func isSkippableFrameMagic(magic uint32) bool {
+	return magic&^MaxSkippableMagicVariant == skippableFrameMagicStart
+}
+
+const skippableFrameMagicStart = 0x184D2A50 // ZSTD_MAGIC_SKIPPABLE_START from zstd.h
@@ -0,0 +1,232 @@
+package gozstd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+)
+
+func TestParseFrameHeader(t *testing.T) {
+	src := []byte(newTestString(64*1024, 3))
+
+	// Frame with known content size.
+	cd := Compress(nil, src)
+	fh, err := ParseFrameHeader(cd)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if fh.ContentSize != uint64(len(src)) {
+		t.Fatalf("unexpected ContentSize; got %d; want %d", fh.ContentSize, len(src))
+	}
+	if fh.Skippable {
+		t.Fatalf("unexpected Skippable frame")
+	}
+	if fh.HasChecksum {
+		t.Fatalf("unexpected HasChecksum")
+	}
+	if fh.DictID != 0 {
+		t.Fatalf("unexpected DictID; got %d; want 0", fh.DictID)
+	}
+	if fh.HeaderSize <= 0 || fh.HeaderSize > len(cd) {
+		t.Fatalf("unexpected HeaderSize=%d", fh.HeaderSize)
+	}
+	if !fh.SingleSegment {
+		t.Fatalf("expecting SingleSegment frame")
+	}
+
+	// The header must be parsed from the frame prefix.
+	fhPrefix, err := ParseFrameHeader(cd[:fh.HeaderSize])
+	if err != nil {
+		t.Fatalf("unexpected error when parsing frame prefix: %s", err)
+	}
+	if fhPrefix != fh {
+		t.Fatalf("unexpected header parsed from frame prefix; got %+v; want %+v", fhPrefix, fh)
+	}
+
+	// Frame with unknown content size and checksum.
+	cd, err = CompressParams(nil, src, &WriterParams{
+		WindowLog:          16,
+		DisableContentSize: true,
+		EnableChecksum:     true,
+	})
+	if err != nil {
+		t.Fatalf("cannot compress data: %s", err)
+	}
+	fh, err = ParseFrameHeader(cd)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if fh.ContentSize != ContentSizeUnknown {
+		t.Fatalf("unexpected ContentSize; got %d; want %d", fh.ContentSize, ContentSizeUnknown)
+	}
+	if fh.WindowSize != 1<<16 {
+		t.Fatalf("unexpected WindowSize; got %d; want %d", fh.WindowSize, 1<<16)
+	}
+	if !fh.HasChecksum {
+		t.Fatalf("expecting HasChecksum")
+	}
+	if fh.SingleSegment {
+		t.Fatalf("unexpected SingleSegment frame")
+	}
+
+	// Skippable frame.
+	payload := []byte("foobar")
+	cd = make([]byte, 8)
+	binary.LittleEndian.PutUint32(cd, 0x184D2A50+3)
+	binary.LittleEndian.PutUint32(cd[4:], uint32(len(payload)))
+	cd = append(cd, payload...)
+	fh, err = ParseFrameHeader(cd)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !fh.Skippable {
+		t.Fatalf("expecting Skippable frame")
+	}
+	if fh.MagicVariant != 3 {
+		t.Fatalf("unexpected MagicVariant; got %d; want 3", fh.MagicVariant)
+	}
+	if fh.ContentSize != uint64(len(payload)) {
+		t.Fatalf("unexpected ContentSize; got %d; want %d", fh.ContentSize, len(payload))
+	}
+}
+
+func TestParseFrameHeaderInvalid(t *testing.T) {
+	cd := Compress(nil, []byte("foobar"))
+
+	for _, src := range [][]byte{nil, cd[:1], cd[:5]} {
+		if _, err := ParseFrameHeader(src); !errors.Is(err, ErrSrcSizeWrong) {
+			t.Fatalf("unexpected error for %X; got %v; want %v", src, err, ErrSrcSizeWrong)
+		}
+	}
+	if _, err := ParseFrameHeader([]byte("invalid frame")); !errors.Is(err, ErrPrefixUnknown) {
+		t.Fatalf("unexpected error; got %v; want %v", err, ErrPrefixUnknown)
+	}
+}
+
+func TestFrameContentSize(t *testing.T) {
+	src := []byte(newTestString(1024, 3))
+	n, err := FrameContentSize(Compress(nil, src))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if n != uint64(len(src)) {
+		t.Fatalf("unexpected content size; got %d; want %d", n, len(src))
+	}
+
+	cd, err := CompressParams(nil, src, &WriterParams{DisableContentSize: true})
+	if err != nil {
+		t.Fatalf("cannot compress data: %s", err)
+	}
+	n, err = FrameContentSize(cd)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if n != ContentSizeUnknown {
+		t.Fatalf("unexpected content size; got %d; want %d", n, ContentSizeUnknown)
+	}
+
+	if _, err := FrameContentSize([]byte("invalid frame")); err == nil {
+		t.Fatalf("expecting non-nil error for invalid frame")
+	}
+}
+
+func TestFindFrameCompressedSize(t *testing.T) {
+	cd1 := Compress(nil, []byte(newTestString(1024, 3)))
+	cd2 := Compress(nil, []byte(newTestString(4096, 3)))
+	src := append(append([]byte{}, cd1...), cd2...)
+
+	n, err := FindFrameCompressedSize(src)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if n != len(cd1) {
+		t.Fatalf("unexpected size of the first frame; got %d; want %d", n, len(cd1))
+	}
+	n, err = FindFrameCompressedSize(src[n:])
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if n != len(cd2) {
+		t.Fatalf("unexpected size of the second frame; got %d; want %d", n, len(cd2))
+	}
+
+	if _, err := FindFrameCompressedSize(cd1[:len(cd1)-1]); !errors.Is(err, ErrSrcSizeWrong) {
+		t.Fatalf("unexpected error for truncated frame; got %v; want %v", err, ErrSrcSizeWrong)
+	}
+	if _, err := FindFrameCompressedSize(nil); err == nil {
+		t.Fatalf("expecting non-nil error for empty src")
+	}
+}
+
+func TestWriteReadSkippableFrame(t *testing.T) {
+	for _, payload := range [][]byte{nil, []byte("foobar"), []byte(newTestString(64*1024, 3))} {
+		for magicVariant := uint32(0); magicVariant <= MaxSkippableMagicVariant; magicVariant++ {
+			prefix := []byte("prefix")
+			frame, err := WriteSkippableFrame(prefix, magicVariant, payload)
+			if err != nil {
+				t.Fatalf("cannot write skippable frame: %s", err)
+			}
+			if !bytes.Equal(frame[:len(prefix)], prefix) {
+				t.Fatalf("unexpected prefix; got %q; want %q", frame[:len(prefix)], prefix)
+			}
+			frame = frame[len(prefix):]
+			if len(frame) != SkippableFrameHeaderSize+len(payload) {
+				t.Fatalf("unexpected frame size; got %d; want %d", len(frame), SkippableFrameHeaderSize+len(payload))
+			}
+			n, err := FindFrameCompressedSize(frame)
+			if err != nil {
+				t.Fatalf("cannot find frame size: %s", err)
+			}
+			if n != len(frame) {
+				t.Fatalf("unexpected frame size; got %d; want %d", n, len(frame))
+			}
+
+			data, mv, err := ReadSkippableFrame(prefix, frame)
+			if err != nil {
+				t.Fatalf("cannot read skippable frame: %s", err)
+			}
+			if mv != magicVariant {
+				t.Fatalf("unexpected magicVariant; got %d; want %d", mv, magicVariant)
+			}
+			if !bytes.Equal(data[:len(prefix)], prefix) {
+				t.Fatalf("unexpected prefix; got %q; want %q", data[:len(prefix)], prefix)
+			}
+			if !bytes.Equal(data[len(prefix):], payload) {
+				t.Fatalf("unexpected payload; got %q; want %q", data[len(prefix):], payload)
+			}
+		}
+	}
+}
+
+func TestSkippableFrameIgnoredByDecompress(t *testing.T) {
+	src := []byte(newTestString(1024, 3))
+	cd, err := WriteSkippableFrame(nil, 0, []byte("metadata"))
+	if err != nil {
+		t.Fatalf("cannot write skippable frame: %s", err)
+	}
+	cd = Compress(cd, src)
+	plainData, err := Decompress(nil, cd)
+	if err != nil {
+		t.Fatalf("cannot decompress data: %s", err)
+	}
+	if !bytes.Equal(plainData, src) {
+		t.Fatalf("unexpected data decompressed; got\n%X; want\n%X", plainData, src)
+	}
+}
+
+func TestSkippableFrameInvalid(t *testing.T) {
+	if _, err := WriteSkippableFrame(nil, MaxSkippableMagicVariant+1, nil); !errors.Is(err, ErrParameterOutOfBound) {
+		t.Fatalf("unexpected error; got %v; want %v", err, ErrParameterOutOfBound)
+	}
+	if _, _, err := ReadSkippableFrame(nil, Compress(nil, []byte("foobar"))); err == nil {
+		t.Fatalf("expecting non-nil error when reading regular frame")
+	}
+	frame, err := WriteSkippableFrame(nil, 1, []byte("foobar"))
+	if err != nil {
+		t.Fatalf("cannot write skippable frame: %s", err)
+	}
+	if _, _, err := ReadSkippableFrame(nil, frame[:len(frame)-1]); !errors.Is(err, ErrSrcSizeWrong) {
+		t.Fatalf("unexpected error for truncated frame; got %v; want %v", err, ErrSrcSizeWrong)
+	}
+}
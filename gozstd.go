@@ -7,7 +7,9 @@ package gozstd
 #include "zstd.h"
 #include "zstd_errors.h"
 
+#include <stdlib.h>  // for malloc/free
 #include <stdint.h>  // for uintptr_t
+#include <string.h>  // for memcpy
 
 // The following *_wrapper functions allow avoiding memory allocations
 // durting calls from Go.
@@ -17,10 +19,45 @@ static size_t ZSTD_compressCCtx_wrapper(uintptr_t ctx, uintptr_t dst, size_t dst
     return ZSTD_compressCCtx((ZSTD_CCtx*)ctx, (void*)dst, dstCapacity, (const void*)src, srcSize, compressionLevel);
 }
 
+static size_t ZSTD_compress2_wrapper(uintptr_t ctx, uintptr_t dst, size_t dstCapacity, uintptr_t src, size_t srcSize) {
+    return ZSTD_compress2((ZSTD_CCtx*)ctx, (void*)dst, dstCapacity, (const void*)src, srcSize);
+}
+
 static size_t ZSTD_compress_usingCDict_wrapper(uintptr_t ctx, uintptr_t dst, size_t dstCapacity, uintptr_t src, size_t srcSize, uintptr_t cdict) {
     return ZSTD_compress_usingCDict((ZSTD_CCtx*)ctx, (void*)dst, dstCapacity, (const void*)src, srcSize, (const ZSTD_CDict*)cdict);
 }
 
+static size_t ZSTD_compressPrefix_wrapper(uintptr_t ctx, uintptr_t dst, size_t dstCapacity, uintptr_t src, size_t srcSize, uintptr_t prefix, size_t prefixSize, int compressionLevel) {
+    ZSTD_CCtx *cctx = (ZSTD_CCtx*)ctx;
+    size_t rv = ZSTD_CCtx_reset(cctx, ZSTD_reset_session_and_parameters);
+    if (ZSTD_isError(rv)) {
+        return rv;
+    }
+    rv = ZSTD_CCtx_setParameter(cctx, ZSTD_c_compressionLevel, compressionLevel);
+    if (ZSTD_isError(rv)) {
+        return rv;
+    }
+    // The prefix is referenced only until the end of ZSTD_compress2 call,
+    // so it may point to Go memory.
+    rv = ZSTD_CCtx_refPrefix(cctx, (const void*)prefix, prefixSize);
+    if (ZSTD_isError(rv)) {
+        return rv;
+    }
+    return ZSTD_compress2(cctx, (void*)dst, dstCapacity, (const void*)src, srcSize);
+}
+
+static size_t ZSTD_decompressPrefix_wrapper(uintptr_t ctx, uintptr_t dst, size_t dstCapacity, uintptr_t src, size_t srcSize, uintptr_t prefix, size_t prefixSize) {
+    ZSTD_DCtx *dctx = (ZSTD_DCtx*)ctx;
+    size_t rv = ZSTD_DCtx_refPrefix(dctx, (const void*)prefix, prefixSize);
+    if (ZSTD_isError(rv)) {
+        return rv;
+    }
+    rv = ZSTD_decompressDCtx(dctx, (void*)dst, dstCapacity, (const void*)src, srcSize);
+    // Drop the reference to the prefix, since it may point to Go memory.
+    ZSTD_DCtx_reset(dctx, ZSTD_reset_session_and_parameters);
+    return rv;
+}
+
 static size_t ZSTD_decompressDCtx_wrapper(uintptr_t ctx, uintptr_t dst, size_t dstCapacity, uintptr_t src, size_t srcSize) {
     return ZSTD_decompressDCtx((ZSTD_DCtx*)ctx, (void*)dst, dstCapacity, (const void*)src, srcSize);
 }
@@ -37,10 +74,10 @@ static unsigned long long ZSTD_findDecompressedSize_wrapper(uintptr_t src, size_
 import "C"
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"runtime"
-	"sync"
 	"unsafe"
 )
 
@@ -49,84 +86,192 @@ const DefaultCompressionLevel = 3 // Obtained from ZSTD_CLEVEL_DEFAULT.
 
 // Compress appends compressed src to dst and returns the result.
 func Compress(dst, src []byte) []byte {
-	return compressDictLevel(dst, src, nil, DefaultCompressionLevel)
+	return mustCompress(compressDictLevel(dst, src, nil, DefaultCompressionLevel))
 }
 
 // CompressLevel appends compressed src to dst and returns the result.
 //
 // The given compressionLevel is used for the compression.
+//
+// CompressLevel panics on compression error. Use TryCompressLevel
+// if the error must be returned instead.
 func CompressLevel(dst, src []byte, compressionLevel int) []byte {
-	return compressDictLevel(dst, src, nil, compressionLevel)
+	return mustCompress(compressDictLevel(dst, src, nil, compressionLevel))
 }
 
 // CompressDict appends compressed src to dst and returns the result.
 //
 // The given dictionary is used for the compression.
+//
+// CompressDict panics on compression error, for instance, if cd is already
+// released. Use TryCompressDict if the error must be returned instead.
 func CompressDict(dst, src []byte, cd *CDict) []byte {
+	return mustCompress(compressDictLevel(dst, src, cd, 0))
+}
+
+// TryCompressLevel appends compressed src to dst and returns the result.
+//
+// The given compressionLevel is used for the compression.
+//
+// Unlike CompressLevel, it returns an error instead of panicking
+// if the compression fails.
+func TryCompressLevel(dst, src []byte, compressionLevel int) ([]byte, error) {
+	return compressDictLevel(dst, src, nil, compressionLevel)
+}
+
+// TryCompressDict appends compressed src to dst and returns the result.
+//
+// The given dictionary is used for the compression.
+//
+// Unlike CompressDict, it returns an error instead of panicking
+// if the compression fails.
+func TryCompressDict(dst, src []byte, cd *CDict) ([]byte, error) {
 	return compressDictLevel(dst, src, cd, 0)
 }
 
-func compressDictLevel(dst, src []byte, cd *CDict, compressionLevel int) []byte {
-	var cctx, cctxDict *cctxWrapper
+// CompressWithPrefix appends src compressed with the given prefix to dst
+// and returns the result.
+//
+// The prefix is used as a one-off raw-content dictionary, so it is cheap
+// to use a distinct prefix per call. For instance, the previous version
+// of a document may be used as the prefix for compressing the next version.
+// The same prefix must be passed to DecompressWithPrefix.
+func CompressWithPrefix(dst, src, prefix []byte) []byte {
+	return mustCompress(compressPrefixLevel(dst, src, prefix, DefaultCompressionLevel))
+}
+
+// CompressWithPrefixLevel appends src compressed with the given prefix to dst
+// and returns the result.
+//
+// The given compressionLevel is used for the compression.
+// See CompressWithPrefix for details.
+func CompressWithPrefixLevel(dst, src, prefix []byte, compressionLevel int) []byte {
+	return mustCompress(compressPrefixLevel(dst, src, prefix, compressionLevel))
+}
+
+func compressPrefixLevel(dst, src, prefix []byte, compressionLevel int) ([]byte, error) {
+	cctx := getCCtx(cctxPool)
+	cctx.prefix = prefix
+	dst, err := compress(cctx, nil, dst, src, nil, compressionLevel)
+	cctx.prefix = nil
+	cctxPool.Put(cctx)
+	return dst, err
+}
+
+// CompressParams appends compressed src to dst and returns the result.
+//
+// The given params are used for the compression. Unlike Writer, CompressParams
+// knows the size of src, so it is written into the frame header unless
+// params.DisableContentSize is set.
+//
+// Calling CompressParams with nil params is equivalent to calling TryCompressLevel
+// with DefaultCompressionLevel.
+func CompressParams(dst, src []byte, params *WriterParams) ([]byte, error) {
+	if params == nil {
+		return compressDictLevel(dst, src, nil, DefaultCompressionLevel)
+	}
+
+	// The params are applied on every call, so parameter state never leaks
+	// between callers and the pooled contexts may be shared among distinct params.
+	c := getCCtxParams()
+	err := c.SetParams(params)
+	if err == nil {
+		dst, err = c.Compress(dst, src)
+	}
+	if params.Dict != nil {
+		// Drop the reference to params.Dict, so it may be released
+		// while c stays in the pool.
+		c.Reset(ResetSessionAndParameters)
+		runtime.KeepAlive(params.Dict)
+	}
+	cctxParamsPool.Put(c)
+	return dst, err
+}
+
+func getCCtxParams() *Compressor {
+	v := cctxParamsPool.Get()
+	if v == nil {
+		return NewCompressor()
+	}
+	return v.(*Compressor)
+}
+
+var cctxParamsPool = newCPool()
+
+func mustCompress(dst []byte, err error) []byte {
+	if err != nil {
+		panic(fmt.Errorf("BUG: unexpected error during compression: %w", err))
+	}
+	return dst
+}
+
+func compressDictLevel(dst, src []byte, cd *CDict, compressionLevel int) ([]byte, error) {
+	if cd != nil && cd.p == nil {
+		return dst, errReleasedCDict
+	}
+
+	var cctx, cctxDict *Compressor
 	if cd == nil {
-		cctx = cctxPool.Get().(*cctxWrapper)
+		cctx = getCCtx(cctxPool)
 	} else {
-		cctxDict = cctxDictPool.Get().(*cctxWrapper)
+		cctxDict = getCCtx(cctxDictPool)
 	}
 
-	dst = compress(cctx, cctxDict, dst, src, cd, compressionLevel)
+	var err error
+	dst, err = compress(cctx, cctxDict, dst, src, cd, compressionLevel)
 
 	if cd == nil {
 		cctxPool.Put(cctx)
 	} else {
 		cctxDictPool.Put(cctxDict)
 	}
-	return dst
+	return dst, err
 }
 
-var cctxPool = &sync.Pool{
-	New: newCCtx,
-}
+var (
+	cctxPool     = newCPool()
+	cctxDictPool = newCPool()
+)
 
-var cctxDictPool = &sync.Pool{
-	New: newCCtx,
+func getCCtx(p *cPool) *Compressor {
+	v := p.Get()
+	if v == nil {
+		return newCCtx()
+	}
+	return v.(*Compressor)
 }
 
-func newCCtx() interface{} {
+func newCCtx() *Compressor {
 	cctx := C.ZSTD_createCCtx()
-	cw := &cctxWrapper{
+	c := &Compressor{
 		cctx: cctx,
 	}
-	runtime.SetFinalizer(cw, freeCCtx)
-	return cw
-}
-
-func freeCCtx(cw *cctxWrapper) {
-	C.ZSTD_freeCCtx(cw.cctx)
-	cw.cctx = nil
+	cctxMem.track(&c.memSize, int(C.ZSTD_sizeof_CCtx(cctx)))
+	runtime.SetFinalizer(c, freeCCtx)
+	return c
 }
 
-type cctxWrapper struct {
-	cctx *C.ZSTD_CCtx
+func freeCCtx(c *Compressor) {
+	c.Release()
 }
 
-func compress(cctx, cctxDict *cctxWrapper, dst, src []byte, cd *CDict, compressionLevel int) []byte {
+func compress(cctx, cctxDict *Compressor, dst, src []byte, cd *CDict, compressionLevel int) ([]byte, error) {
 	if len(src) == 0 {
-		return dst
+		return dst, nil
 	}
 
 	dstLen := len(dst)
 	if cap(dst) > dstLen {
 		// Fast path - try compressing without dst resize.
-		result := compressInternal(cctx, cctxDict, dst[dstLen:cap(dst)], src, cd, compressionLevel, false)
+		result := compressInternal(cctx, cctxDict, dst[dstLen:cap(dst)], src, cd, compressionLevel)
 		compressedSize := int(result)
 		if compressedSize >= 0 {
 			// All OK.
-			return dst[:dstLen+compressedSize]
+			return dst[:dstLen+compressedSize], nil
 		}
 		if C.ZSTD_getErrorCode(result) != C.ZSTD_error_dstSize_tooSmall {
 			// Unexpected error.
-			panic(fmt.Errorf("BUG: unexpected error during compression with cd=%p: %s", cd, errStr(result)))
+			return dst, fmt.Errorf("compression error: %w", newError(result))
 		}
 	}
 
@@ -137,17 +282,20 @@ func compress(cctx, cctxDict *cctxWrapper, dst, src []byte, cd *CDict, compressi
 		dst = append(dst[:cap(dst)], make([]byte, n)...)
 	}
 
-	result := compressInternal(cctx, cctxDict, dst[dstLen:dstLen+compressBound], src, cd, compressionLevel, true)
+	result := compressInternal(cctx, cctxDict, dst[dstLen:dstLen+compressBound], src, cd, compressionLevel)
+	if C.ZSTD_getErrorCode(result) != 0 {
+		return dst[:dstLen], fmt.Errorf("compression error: %w", newError(result))
+	}
 	compressedSize := int(result)
 	dst = dst[:dstLen+compressedSize]
 	if cap(dst)-len(dst) > 4096 {
 		// Re-allocate dst in order to remove superflouos capacity and reduce memory usage.
 		dst = append([]byte{}, dst...)
 	}
-	return dst
+	return dst, nil
 }
 
-func compressInternal(cctx, cctxDict *cctxWrapper, dst, src []byte, cd *CDict, compressionLevel int, mustSucceed bool) C.size_t {
+func compressInternal(cctx, cctxDict *Compressor, dst, src []byte, cd *CDict, compressionLevel int) C.size_t {
 	if cd != nil {
 		result := C.ZSTD_compress_usingCDict_wrapper(
 			C.uintptr_t(uintptr(unsafe.Pointer(cctxDict.cctx))),
@@ -159,9 +307,34 @@ func compressInternal(cctx, cctxDict *cctxWrapper, dst, src []byte, cd *CDict, c
 		// Prevent from GC'ing of dst and src during CGO call above.
 		runtime.KeepAlive(dst)
 		runtime.KeepAlive(src)
-		if mustSucceed {
-			ensureNoError("ZSTD_compress_usingCDict_wrapper", result)
-		}
+		return result
+	}
+	if len(cctx.prefix) > 0 {
+		result := C.ZSTD_compressPrefix_wrapper(
+			C.uintptr_t(uintptr(unsafe.Pointer(cctx.cctx))),
+			C.uintptr_t(uintptr(unsafe.Pointer(&dst[0]))),
+			C.size_t(cap(dst)),
+			C.uintptr_t(uintptr(unsafe.Pointer(&src[0]))),
+			C.size_t(len(src)),
+			C.uintptr_t(uintptr(unsafe.Pointer(&cctx.prefix[0]))),
+			C.size_t(len(cctx.prefix)),
+			C.int(compressionLevel))
+		// Prevent from GC'ing of dst, src and prefix during CGO call above.
+		runtime.KeepAlive(dst)
+		runtime.KeepAlive(src)
+		runtime.KeepAlive(cctx.prefix)
+		return result
+	}
+	if cctx.hasParams {
+		result := C.ZSTD_compress2_wrapper(
+			C.uintptr_t(uintptr(unsafe.Pointer(cctx.cctx))),
+			C.uintptr_t(uintptr(unsafe.Pointer(&dst[0]))),
+			C.size_t(cap(dst)),
+			C.uintptr_t(uintptr(unsafe.Pointer(&src[0]))),
+			C.size_t(len(src)))
+		// Prevent from GC'ing of dst and src during CGO call above.
+		runtime.KeepAlive(dst)
+		runtime.KeepAlive(src)
 		return result
 	}
 	result := C.ZSTD_compressCCtx_wrapper(
@@ -174,9 +347,6 @@ func compressInternal(cctx, cctxDict *cctxWrapper, dst, src []byte, cd *CDict, c
 	// Prevent from GC'ing of dst and src during CGO call above.
 	runtime.KeepAlive(dst)
 	runtime.KeepAlive(src)
-	if mustSucceed {
-		ensureNoError("ZSTD_compressCCtx_wrapper", result)
-	}
 	return result
 }
 
@@ -189,51 +359,123 @@ func Decompress(dst, src []byte) ([]byte, error) {
 //
 // The given dictionary dd is used for the decompression.
 func DecompressDict(dst, src []byte, dd *DDict) ([]byte, error) {
-	var dctx, dctxDict *dctxWrapper
+	return decompressDictParams(dst, src, dd, nil)
+}
+
+// DecompressWithPrefix appends src decompressed with the given prefix to dst
+// and returns the result.
+//
+// The prefix must be the same as the one passed to CompressWithPrefix*
+// when compressing src. src is expected to contain a single frame.
+func DecompressWithPrefix(dst, src, prefix []byte) ([]byte, error) {
+	dctx := getDCtx(dctxPool)
+	dctx.prefix = prefix
+	dst, err := decompress(dctx, nil, dst, src, nil, 0)
+	dctx.prefix = nil
+	dctxPool.Put(dctx)
+	if err == errContentSizeUnknown {
+		return streamDecompress(dst, src, nil, nil, prefix)
+	}
+	return dst, err
+}
+
+// ErrSizeLimitExceeded is returned when the decompressed data exceeds
+// the limit passed to DecompressLimit or set via ReaderParams.MaxDecompressedSize.
+var ErrSizeLimitExceeded = errors.New("decompressed data size exceeds the limit")
+
+// DecompressLimit appends decompressed src to dst and returns the result.
+//
+// ErrSizeLimitExceeded is returned if the decompressed data exceeds maxSize bytes.
+// DecompressLimit never allocates more than maxSize bytes for the decompressed data,
+// so it is safe to use on untrusted src.
+// Special value maxSize=0 means 'no limit'.
+func DecompressLimit(dst, src []byte, maxSize int) ([]byte, error) {
+	params := &ReaderParams{
+		MaxDecompressedSize: maxSize,
+	}
+	return decompressDictParams(dst, src, nil, params)
+}
+
+// DecompressParams appends decompressed src to dst and returns the result.
+//
+// The given params are used for the decompression.
+// Calling DecompressParams with a nil params is equivalent to calling Decompress.
+func DecompressParams(dst, src []byte, params *ReaderParams) ([]byte, error) {
+	if params == nil {
+		return decompressDictParams(dst, src, nil, nil)
+	}
+	return decompressDictParams(dst, src, params.Dict, params)
+}
+
+func decompressDictParams(dst, src []byte, dd *DDict, params *ReaderParams) ([]byte, error) {
+	limit := 0
+	if params != nil {
+		if params.Format != FormatZstd1 || params.SkippableFrameHandler != nil || params.Dicts != nil {
+			// The functions below support only FormatZstd1 with a single dictionary
+			// and silently skip skippable frames, while Reader supports all of these.
+			return streamDecompress(dst, src, dd, params, nil)
+		}
+		// ZSTD_decompressDCtx doesn't check the window size, so verify it here
+		// in the same way as the Reader does.
+		if err := checkWindowSize(src, params.WindowLogMax); err != nil {
+			return dst, err
+		}
+		limit = params.MaxDecompressedSize
+	}
+
+	var dctx, dctxDict *Decompressor
 	if dd == nil {
-		dctx = dctxPool.Get().(*dctxWrapper)
+		dctx = getDCtx(dctxPool)
 	} else {
-		dctxDict = dctxDictPool.Get().(*dctxWrapper)
+		dctxDict = getDCtx(dctxDictPool)
 	}
 
 	var err error
-	dst, err = decompress(dctx, dctxDict, dst, src, dd)
+	dst, err = decompress(dctx, dctxDict, dst, src, dd, limit)
 
 	if dd == nil {
 		dctxPool.Put(dctx)
 	} else {
 		dctxDictPool.Put(dctxDict)
 	}
+	if err == errContentSizeUnknown {
+		return streamDecompress(dst, src, dd, params, nil)
+	}
 	return dst, err
 }
 
-var dctxPool = &sync.Pool{
-	New: newDCtx,
-}
+var (
+	dctxPool     = newCPool()
+	dctxDictPool = newCPool()
+)
 
-var dctxDictPool = &sync.Pool{
-	New: newDCtx,
+func getDCtx(p *cPool) *Decompressor {
+	v := p.Get()
+	if v == nil {
+		return newDCtx()
+	}
+	return v.(*Decompressor)
 }
 
-func newDCtx() interface{} {
+func newDCtx() *Decompressor {
 	dctx := C.ZSTD_createDCtx()
-	dw := &dctxWrapper{
+	d := &Decompressor{
 		dctx: dctx,
 	}
-	runtime.SetFinalizer(dw, freeDCtx)
-	return dw
+	dctxMem.track(&d.memSize, int(C.ZSTD_sizeof_DCtx(dctx)))
+	runtime.SetFinalizer(d, freeDCtx)
+	return d
 }
 
-func freeDCtx(dw *dctxWrapper) {
-	C.ZSTD_freeDCtx(dw.dctx)
-	dw.dctx = nil
+func freeDCtx(d *Decompressor) {
+	d.Release()
 }
 
-type dctxWrapper struct {
-	dctx *C.ZSTD_DCtx
-}
-
-func decompress(dctx, dctxDict *dctxWrapper, dst, src []byte, dd *DDict) ([]byte, error) {
+// decompress appends decompressed src to dst and returns the result.
+//
+// The decompressed data cannot exceed limit bytes if it is positive.
+// errContentSizeUnknown is returned if src must be decompressed in streaming mode.
+func decompress(dctx, dctxDict *Decompressor, dst, src []byte, dd *DDict, limit int) ([]byte, error) {
 	if len(src) == 0 {
 		return dst, nil
 	}
@@ -241,7 +483,11 @@ func decompress(dctx, dctxDict *dctxWrapper, dst, src []byte, dd *DDict) ([]byte
 	dstLen := len(dst)
 	if cap(dst) > dstLen {
 		// Fast path - try decompressing without dst resize.
-		result := decompressInternal(dctx, dctxDict, dst[dstLen:cap(dst)], src, dd)
+		dstCap := cap(dst)
+		if limit > 0 && dstCap-dstLen > limit {
+			dstCap = dstLen + limit
+		}
+		result := decompressInternal(dctx, dctxDict, dst[dstLen:dstCap:dstCap], src, dd)
 		decompressedSize := int(result)
 		if decompressedSize >= 0 {
 			// All OK.
@@ -250,22 +496,26 @@ func decompress(dctx, dctxDict *dctxWrapper, dst, src []byte, dd *DDict) ([]byte
 
 		if C.ZSTD_getErrorCode(result) != C.ZSTD_error_dstSize_tooSmall {
 			// Error during decompression.
-			return dst[:dstLen], fmt.Errorf("decompression error: %s", errStr(result))
+			return dst[:dstLen], fmt.Errorf("decompression error: %w", newError(result))
 		}
 	}
 
 	// Slow path - resize dst to fit decompressed data.
-	decompressBound := int(C.ZSTD_findDecompressedSize_wrapper(
+	contentSize := uint64(C.ZSTD_findDecompressedSize_wrapper(
 		C.uintptr_t(uintptr(unsafe.Pointer(&src[0]))), C.size_t(len(src))))
 	// Prevent from GC'ing of src during CGO call above.
 	runtime.KeepAlive(src)
-	switch uint64(decompressBound) {
+	switch contentSize {
 	case uint64(C.ZSTD_CONTENTSIZE_UNKNOWN):
-		return streamDecompress(dst, src, dd)
+		return dst, errContentSizeUnknown
 	case uint64(C.ZSTD_CONTENTSIZE_ERROR):
-		return dst, fmt.Errorf("cannot decompress invalid src")
+		return dst, fmt.Errorf("cannot decompress invalid src: %w", findFramesError(src))
 	}
-	decompressBound++
+	if limit > 0 && contentSize > uint64(limit) {
+		// Do not trust the content size from frame headers - src may be malicious.
+		return dst, ErrSizeLimitExceeded
+	}
+	decompressBound := int(contentSize) + 1
 
 	if n := dstLen + decompressBound - cap(dst); n > 0 {
 		// This should be optimized since go 1.11 - see https://golang.org/doc/go1.11#performance-compiler.
@@ -284,12 +534,69 @@ func decompress(dctx, dctxDict *dctxWrapper, dst, src []byte, dd *DDict) ([]byte
 	}
 
 	// Error during decompression.
-	return dst[:dstLen], fmt.Errorf("decompression error: %s", errStr(result))
+	return dst[:dstLen], fmt.Errorf("decompression error: %w", newError(result))
+}
+
+// errContentSizeUnknown is returned by decompress if src contains frames
+// without the content size in the frame header.
+var errContentSizeUnknown = errors.New("cannot determine the decompressed size")
+
+// checkWindowSize returns an error if frames in src require bigger window
+// than allowed by windowLogMax.
+//
+// Invalid frames are left to the decompressor, so it reports the proper error.
+func checkWindowSize(src []byte, windowLogMax int) error {
+	if windowLogMax == 0 {
+		windowLogMax = DefaultWindowLogMax
+	}
+	if windowLogMax < 0 || windowLogMax >= 64 {
+		return nil
+	}
+	maxWindowSize := uint64(1) << uint(windowLogMax)
+	for len(src) > 0 {
+		fh, err := ParseFrameHeader(src)
+		if err != nil {
+			return nil
+		}
+		if !fh.Skippable && fh.WindowSize > maxWindowSize {
+			return fmt.Errorf("decompression error: frame window size %d exceeds the limit %d set via WindowLogMax=%d: %w",
+				fh.WindowSize, maxWindowSize, windowLogMax, ErrFrameParameterWindowTooLarge)
+		}
+		n, err := findFrameCompressedSize(src)
+		if err != nil {
+			return nil
+		}
+		src = src[n:]
+	}
+	return nil
 }
 
-func decompressInternal(dctx, dctxDict *dctxWrapper, dst, src []byte, dd *DDict) C.size_t {
+// findFramesError returns the error for the first invalid frame in src.
+func findFramesError(src []byte) error {
+	for len(src) > 0 {
+		n, err := findFrameCompressedSize(src)
+		if err != nil {
+			return err
+		}
+		src = src[n:]
+	}
+	return ErrCorruption
+}
+
+func decompressInternal(dctx, dctxDict *Decompressor, dst, src []byte, dd *DDict) C.size_t {
 	var n C.size_t
-	if dd != nil {
+	if dd == nil && len(dctx.prefix) > 0 {
+		n = C.ZSTD_decompressPrefix_wrapper(
+			C.uintptr_t(uintptr(unsafe.Pointer(dctx.dctx))),
+			C.uintptr_t(uintptr(unsafe.Pointer(&dst[0]))),
+			C.size_t(cap(dst)),
+			C.uintptr_t(uintptr(unsafe.Pointer(&src[0]))),
+			C.size_t(len(src)),
+			C.uintptr_t(uintptr(unsafe.Pointer(&dctx.prefix[0]))),
+			C.size_t(len(dctx.prefix)))
+		// Prevent from GC'ing of prefix during CGO call above.
+		runtime.KeepAlive(dctx.prefix)
+	} else if dd != nil {
 		n = C.ZSTD_decompress_usingDDict_wrapper(
 			C.uintptr_t(uintptr(unsafe.Pointer(dctxDict.dctx))),
 			C.uintptr_t(uintptr(unsafe.Pointer(&dst[0]))),
@@ -311,25 +618,28 @@ func decompressInternal(dctx, dctxDict *dctxWrapper, dst, src []byte, dd *DDict)
 	return n
 }
 
-func errStr(result C.size_t) string {
-	errCode := C.ZSTD_getErrorCode(result)
-	errCStr := C.ZSTD_getErrorString(errCode)
-	return C.GoString(errCStr)
-}
-
 func ensureNoError(funcName string, result C.size_t) {
 	if int(result) >= 0 {
 		// Fast path - avoid calling C function.
 		return
 	}
 	if C.ZSTD_getErrorCode(result) != 0 {
-		panic(fmt.Errorf("BUG: unexpected error in %s: %s", funcName, errStr(result)))
+		panic(fmt.Errorf("BUG: unexpected error in %s: %w", funcName, newError(result)))
 	}
 }
 
-func streamDecompress(dst, src []byte, dd *DDict) ([]byte, error) {
-	sd := getStreamDecompressor(dd)
+func streamDecompress(dst, src []byte, dd *DDict, params *ReaderParams, prefix []byte) ([]byte, error) {
+	sd := getStreamDecompressor(dd, params)
+	if len(prefix) > 0 {
+		if err := sd.zr.SetPrefix(prefix); err != nil {
+			putStreamDecompressor(sd)
+			return dst, err
+		}
+	}
 	sd.dst = dst
+	if params != nil && params.MaxDecompressedSize > 0 {
+		sd.maxDstLen = len(dst) + params.MaxDecompressedSize
+	}
 	sd.src = src
 	_, err := sd.zr.WriteTo(sd)
 	dst = sd.dst
@@ -342,6 +652,9 @@ type streamDecompressor struct {
 	src       []byte
 	srcOffset int
 
+	// maxDstLen limits the capacity of dst if set to positive value.
+	maxDstLen int
+
 	zr *Reader
 }
 
@@ -358,11 +671,25 @@ func (sr *srcReader) Read(p []byte) (int, error) {
 }
 
 func (sd *streamDecompressor) Write(p []byte) (int, error) {
+	if n := len(sd.dst) + len(p); sd.maxDstLen > 0 && n > cap(sd.dst) {
+		// Grow dst manually, since append may allocate more than maxDstLen bytes.
+		// The Reader guarantees that n doesn't exceed maxDstLen.
+		newCap := 2 * cap(sd.dst)
+		if newCap < n {
+			newCap = n
+		}
+		if newCap > sd.maxDstLen {
+			newCap = sd.maxDstLen
+		}
+		dst := make([]byte, len(sd.dst), newCap)
+		copy(dst, sd.dst)
+		sd.dst = dst
+	}
 	sd.dst = append(sd.dst, p...)
 	return len(p), nil
 }
 
-func getStreamDecompressor(dd *DDict) *streamDecompressor {
+func getStreamDecompressor(dd *DDict, params *ReaderParams) *streamDecompressor {
 	v := streamDecompressorPool.Get()
 	if v == nil {
 		sd := &streamDecompressor{
@@ -371,16 +698,60 @@ func getStreamDecompressor(dd *DDict) *streamDecompressor {
 		v = sd
 	}
 	sd := v.(*streamDecompressor)
-	sd.zr.Reset((*srcReader)(sd), dd)
+	if params == nil {
+		params = &ReaderParams{
+			Dict: dd,
+		}
+	}
+	sd.zr.ResetReaderParams((*srcReader)(sd), params)
 	return sd
 }
 
+// Release releases sd.zr.
+func (sd *streamDecompressor) Release() {
+	sd.zr.Release()
+}
+
+func (sd *streamDecompressor) refreshMemSize() {
+	sd.zr.updateMemSize()
+}
+
 func putStreamDecompressor(sd *streamDecompressor) {
 	sd.dst = nil
 	sd.src = nil
 	sd.srcOffset = 0
-	sd.zr.Reset(nil, nil)
+	sd.maxDstLen = 0
+	sd.zr.ResetReaderParams(nil, &ReaderParams{})
 	streamDecompressorPool.Put(sd)
 }
 
-var streamDecompressorPool sync.Pool
+var streamDecompressorPool = newCPool()
+
+// prefixBuf holds a copy of the prefix in C memory, since zstd references
+// the prefix across multiple CGO calls, while Go memory cannot be retained
+// by C code after the call returns.
+type prefixBuf struct {
+	p    unsafe.Pointer
+	size C.size_t
+	cap  C.size_t
+}
+
+func (pb *prefixBuf) set(prefix []byte) {
+	pb.size = C.size_t(len(prefix))
+	if pb.size == 0 {
+		return
+	}
+	if pb.size > pb.cap {
+		C.free(pb.p)
+		pb.p = C.malloc(pb.size)
+		pb.cap = pb.size
+	}
+	C.memcpy(pb.p, unsafe.Pointer(&prefix[0]), pb.size)
+}
+
+func (pb *prefixBuf) free() {
+	C.free(pb.p)
+	pb.p = nil
+	pb.size = 0
+	pb.cap = 0
+}
@@ -3,6 +3,7 @@ package gozstd
 import (
 	"bytes"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"math/rand"
 	"runtime"
@@ -234,6 +235,64 @@ func TestDecompressInvalidData(t *testing.T) {
 	}
 }
 
+func TestDecompressLimit(t *testing.T) {
+	data := []byte(newTestString(256*1024, 3))
+
+	// Frame with known content size.
+	cdKnown := Compress(nil, data)
+
+	// Frame with unknown content size.
+	var bb bytes.Buffer
+	zw := NewWriter(&bb)
+	if _, err := zw.Write(data); err != nil {
+		t.Fatalf("cannot compress data: %s", err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("cannot close zw: %s", err)
+	}
+	zw.Release()
+	cdUnknown := bb.Bytes()
+
+	for _, cd := range [][]byte{cdKnown, cdUnknown} {
+		// The limit is exceeded.
+		if _, err := DecompressLimit(nil, cd, len(data)-1); err != ErrSizeLimitExceeded {
+			t.Fatalf("unexpected error; got %v; want %v", err, ErrSizeLimitExceeded)
+		}
+		buf := make([]byte, 0, 2*len(data))
+		if _, err := DecompressLimit(buf, cd, len(data)/2); err != ErrSizeLimitExceeded {
+			t.Fatalf("unexpected error for non-empty buf; got %v; want %v", err, ErrSizeLimitExceeded)
+		}
+
+		// The limit isn't exceeded.
+		plainData, err := DecompressLimit(nil, cd, len(data))
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if !bytes.Equal(plainData, data) {
+			t.Fatalf("unexpected data decompressed; got\n%X; want\n%X", plainData, data)
+		}
+		if cap(plainData) > len(data)+1 {
+			t.Fatalf("too big capacity for the decompressed data; got %d; mustn't exceed %d", cap(plainData), len(data)+1)
+		}
+		plainData, err = DecompressLimit([]byte("foo"), cd, len(data))
+		if err != nil {
+			t.Fatalf("unexpected error for non-empty dst: %s", err)
+		}
+		if string(plainData[:3]) != "foo" || !bytes.Equal(plainData[3:], data) {
+			t.Fatalf("unexpected data decompressed for non-empty dst")
+		}
+	}
+
+	// Make sure the limit doesn't leak into Decompress via pooled objects.
+	plainData, err := Decompress(nil, cdUnknown)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !bytes.Equal(plainData, data) {
+		t.Fatalf("unexpected data decompressed; got\n%X; want\n%X", plainData, data)
+	}
+}
+
 func TestCompressLevel(t *testing.T) {
 	src := []byte("foobar baz")
 
@@ -260,6 +319,248 @@ func testCompressLevel(t *testing.T, src []byte, compressionLevel int) {
 	}
 }
 
+func TestTryCompressLevel(t *testing.T) {
+	src := []byte(newTestString(1024, 3))
+	for level := 1; level < 22; level++ {
+		cd, err := TryCompressLevel(nil, src, level)
+		if err != nil {
+			t.Fatalf("unexpected error on level %d: %s", level, err)
+		}
+		plainData, err := Decompress(nil, cd)
+		if err != nil {
+			t.Fatalf("cannot decompress data compressed on level %d: %s", level, err)
+		}
+		if !bytes.Equal(plainData, src) {
+			t.Fatalf("unexpected data decompressed on level %d; got\n%X; want\n%X", level, plainData, src)
+		}
+	}
+}
+
+func TestCompressParams(t *testing.T) {
+	src := []byte(newTestString(64*1024, 3))
+
+	dict := []byte(newTestString(1024, 3))
+	cd, err := NewCDict(dict)
+	if err != nil {
+		t.Fatalf("cannot create CDict: %s", err)
+	}
+	defer cd.Release()
+	dd, err := NewDDict(dict)
+	if err != nil {
+		t.Fatalf("cannot create DDict: %s", err)
+	}
+	defer dd.Release()
+
+	testCompressParams(t, src, nil, nil)
+	testCompressParams(t, src, &WriterParams{}, nil)
+	testCompressParams(t, src, &WriterParams{CompressionLevel: 19, WindowLog: 12}, &ReaderParams{WindowLogMax: 12})
+	testCompressParams(t, src, &WriterParams{Strategy: StrategyLazy2, EnableChecksum: true}, nil)
+	testCompressParams(t, src, &WriterParams{LongDistanceMatching: ParamSwitchEnable, WindowLog: 24}, nil)
+	testCompressParams(t, src, &WriterParams{DisableContentSize: true}, nil)
+	testCompressParams(t, src, &WriterParams{Format: FormatZstd1Magicless}, &ReaderParams{Format: FormatZstd1Magicless})
+	testCompressParams(t, src, &WriterParams{Dict: cd, EnableChecksum: true}, &ReaderParams{Dict: dd})
+}
+
+func testCompressParams(t *testing.T, src []byte, wp *WriterParams, rp *ReaderParams) {
+	t.Helper()
+
+	prefix := []byte("prefix")
+	for i := 0; i < 3; i++ {
+		cd, err := CompressParams(prefix, src, wp)
+		if err != nil {
+			t.Fatalf("unexpected error with params %+v: %s", wp, err)
+		}
+		if !bytes.Equal(cd[:len(prefix)], prefix) {
+			t.Fatalf("unexpected prefix; got %q; want %q", cd[:len(prefix)], prefix)
+		}
+		plainData, err := DecompressParams(nil, cd[len(prefix):], rp)
+		if err != nil {
+			t.Fatalf("cannot decompress data compressed with params %+v: %s", wp, err)
+		}
+		if !bytes.Equal(plainData, src) {
+			t.Fatalf("unexpected data decompressed with params %+v; got\n%X; want\n%X", wp, plainData, src)
+		}
+
+		// Verify the params do not leak to subsequent calls.
+		cd, err = CompressParams(nil, src, &WriterParams{})
+		if err != nil {
+			t.Fatalf("unexpected error with default params: %s", err)
+		}
+		plainData, err = Decompress(nil, cd)
+		if err != nil {
+			t.Fatalf("cannot decompress data compressed with default params: %s", err)
+		}
+		if !bytes.Equal(plainData, src) {
+			t.Fatalf("unexpected data decompressed with default params; got\n%X; want\n%X", plainData, src)
+		}
+	}
+}
+
+func TestCompressParamsMagicless(t *testing.T) {
+	src := []byte(newTestString(1024, 3))
+	cd, err := CompressParams(nil, src, &WriterParams{Format: FormatZstd1Magicless})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	cdStd, err := CompressParams(nil, src, &WriterParams{})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(cd) != len(cdStd)-4 {
+		t.Fatalf("unexpected magicless frame size; got %d; want %d", len(cd), len(cdStd)-4)
+	}
+	if _, err := Decompress(nil, cd); err == nil {
+		t.Fatalf("expecting non-nil error when decompressing magicless frame with the default format")
+	}
+}
+
+func TestCompressParamsSinglePool(t *testing.T) {
+	src := []byte(newTestString(1024, 3))
+	if _, err := CompressParams(nil, src, &WriterParams{}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	cPoolsLock.Lock()
+	poolsCount := len(cPools)
+	cPoolsLock.Unlock()
+
+	// Distinct params mustn't create distinct pools, while params
+	// mustn't leak between calls.
+	for i := 0; i < 100; i++ {
+		params := &WriterParams{
+			SrcSizeHint:    1000 + i,
+			EnableChecksum: i%2 == 0,
+		}
+		cd, err := CompressParams(nil, src, params)
+		if err != nil {
+			t.Fatalf("cannot compress data with params %+v: %s", params, err)
+		}
+		fh, err := ParseFrameHeader(cd)
+		if err != nil {
+			t.Fatalf("cannot parse frame header: %s", err)
+		}
+		if fh.HasChecksum != params.EnableChecksum {
+			t.Fatalf("unexpected checksum flag for params %+v; got %v", params, fh.HasChecksum)
+		}
+	}
+
+	cPoolsLock.Lock()
+	n := len(cPools)
+	cPoolsLock.Unlock()
+	if n != poolsCount {
+		t.Fatalf("unexpected number of pools; got %d; want %d", n, poolsCount)
+	}
+}
+
+func TestCompressParamsInvalid(t *testing.T) {
+	src := []byte(newTestString(1024, 3))
+	_, err := CompressParams(nil, src, &WriterParams{WindowLog: 100})
+	if !errors.Is(err, ErrParameterOutOfBound) {
+		t.Fatalf("unexpected error; got %v; want %v", err, ErrParameterOutOfBound)
+	}
+
+	cd, err := NewCDict([]byte(newTestString(1024, 3)))
+	if err != nil {
+		t.Fatalf("cannot create CDict: %s", err)
+	}
+	cd.Release()
+	if _, err := CompressParams(nil, src, &WriterParams{Dict: cd}); err == nil {
+		t.Fatalf("expecting non-nil error when using released dict")
+	}
+
+	// Verify the pooled context remains usable after the errors.
+	data, err := CompressParams(nil, src, &WriterParams{WindowLog: 10})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	plainData, err := Decompress(nil, data)
+	if err != nil {
+		t.Fatalf("cannot decompress data: %s", err)
+	}
+	if !bytes.Equal(plainData, src) {
+		t.Fatalf("unexpected data decompressed; got\n%X; want\n%X", plainData, src)
+	}
+}
+
+func TestCompressWithPrefix(t *testing.T) {
+	prev := newTestDocument(64 * 1024)
+	for i := 0; i < 5; i++ {
+		// Create the next version of the document by modifying the previous one.
+		next := append([]byte{}, prev...)
+		for j := 0; j < 10; j++ {
+			next[rand.Intn(len(next))] = byte(rand.Intn(256))
+		}
+		next = append(next, fmt.Sprintf("version %d", i)...)
+
+		cd := CompressWithPrefixLevel(nil, next, prev, 5)
+		cdNoPrefix := CompressLevel(nil, next, 5)
+		if len(cd) >= len(cdNoPrefix)/10 {
+			t.Fatalf("too big data compressed with prefix; got %d bytes; want less than %d bytes", len(cd), len(cdNoPrefix)/10)
+		}
+		plainData, err := DecompressWithPrefix(nil, cd, prev)
+		if err != nil {
+			t.Fatalf("cannot decompress data with prefix: %s", err)
+		}
+		if !bytes.Equal(plainData, next) {
+			t.Fatalf("unexpected data decompressed with prefix; got %d bytes; want %d bytes", len(plainData), len(next))
+		}
+		if plainData, err := Decompress(nil, cd); err == nil && bytes.Equal(plainData, next) {
+			t.Fatalf("expecting failure when decompressing data without prefix")
+		}
+
+		// Frames without content size must be decompressed via stream decompressor.
+		var bb bytes.Buffer
+		zw := NewWriter(&bb)
+		if err := zw.SetPrefix(prev); err != nil {
+			t.Fatalf("cannot set prefix: %s", err)
+		}
+		if _, err := zw.Write(next); err != nil {
+			t.Fatalf("cannot write data: %s", err)
+		}
+		if err := zw.Close(); err != nil {
+			t.Fatalf("cannot close writer: %s", err)
+		}
+		zw.Release()
+		plainData, err = DecompressWithPrefix(plainData[:0], bb.Bytes(), prev)
+		if err != nil {
+			t.Fatalf("cannot decompress stream data with prefix: %s", err)
+		}
+		if !bytes.Equal(plainData, next) {
+			t.Fatalf("unexpected stream data decompressed with prefix; got %d bytes; want %d bytes", len(plainData), len(next))
+		}
+
+		prev = next
+	}
+
+	// Empty prefix must be ignored.
+	src := []byte("foobar")
+	plainData, err := DecompressWithPrefix(nil, CompressWithPrefix(nil, src, nil), nil)
+	if err != nil {
+		t.Fatalf("cannot decompress data with empty prefix: %s", err)
+	}
+	if !bytes.Equal(plainData, src) {
+		t.Fatalf("unexpected data decompressed with empty prefix; got %q; want %q", plainData, src)
+	}
+
+	// Pooled contexts must not keep the prefix.
+	plainData, err = Decompress(nil, Compress(nil, src))
+	if err != nil {
+		t.Fatalf("cannot decompress data: %s", err)
+	}
+	if !bytes.Equal(plainData, src) {
+		t.Fatalf("unexpected data decompressed; got %q; want %q", plainData, src)
+	}
+}
+
+// newTestDocument returns text document of the given size with random values.
+func newTestDocument(size int) []byte {
+	var bb bytes.Buffer
+	for bb.Len() < size {
+		fmt.Fprintf(&bb, "line %d: value=%d\n", bb.Len(), rand.Intn(1000000))
+	}
+	return bb.Bytes()
+}
+
 func TestCompressDecompress(t *testing.T) {
 	testCompressDecompress(t, "")
 	testCompressDecompress(t, "a")
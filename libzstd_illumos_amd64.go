@@ -1,5 +1,8 @@
 package gozstd
 
+// libzstd_illumos_amd64.a is built without multithreading support,
+// so WriterParams.Workers is ignored on illumos/amd64. See MaxWorkers.
+
 /*
 #cgo LDFLAGS: ${SRCDIR}/libzstd_illumos_amd64.a
 */
@@ -1,5 +1,8 @@
 package gozstd
 
+// libzstd_windows_amd64.a is built without multithreading support,
+// so WriterParams.Workers is ignored on windows/amd64. See MaxWorkers.
+
 /*
 #cgo LDFLAGS: ${SRCDIR}/libzstd_windows_amd64.a
 */
@@ -0,0 +1,706 @@
+package gozstd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"runtime"
+)
+
+// DefaultParallelChunkSize is the default number of uncompressed bytes
+// per frame written by ParallelWriter.
+const DefaultParallelChunkSize = 1024 * 1024
+
+// ParallelWriterParams allows users to specify parameters
+// for NewParallelWriter.
+type ParallelWriterParams struct {
+	// WriterParams are the parameters used for compressing chunks.
+	WriterParams WriterParams
+
+	// ChunkSize is the number of uncompressed bytes per frame.
+	// Bigger chunks give better compression ratio at the cost
+	// of higher memory usage.
+	// Special value 0 means 'use DefaultParallelChunkSize'.
+	ChunkSize int
+
+	// Concurrency is the maximum number of chunks compressed concurrently.
+	// Special value 0 means 'use runtime.GOMAXPROCS(0)'.
+	Concurrency int
+
+	// EnablePzstdFormat enables writing the format of pzstd tool
+	// from zstd/contrib/pzstd, where every frame is preceded by skippable
+	// frame containing the compressed size of the frame.
+	// This allows pzstd to decompress the frames in parallel.
+	EnablePzstdFormat bool
+}
+
+// ParallelWriter compresses the written data in parallel.
+//
+// The written data is split into chunks, which are compressed concurrently
+// into independent frames. The frames are written to the underlying writer
+// in order, so the output is a regular multi-frame zstd stream, which may be
+// decompressed by Reader, Decompress* or any zstd decompressor.
+//
+// Unlike WriterParams.Workers, ParallelWriter doesn't need libzstd
+// built with multithreading support.
+//
+// ParallelWriter cannot be used from concurrently running goroutines.
+type ParallelWriter struct {
+	w      io.Writer
+	params WriterParams
+	err    error
+
+	chunkSize int
+
+	// cur holds the current chunk in src, which isn't submitted for compression yet.
+	cur *parallelJob
+
+	// jobs contains the submitted chunks in the order they were written.
+	jobs []*parallelJob
+
+	// freeJobs contains jobs with buffers ready for re-use.
+	freeJobs []*parallelJob
+
+	// concurrency is the maximum number of submitted jobs.
+	concurrency int
+
+	pzstd bool
+}
+
+type parallelJob struct {
+	src  []byte
+	dst  []byte
+	err  error
+	done chan struct{}
+
+	// sequential is set if the frame in src is too big for decompressing
+	// into dst, so it must be streamed by ParallelReader.
+	sequential bool
+}
+
+// NewParallelWriter returns new ParallelWriter writing compressed data to w
+// using the given params.
+//
+// Calling NewParallelWriter with nil params is equivalent to calling it
+// with zero ParallelWriterParams.
+//
+// An error on invalid params is returned by subsequent ParallelWriter calls.
+//
+// The returned writer must be closed with Close call in order
+// to flush all the compressed data to w.
+func NewParallelWriter(w io.Writer, params *ParallelWriterParams) *ParallelWriter {
+	if params == nil {
+		params = &ParallelWriterParams{}
+	}
+	pw := &ParallelWriter{
+		w:         w,
+		params:    params.WriterParams,
+		chunkSize: params.ChunkSize,
+		pzstd:     params.EnablePzstdFormat,
+	}
+	if pw.chunkSize == 0 {
+		pw.chunkSize = DefaultParallelChunkSize
+	}
+	pw.concurrency = params.Concurrency
+	if pw.concurrency == 0 {
+		pw.concurrency = runtime.GOMAXPROCS(0)
+	}
+
+	switch {
+	case pw.chunkSize < 0:
+		pw.err = fmt.Errorf("invalid ChunkSize=%d; it cannot be negative", params.ChunkSize)
+	case pw.concurrency < 0:
+		pw.err = fmt.Errorf("invalid Concurrency=%d; it cannot be negative", params.Concurrency)
+	default:
+		// Verify params by compressing empty data.
+		_, pw.err = CompressParams(nil, nil, &pw.params)
+	}
+	return pw
+}
+
+// Write writes p to pw.
+//
+// Write doesn't flush the compressed data to the underlying writer
+// due to performance reasons.
+// Call Flush or Close when the compressed data must propagate
+// to the underlying writer.
+func (pw *ParallelWriter) Write(p []byte) (int, error) {
+	if pw.err != nil {
+		return 0, pw.err
+	}
+	pLen := len(p)
+	for len(p) > 0 {
+		if pw.cur == nil {
+			pw.cur = pw.getJob()
+		}
+		n := pw.chunkSize - len(pw.cur.src)
+		if n > len(p) {
+			n = len(p)
+		}
+		pw.cur.src = append(pw.cur.src, p[:n]...)
+		p = p[n:]
+		if len(pw.cur.src) == pw.chunkSize {
+			if err := pw.submitChunk(); err != nil {
+				return pLen - len(p), err
+			}
+		}
+	}
+	return pLen, nil
+}
+
+// Flush compresses the buffered data and writes all the compressed data
+// to the underlying writer.
+//
+// The buffered data is compressed into a separate frame, so frequent
+// Flush calls may worsen the compression ratio.
+func (pw *ParallelWriter) Flush() error {
+	if pw.err != nil {
+		return pw.err
+	}
+	if pw.cur != nil && len(pw.cur.src) > 0 {
+		if err := pw.submitChunk(); err != nil {
+			return err
+		}
+	}
+	for len(pw.jobs) > 0 {
+		if err := pw.writeJob(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close flushes all the compressed data to the underlying writer.
+//
+// It doesn't close the underlying writer passed to NewParallelWriter.
+// pw may be used for writing more data after Close, since every chunk
+// is written in a separate frame.
+func (pw *ParallelWriter) Close() error {
+	return pw.Flush()
+}
+
+func (pw *ParallelWriter) submitChunk() error {
+	// Limit the number of concurrently compressed chunks and the number
+	// of chunks held in memory by writing the oldest chunk
+	// if too many chunks are in flight.
+	for len(pw.jobs) >= pw.concurrency {
+		if err := pw.writeJob(); err != nil {
+			return err
+		}
+	}
+
+	job := pw.cur
+	pw.cur = nil
+	job.done = make(chan struct{})
+	pw.jobs = append(pw.jobs, job)
+
+	params := &pw.params
+	pzstd := pw.pzstd
+	go func() {
+		if pzstd {
+			job.dst, job.err = compressPzstdFrame(job.dst[:0], job.src, params)
+		} else {
+			job.dst, job.err = CompressParams(job.dst[:0], job.src, params)
+		}
+		close(job.done)
+	}()
+	return nil
+}
+
+// writeJob waits until the oldest job is compressed and writes it to the underlying writer.
+func (pw *ParallelWriter) writeJob() error {
+	job := pw.jobs[0]
+	<-job.done
+	pw.jobs[0] = nil
+	pw.jobs = pw.jobs[1:]
+	err := job.err
+	if err == nil {
+		if _, werr := pw.w.Write(job.dst); werr != nil {
+			err = fmt.Errorf("cannot write compressed data to the underlying writer: %w", werr)
+		}
+	}
+	pw.putJob(job)
+	if err != nil {
+		pw.err = err
+	}
+	return err
+}
+
+// compressPzstdFrame appends src compressed into a frame preceded
+// by pzstd skippable frame to dst and returns the result.
+func compressPzstdFrame(dst, src []byte, params *WriterParams) ([]byte, error) {
+	dstLen := len(dst)
+	dst = append(dst, make([]byte, pzstdFrameHeaderSize)...)
+	dst, err := CompressParams(dst, src, params)
+	if err != nil {
+		return dst[:dstLen], err
+	}
+	frameSize := len(dst) - dstLen - pzstdFrameHeaderSize
+	if uint64(frameSize) > math.MaxUint32 {
+		return dst[:dstLen], fmt.Errorf("too big compressed frame for pzstd format: %d bytes; it cannot exceed %d bytes; decrease ChunkSize", frameSize, uint32(math.MaxUint32))
+	}
+	h := dst[dstLen:]
+	binary.LittleEndian.PutUint32(h, skippableFrameMagicStart)
+	binary.LittleEndian.PutUint32(h[4:], pzstdFrameHeaderSize-SkippableFrameHeaderSize)
+	binary.LittleEndian.PutUint32(h[8:], uint32(frameSize))
+	return dst, nil
+}
+
+// pzstdFrameSize returns the size of the frame following pzstd skippable frame in src.
+//
+// src must contain the whole skippable frame. 0 is returned if src
+// doesn't contain pzstd skippable frame.
+func pzstdFrameSize(src []byte) int {
+	if len(src) != pzstdFrameHeaderSize ||
+		binary.LittleEndian.Uint32(src) != skippableFrameMagicStart ||
+		binary.LittleEndian.Uint32(src[4:]) != pzstdFrameHeaderSize-SkippableFrameHeaderSize {
+		return 0
+	}
+	return int(binary.LittleEndian.Uint32(src[8:]))
+}
+
+// pzstdFrameHeaderSize is the size of skippable frame preceding
+// every frame in pzstd format.
+const pzstdFrameHeaderSize = 12 // SkippableFrame::kSize from zstd/contrib/pzstd/SkippableFrame.h
+
+func (pw *ParallelWriter) getJob() *parallelJob {
+	n := len(pw.freeJobs)
+	if n == 0 {
+		return &parallelJob{
+			src: make([]byte, 0, pw.chunkSize),
+		}
+	}
+	job := pw.freeJobs[n-1]
+	pw.freeJobs[n-1] = nil
+	pw.freeJobs = pw.freeJobs[:n-1]
+	return job
+}
+
+func (pw *ParallelWriter) putJob(job *parallelJob) {
+	job.src = job.src[:0]
+	job.dst = job.dst[:0]
+	job.err = nil
+	job.done = nil
+	pw.freeJobs = append(pw.freeJobs, job)
+}
+
+// DefaultParallelMaxFrameSize is the default maximum size of compressed frame
+// decompressed in parallel by ParallelReader.
+const DefaultParallelMaxFrameSize = 64 * 1024 * 1024
+
+// DefaultParallelMaxFrameContentSize is the default maximum decompressed size
+// of frame decompressed in parallel by ParallelReader.
+const DefaultParallelMaxFrameContentSize = 64 * 1024 * 1024
+
+// ParallelReaderParams allows users to specify parameters
+// for NewParallelReader.
+type ParallelReaderParams struct {
+	// ReaderParams are the parameters used for decompressing frames.
+	//
+	// ReaderParams.MaxDecompressedSize limits the decompressed size
+	// of every frame. ReaderParams.Format must be FormatZstd1,
+	// while ReaderParams.SkippableFrameHandler isn't supported.
+	ReaderParams ReaderParams
+
+	// Concurrency is the maximum number of frames decompressed concurrently.
+	// Special value 0 means 'use runtime.GOMAXPROCS(0)'.
+	Concurrency int
+
+	// MaxFrameSize is the maximum size of compressed frame, which may be
+	// decompressed in parallel. The remaining data starting from a bigger frame
+	// is decompressed sequentially.
+	// Special value 0 means 'use DefaultParallelMaxFrameSize'.
+	MaxFrameSize int
+
+	// MaxFrameContentSize is the maximum decompressed size of frame, which may be
+	// decompressed in parallel. Bigger frames are streamed sequentially
+	// without buffering their decompressed data in memory.
+	// Special value 0 means 'use DefaultParallelMaxFrameContentSize'.
+	MaxFrameContentSize int
+}
+
+// ParallelReader decompresses multi-frame streams in parallel.
+//
+// The input is split into frames, which are decompressed concurrently.
+// The decompressed data is returned in order. The memory usage is limited
+// by Concurrency*(MaxFrameSize+MaxFrameContentSize) bytes, since frames
+// with bigger decompressed size are streamed sequentially.
+//
+// Multi-frame streams are created by ParallelWriter, SeekableWriter,
+// Writer.Close calls, zstd -T and pzstd. Skippable frames are skipped.
+// The frame sizes stored by pzstd and ParallelWriterParams.EnablePzstdFormat
+// are used for splitting the input into frames. Use Reader for single-frame streams,
+// since they cannot be decompressed in parallel.
+//
+// ParallelReader cannot be used from concurrently running goroutines.
+type ParallelReader struct {
+	r      io.Reader
+	params ReaderParams
+	err    error
+
+	concurrency         int
+	maxFrameSize        int
+	maxFrameContentSize int
+
+	// jobParams are the params used for decompressing frames in parallel.
+	// They limit the decompressed size of frames without content size
+	// in the frame header to maxFrameContentSize.
+	jobParams ReaderParams
+
+	// inBuf contains the data read from r, which isn't split into frames yet,
+	// starting from inPos.
+	inBuf []byte
+	inPos int
+
+	// inErr is the error returned by r. It is io.EOF at the end of r.
+	inErr error
+
+	// nextFrameSize is the size of the next frame obtained from pzstd skippable frame.
+	nextFrameSize int
+
+	// jobs contains the frames submitted for decompression in the order they were read.
+	jobs []*parallelJob
+
+	// freeJobs contains jobs with buffers ready for re-use.
+	freeJobs []*parallelJob
+
+	// outJob contains the decompressed data returned by Read and WriteTo starting from outPos.
+	outJob *parallelJob
+	outPos int
+
+	// frameZr streams the sequential frame from outJob.
+	frameZr *Reader
+
+	// zr decompresses the data sequentially starting from the frame
+	// exceeding maxFrameSize.
+	zr *Reader
+}
+
+// NewParallelReader returns new ParallelReader reading compressed data from r
+// using the given params.
+//
+// Calling NewParallelReader with nil params is equivalent to calling it
+// with zero ParallelReaderParams.
+//
+// An error on invalid params is returned by subsequent ParallelReader calls.
+//
+// Call Release when the ParallelReader is no longer needed.
+func NewParallelReader(r io.Reader, params *ParallelReaderParams) *ParallelReader {
+	if params == nil {
+		params = &ParallelReaderParams{}
+	}
+	pr := &ParallelReader{
+		r:                   r,
+		params:              params.ReaderParams,
+		concurrency:         params.Concurrency,
+		maxFrameSize:        params.MaxFrameSize,
+		maxFrameContentSize: params.MaxFrameContentSize,
+	}
+	if pr.concurrency == 0 {
+		pr.concurrency = runtime.GOMAXPROCS(0)
+	}
+	if pr.maxFrameSize == 0 {
+		pr.maxFrameSize = DefaultParallelMaxFrameSize
+	}
+	if pr.maxFrameContentSize == 0 {
+		pr.maxFrameContentSize = DefaultParallelMaxFrameContentSize
+	}
+	pr.jobParams = pr.params
+	if limit := pr.jobParams.MaxDecompressedSize; limit == 0 || limit > pr.maxFrameContentSize {
+		pr.jobParams.MaxDecompressedSize = pr.maxFrameContentSize
+	}
+
+	switch {
+	case pr.concurrency < 0:
+		pr.err = fmt.Errorf("invalid Concurrency=%d; it cannot be negative", params.Concurrency)
+	case pr.maxFrameSize < 0:
+		pr.err = fmt.Errorf("invalid MaxFrameSize=%d; it cannot be negative", params.MaxFrameSize)
+	case pr.maxFrameContentSize < 0:
+		pr.err = fmt.Errorf("invalid MaxFrameContentSize=%d; it cannot be negative", params.MaxFrameContentSize)
+	case pr.params.Format != FormatZstd1:
+		pr.err = fmt.Errorf("unsupported Format=%d; ParallelReader supports only FormatZstd1", pr.params.Format)
+	case pr.params.SkippableFrameHandler != nil:
+		pr.err = fmt.Errorf("SkippableFrameHandler isn't supported by ParallelReader")
+	}
+	return pr
+}
+
+// Release releases all the resources occupied by pr.
+//
+// pr cannot be used after the release.
+func (pr *ParallelReader) Release() {
+	if pr.frameZr != nil {
+		pr.frameZr.Release()
+		pr.frameZr = nil
+	}
+	if pr.zr != nil {
+		pr.zr.Release()
+		pr.zr = nil
+	}
+	pr.r = nil
+	pr.inBuf = nil
+	pr.jobs = nil
+	pr.freeJobs = nil
+	pr.outJob = nil
+}
+
+// Read reads up to len(p) decompressed bytes from pr to p.
+//
+// io.ErrUnexpectedEOF is returned if the underlying reader ends
+// in the middle of a frame.
+func (pr *ParallelReader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	for {
+		if pr.err != nil {
+			return 0, pr.err
+		}
+		if pr.outJob != nil && pr.outPos < len(pr.outJob.dst) {
+			n := copy(p, pr.outJob.dst[pr.outPos:])
+			pr.outPos += n
+			return n, nil
+		}
+		if pr.frameZr != nil {
+			n, err := pr.frameZr.Read(p)
+			if err == io.EOF {
+				pr.releaseFrameReader()
+				if n == 0 {
+					continue
+				}
+				err = nil
+			}
+			if err != nil {
+				pr.err = err
+			}
+			return n, err
+		}
+		if pr.zr != nil {
+			return pr.zr.Read(p)
+		}
+		if err := pr.nextJob(); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// WriteTo writes all the decompressed data from pr to w.
+//
+// It returns the number of bytes written to w.
+//
+// io.ErrUnexpectedEOF is returned if the underlying reader ends
+// in the middle of a frame.
+func (pr *ParallelReader) WriteTo(w io.Writer) (int64, error) {
+	nn := int64(0)
+	for {
+		if pr.err != nil {
+			return nn, pr.err
+		}
+		if pr.outJob != nil && pr.outPos < len(pr.outJob.dst) {
+			n, err := w.Write(pr.outJob.dst[pr.outPos:])
+			pr.outPos += n
+			nn += int64(n)
+			if err != nil {
+				return nn, err
+			}
+			continue
+		}
+		if pr.frameZr != nil {
+			n, err := pr.frameZr.WriteTo(w)
+			nn += n
+			if err != nil {
+				pr.err = err
+				return nn, err
+			}
+			pr.releaseFrameReader()
+			continue
+		}
+		if pr.zr != nil {
+			n, err := pr.zr.WriteTo(w)
+			nn += n
+			return nn, err
+		}
+		if err := pr.nextJob(); err != nil {
+			if err == io.EOF {
+				return nn, nil
+			}
+			return nn, err
+		}
+	}
+}
+
+// nextJob waits for the next decompressed frame and makes it current.
+//
+// io.EOF is returned if there are no more frames.
+func (pr *ParallelReader) nextJob() error {
+	if pr.outJob != nil {
+		pr.putJob(pr.outJob)
+		pr.outJob = nil
+	}
+	if err := pr.submitJobs(); err != nil {
+		return err
+	}
+	if len(pr.jobs) == 0 {
+		if pr.inPos < len(pr.inBuf) {
+			// The next frame exceeds maxFrameSize. Decompress the remaining data sequentially.
+			rest := io.MultiReader(bytes.NewReader(pr.inBuf[pr.inPos:]), pr.r)
+			pr.zr = NewReaderParams(rest, &pr.params)
+			return nil
+		}
+		if pr.inErr != io.EOF {
+			pr.err = fmt.Errorf("cannot read data from the underlying reader: %w", pr.inErr)
+			return pr.err
+		}
+		return io.EOF
+	}
+
+	job := pr.jobs[0]
+	<-job.done
+	pr.jobs[0] = nil
+	pr.jobs = pr.jobs[1:]
+	pr.outJob = job
+	pr.outPos = 0
+	if job.err != nil && errors.Is(job.err, ErrSizeLimitExceeded) && pr.jobParams.MaxDecompressedSize != pr.params.MaxDecompressedSize {
+		// The frame without content size in the frame header exceeds maxFrameContentSize.
+		job.sequential = true
+		job.err = nil
+	}
+	if job.err != nil {
+		pr.err = job.err
+		return pr.err
+	}
+	if job.sequential {
+		// Stream the frame instead of decompressing it into job.dst.
+		pr.outPos = len(job.dst)
+		pr.frameZr = NewReaderParams(bytes.NewReader(job.src), &pr.params)
+	}
+	return nil
+}
+
+func (pr *ParallelReader) releaseFrameReader() {
+	pr.frameZr.Release()
+	pr.frameZr = nil
+}
+
+// submitJobs splits the data read from the underlying reader into frames
+// and submits them for decompression until concurrency frames are in flight.
+func (pr *ParallelReader) submitJobs() error {
+	for len(pr.jobs) < pr.concurrency {
+		src := pr.inBuf[pr.inPos:]
+		n := pr.nextFrameSize
+		var err error
+		if n == 0 {
+			n, err = findFrameCompressedSize(src)
+		} else if n > len(src) {
+			err = ErrSrcSizeWrong
+		}
+		if err != nil {
+			if len(src) == 0 && pr.inErr != nil {
+				// All the frames are submitted.
+				return nil
+			}
+			if !errors.Is(err, ErrSrcSizeWrong) {
+				pr.submitError(fmt.Errorf("cannot decompress data: %w", err))
+				return nil
+			}
+			if pr.inErr != nil {
+				if pr.inErr == io.EOF {
+					pr.submitError(io.ErrUnexpectedEOF)
+				} else {
+					pr.submitError(fmt.Errorf("cannot read data from the underlying reader: %w", pr.inErr))
+				}
+				return nil
+			}
+			if len(src) >= pr.maxFrameSize {
+				// The frame is too big for parallel decompression.
+				// It will be decompressed sequentially after the submitted frames.
+				return nil
+			}
+			pr.readInBuf()
+			continue
+		}
+
+		if n >= 4 && isSkippableFrameMagic(binary.LittleEndian.Uint32(src)) {
+			pr.nextFrameSize = pzstdFrameSize(src[:n])
+			pr.inPos += n
+			continue
+		}
+		pr.nextFrameSize = 0
+
+		job := pr.getJob()
+		job.src = append(job.src[:0], src[:n]...)
+		job.done = make(chan struct{})
+		pr.inPos += n
+		pr.jobs = append(pr.jobs, job)
+		if fh, err := ParseFrameHeader(job.src); err == nil && fh.ContentSize != ContentSizeUnknown && fh.ContentSize > uint64(pr.maxFrameContentSize) {
+			// The frame is too big for decompressing in memory.
+			// It will be streamed when all the previous frames are read.
+			job.sequential = true
+			close(job.done)
+			continue
+		}
+		params := &pr.jobParams
+		go func() {
+			job.dst, job.err = DecompressParams(job.dst[:0], job.src, params)
+			close(job.done)
+		}()
+	}
+	return nil
+}
+
+// submitError submits job returning the given err in order with the previously submitted jobs.
+func (pr *ParallelReader) submitError(err error) {
+	job := pr.getJob()
+	job.err = err
+	job.done = make(chan struct{})
+	close(job.done)
+	pr.jobs = append(pr.jobs, job)
+	pr.inPos = len(pr.inBuf)
+	if pr.inErr == nil {
+		pr.inErr = io.EOF
+	}
+}
+
+// readInBuf reads more data from the underlying reader into inBuf.
+func (pr *ParallelReader) readInBuf() {
+	// Move the unprocessed data to the start of inBuf.
+	n := copy(pr.inBuf, pr.inBuf[pr.inPos:])
+	pr.inBuf = pr.inBuf[:n]
+	pr.inPos = 0
+
+	if cap(pr.inBuf)-len(pr.inBuf) < parallelReadSize {
+		inBuf := make([]byte, len(pr.inBuf), 2*cap(pr.inBuf)+parallelReadSize)
+		copy(inBuf, pr.inBuf)
+		pr.inBuf = inBuf
+	}
+	n, err := pr.r.Read(pr.inBuf[len(pr.inBuf):cap(pr.inBuf)])
+	pr.inBuf = pr.inBuf[:len(pr.inBuf)+n]
+	if err != nil {
+		pr.inErr = err
+	}
+}
+
+const parallelReadSize = 64 * 1024
+
+func (pr *ParallelReader) getJob() *parallelJob {
+	n := len(pr.freeJobs)
+	if n == 0 {
+		return &parallelJob{}
+	}
+	job := pr.freeJobs[n-1]
+	pr.freeJobs[n-1] = nil
+	pr.freeJobs = pr.freeJobs[:n-1]
+	return job
+}
+
+func (pr *ParallelReader) putJob(job *parallelJob) {
+	job.src = job.src[:0]
+	job.dst = job.dst[:0]
+	job.err = nil
+	job.done = nil
+	job.sequential = false
+	pr.freeJobs = append(pr.freeJobs, job)
+}
@@ -0,0 +1,496 @@
+package gozstd
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func TestParallelWriter(t *testing.T) {
+	data := []byte(newTestString(3*1024*1024+123, 3))
+	for _, chunkSize := range []int{0, 1000, 64 * 1024} {
+		for _, concurrency := range []int{0, 1, 3, 16} {
+			params := &ParallelWriterParams{
+				WriterParams: WriterParams{
+					CompressionLevel: 5,
+					EnableChecksum:   true,
+				},
+				ChunkSize:   chunkSize,
+				Concurrency: concurrency,
+			}
+			testParallelWriter(t, data, params)
+		}
+	}
+}
+
+func testParallelWriter(t *testing.T, data []byte, params *ParallelWriterParams) {
+	t.Helper()
+
+	var bb bytes.Buffer
+	pw := NewParallelWriter(&bb, params)
+
+	// Write the data in random chunks with occasional flushes.
+	src := data
+	for len(src) > 0 {
+		n := rand.Intn(256 * 1024)
+		if n > len(src) {
+			n = len(src)
+		}
+		if _, err := pw.Write(src[:n]); err != nil {
+			t.Fatalf("cannot write data: %s", err)
+		}
+		src = src[n:]
+		if rand.Intn(10) == 0 {
+			if err := pw.Flush(); err != nil {
+				t.Fatalf("cannot flush ParallelWriter: %s", err)
+			}
+		}
+	}
+	if err := pw.Close(); err != nil {
+		t.Fatalf("cannot close ParallelWriter: %s", err)
+	}
+	cd := bb.Bytes()
+
+	// Verify the frames.
+	chunkSize := params.ChunkSize
+	if chunkSize == 0 {
+		chunkSize = DefaultParallelChunkSize
+	}
+	for src := cd; len(src) > 0; {
+		n, err := FindFrameCompressedSize(src)
+		if err != nil {
+			t.Fatalf("cannot find frame size: %s", err)
+		}
+		contentSize, err := FrameContentSize(src)
+		if err != nil {
+			t.Fatalf("cannot obtain frame content size: %s", err)
+		}
+		if contentSize == 0 || contentSize > uint64(chunkSize) {
+			t.Fatalf("unexpected frame content size; got %d; want (0..%d]", contentSize, chunkSize)
+		}
+		src = src[n:]
+	}
+
+	plainData, err := Decompress(nil, cd)
+	if err != nil {
+		t.Fatalf("cannot decompress data: %s", err)
+	}
+	if !bytes.Equal(plainData, data) {
+		t.Fatalf("unexpected data decompressed; got %d bytes; want %d bytes", len(plainData), len(data))
+	}
+	zr := NewReader(bytes.NewReader(cd))
+	defer zr.Release()
+	plainData, err = ioutil.ReadAll(zr)
+	if err != nil {
+		t.Fatalf("cannot read data: %s", err)
+	}
+	if !bytes.Equal(plainData, data) {
+		t.Fatalf("unexpected data read; got %d bytes; want %d bytes", len(plainData), len(data))
+	}
+}
+
+func TestParallelWriterDict(t *testing.T) {
+	var samples [][]byte
+	for i := 0; i < 1000; i++ {
+		samples = append(samples, []byte(fmt.Sprintf("sample %d, %d", i, rand.Intn(1000))))
+	}
+	dict := BuildDict(samples, 8*1024)
+	cd, err := NewCDict(dict)
+	if err != nil {
+		t.Fatalf("cannot create CDict: %s", err)
+	}
+	defer cd.Release()
+	dd, err := NewDDict(dict)
+	if err != nil {
+		t.Fatalf("cannot create DDict: %s", err)
+	}
+	defer dd.Release()
+
+	data := bytes.Join(samples, []byte("\n"))
+	var bb bytes.Buffer
+	pw := NewParallelWriter(&bb, &ParallelWriterParams{
+		WriterParams: WriterParams{
+			Dict: cd,
+		},
+		ChunkSize: 100,
+	})
+	if _, err := pw.Write(data); err != nil {
+		t.Fatalf("cannot write data: %s", err)
+	}
+	if err := pw.Close(); err != nil {
+		t.Fatalf("cannot close ParallelWriter: %s", err)
+	}
+	if id := DictIDFromFrame(bb.Bytes()); id != cd.ID() {
+		t.Fatalf("unexpected dict id in frame; got %d; want %d", id, cd.ID())
+	}
+	plainData, err := DecompressDict(nil, bb.Bytes(), dd)
+	if err != nil {
+		t.Fatalf("cannot decompress data: %s", err)
+	}
+	if !bytes.Equal(plainData, data) {
+		t.Fatalf("unexpected data decompressed; got %d bytes; want %d bytes", len(plainData), len(data))
+	}
+}
+
+func TestParallelWriterInvalidParams(t *testing.T) {
+	for _, params := range []*ParallelWriterParams{
+		{ChunkSize: -1},
+		{Concurrency: -1},
+		{WriterParams: WriterParams{WindowLog: 100}},
+	} {
+		pw := NewParallelWriter(ioutil.Discard, params)
+		if _, err := pw.Write([]byte("foobar")); err == nil {
+			t.Fatalf("expecting non-nil error for params %+v", params)
+		}
+		if err := pw.Close(); err == nil {
+			t.Fatalf("expecting non-nil error on Close for params %+v", params)
+		}
+	}
+}
+
+func TestParallelWriterBadUnderlyingWriter(t *testing.T) {
+	pw := NewParallelWriter(&badWriter{}, &ParallelWriterParams{
+		ChunkSize: 100,
+	})
+	data := []byte(newTestString(10000, 3))
+	if _, err := pw.Write(data); err == nil {
+		if err := pw.Close(); err == nil {
+			t.Fatalf("expecting non-nil error when writing to bad underlying writer")
+		}
+	}
+	if _, err := pw.Write(data); err == nil {
+		t.Fatalf("expecting non-nil error on subsequent writes")
+	}
+}
+
+func TestParallelReader(t *testing.T) {
+	data := []byte(newTestString(3*1024*1024+123, 3))
+	var bb bytes.Buffer
+	pw := NewParallelWriter(&bb, &ParallelWriterParams{
+		ChunkSize: 64 * 1024,
+	})
+	if _, err := pw.Write(data); err != nil {
+		t.Fatalf("cannot write data: %s", err)
+	}
+	if err := pw.Close(); err != nil {
+		t.Fatalf("cannot close ParallelWriter: %s", err)
+	}
+	cd := bb.Bytes()
+
+	for _, concurrency := range []int{0, 1, 3, 16} {
+		for _, maxFrameSize := range []int{0, 1000, 100 * 1024} {
+			params := &ParallelReaderParams{
+				Concurrency:  concurrency,
+				MaxFrameSize: maxFrameSize,
+			}
+			testParallelReader(t, cd, data, params)
+		}
+	}
+
+	// Verify single-frame stream and empty stream.
+	testParallelReader(t, Compress(nil, data), data, nil)
+	testParallelReader(t, nil, nil, nil)
+}
+
+func TestParallelReaderMaxFrameContentSize(t *testing.T) {
+	var data []byte
+	var knownSize, unknownSize []byte
+	for _, n := range []int{10, 64 * 1024, 100, 200 * 1024, 0, 1000} {
+		chunk := []byte(newTestString(n, 3))
+		data = append(data, chunk...)
+		knownSize = CompressLevel(knownSize, chunk, 3)
+
+		// Writer doesn't store the content size in the frame header.
+		var bb bytes.Buffer
+		zw := NewWriter(&bb)
+		if _, err := zw.Write(chunk); err != nil {
+			t.Fatalf("cannot write data: %s", err)
+		}
+		if err := zw.Close(); err != nil {
+			t.Fatalf("cannot close Writer: %s", err)
+		}
+		zw.Release()
+		unknownSize = append(unknownSize, bb.Bytes()...)
+	}
+	fh, err := ParseFrameHeader(unknownSize)
+	if err != nil {
+		t.Fatalf("cannot parse frame header: %s", err)
+	}
+	if fh.ContentSize != ContentSizeUnknown {
+		t.Fatalf("unexpected content size; got %d; want %d", fh.ContentSize, ContentSizeUnknown)
+	}
+
+	for _, cd := range [][]byte{knownSize, unknownSize} {
+		for _, maxFrameContentSize := range []int{0, 1, 1000, 100 * 1024} {
+			params := &ParallelReaderParams{
+				Concurrency:         3,
+				MaxFrameContentSize: maxFrameContentSize,
+			}
+			testParallelReader(t, cd, data, params)
+		}
+
+		// MaxDecompressedSize must be respected by streamed frames.
+		for _, maxFrameContentSize := range []int{0, 1000} {
+			params := &ParallelReaderParams{
+				ReaderParams: ReaderParams{
+					MaxDecompressedSize: 100 * 1024,
+				},
+				MaxFrameContentSize: maxFrameContentSize,
+			}
+			pr := NewParallelReader(bytes.NewReader(cd), params)
+			_, err := ioutil.ReadAll(pr)
+			pr.Release()
+			if !errors.Is(err, ErrSizeLimitExceeded) {
+				t.Fatalf("unexpected error with params %+v; got %v; want %v", params, err, ErrSizeLimitExceeded)
+			}
+		}
+	}
+}
+
+func testParallelReader(t *testing.T, cd, data []byte, params *ParallelReaderParams) {
+	t.Helper()
+
+	pr := NewParallelReader(bytes.NewReader(cd), params)
+	plainData, err := ioutil.ReadAll(pr)
+	pr.Release()
+	if err != nil {
+		t.Fatalf("cannot read data with params %+v: %s", params, err)
+	}
+	if !bytes.Equal(plainData, data) {
+		t.Fatalf("unexpected data read with params %+v; got %d bytes; want %d bytes", params, len(plainData), len(data))
+	}
+
+	pr = NewParallelReader(bytes.NewReader(cd), params)
+	var bb bytes.Buffer
+	n, err := pr.WriteTo(&bb)
+	pr.Release()
+	if err != nil {
+		t.Fatalf("cannot write data with params %+v: %s", params, err)
+	}
+	if n != int64(len(data)) {
+		t.Fatalf("unexpected number of bytes written; got %d; want %d", n, len(data))
+	}
+	if !bytes.Equal(bb.Bytes(), data) {
+		t.Fatalf("unexpected data written with params %+v; got %d bytes; want %d bytes", params, bb.Len(), len(data))
+	}
+}
+
+func TestParallelReaderDict(t *testing.T) {
+	var samples [][]byte
+	for i := 0; i < 1000; i++ {
+		samples = append(samples, []byte(fmt.Sprintf("sample %d, %d", i, rand.Intn(1000))))
+	}
+	dict := BuildDict(samples, 8*1024)
+	cd, err := NewCDict(dict)
+	if err != nil {
+		t.Fatalf("cannot create CDict: %s", err)
+	}
+	defer cd.Release()
+	dd, err := NewDDict(dict)
+	if err != nil {
+		t.Fatalf("cannot create DDict: %s", err)
+	}
+	defer dd.Release()
+
+	data := bytes.Join(samples, []byte("\n"))
+	var bb bytes.Buffer
+	pw := NewParallelWriter(&bb, &ParallelWriterParams{
+		WriterParams: WriterParams{
+			Dict: cd,
+		},
+		ChunkSize: 100,
+	})
+	if _, err := pw.Write(data); err != nil {
+		t.Fatalf("cannot write data: %s", err)
+	}
+	if err := pw.Close(); err != nil {
+		t.Fatalf("cannot close ParallelWriter: %s", err)
+	}
+
+	testParallelReader(t, bb.Bytes(), data, &ParallelReaderParams{
+		ReaderParams: ReaderParams{
+			Dict: dd,
+		},
+	})
+}
+
+func TestParallelReaderSkippableFrames(t *testing.T) {
+	data := []byte(newTestString(300*1024, 3))
+	var bb bytes.Buffer
+	sw := NewSeekableWriter(&bb, &SeekableWriterParams{
+		FrameSize: 32 * 1024,
+	})
+	if _, err := sw.Write(data); err != nil {
+		t.Fatalf("cannot write data: %s", err)
+	}
+	if err := sw.Close(); err != nil {
+		t.Fatalf("cannot close SeekableWriter: %s", err)
+	}
+	testParallelReader(t, bb.Bytes(), data, nil)
+}
+
+func TestParallelReaderTruncatedStream(t *testing.T) {
+	data := []byte(newTestString(300*1024, 3))
+	var bb bytes.Buffer
+	pw := NewParallelWriter(&bb, &ParallelWriterParams{
+		ChunkSize: 32 * 1024,
+	})
+	if _, err := pw.Write(data); err != nil {
+		t.Fatalf("cannot write data: %s", err)
+	}
+	if err := pw.Close(); err != nil {
+		t.Fatalf("cannot close ParallelWriter: %s", err)
+	}
+	cd := bb.Bytes()
+
+	step := len(cd)/100 + 1
+	for n := 1; n < len(cd); n += step {
+		truncated := cd[:n]
+		if _, err := FindFrameCompressedSize(truncated); err == nil {
+			// Skip truncation at the frame boundary.
+			continue
+		}
+
+		pr := NewParallelReader(bytes.NewReader(truncated), nil)
+		if _, err := ioutil.ReadAll(pr); err != io.ErrUnexpectedEOF {
+			t.Fatalf("unexpected error in Read for %d out of %d bytes; got %v; want %v", n, len(cd), err, io.ErrUnexpectedEOF)
+		}
+		pr.Release()
+
+		pr = NewParallelReader(bytes.NewReader(truncated), &ParallelReaderParams{
+			MaxFrameSize: 100,
+		})
+		if _, err := pr.WriteTo(ioutil.Discard); err != io.ErrUnexpectedEOF {
+			t.Fatalf("unexpected error in WriteTo for %d out of %d bytes; got %v; want %v", n, len(cd), err, io.ErrUnexpectedEOF)
+		}
+		pr.Release()
+	}
+}
+
+func TestParallelReaderInvalidData(t *testing.T) {
+	cd := Compress(nil, []byte(newTestString(64*1024, 15)))
+	cd = append(cd, "invalid compressed data"...)
+
+	pr := NewParallelReader(bytes.NewReader(cd), nil)
+	defer pr.Release()
+	plainData, err := ioutil.ReadAll(pr)
+	if err == nil {
+		t.Fatalf("expecting error when decompressing invalid data")
+	}
+	if len(plainData) != 64*1024 {
+		t.Fatalf("unexpected number of bytes decompressed before the invalid data; got %d; want %d", len(plainData), 64*1024)
+	}
+	if _, err := pr.Read(make([]byte, 10)); err == nil {
+		t.Fatalf("expecting non-nil error on subsequent reads")
+	}
+}
+
+func TestParallelReaderBadUnderlyingReader(t *testing.T) {
+	r := &badReader{
+		b: Compress(nil, []byte(newTestString(64*1024, 30))),
+	}
+	pr := NewParallelReader(r, nil)
+	defer pr.Release()
+
+	if _, err := ioutil.ReadAll(pr); err == nil || !strings.Contains(err.Error(), "badReader failed") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestParallelReaderInvalidParams(t *testing.T) {
+	cd := Compress(nil, []byte("foobar"))
+	for _, params := range []*ParallelReaderParams{
+		{Concurrency: -1},
+		{MaxFrameSize: -1},
+		{MaxFrameContentSize: -1},
+		{ReaderParams: ReaderParams{Format: FormatZstd1Magicless}},
+		{ReaderParams: ReaderParams{SkippableFrameHandler: func(magic uint32, data []byte) error { return nil }}},
+	} {
+		pr := NewParallelReader(bytes.NewReader(cd), params)
+		if _, err := ioutil.ReadAll(pr); err == nil {
+			t.Fatalf("expecting non-nil error for params %+v", params)
+		}
+		pr.Release()
+	}
+}
+
+func TestParallelReaderPzstdReferenceData(t *testing.T) {
+	// The data has been created by zstd/contrib/pzstd from "pzstd reference data\n" repeated 3 times.
+	cd := mustUnhex("502a4d18040000002800000028b52ffd0458dd0000a8707a737464207265666572656e636520646174610a01002334999771bf2f")
+	data := []byte(strings.Repeat("pzstd reference data\n", 3))
+	if n := pzstdFrameSize(cd[:pzstdFrameHeaderSize]); n != len(cd)-pzstdFrameHeaderSize {
+		t.Fatalf("unexpected pzstd frame size; got %d; want %d", n, len(cd)-pzstdFrameHeaderSize)
+	}
+	testParallelReader(t, cd, data, nil)
+
+	// Concatenated pzstd streams are valid pzstd stream.
+	testParallelReader(t, append(append([]byte{}, cd...), cd...), append(append([]byte{}, data...), data...), nil)
+}
+
+func TestParallelWriterPzstd(t *testing.T) {
+	data := []byte(newTestString(1024*1024+123, 3))
+	var bb bytes.Buffer
+	pw := NewParallelWriter(&bb, &ParallelWriterParams{
+		ChunkSize:         64 * 1024,
+		EnablePzstdFormat: true,
+	})
+	if _, err := pw.Write(data); err != nil {
+		t.Fatalf("cannot write data: %s", err)
+	}
+	if err := pw.Close(); err != nil {
+		t.Fatalf("cannot close ParallelWriter: %s", err)
+	}
+	cd := bb.Bytes()
+
+	// Verify every frame is preceded by pzstd skippable frame with the frame size.
+	frames := 0
+	for src := cd; len(src) > 0; {
+		n, err := FindFrameCompressedSize(src)
+		if err != nil {
+			t.Fatalf("cannot find skippable frame size: %s", err)
+		}
+		frameSize := pzstdFrameSize(src[:n])
+		if frameSize == 0 {
+			t.Fatalf("missing pzstd skippable frame before frame #%d", frames)
+		}
+		src = src[n:]
+		n, err = FindFrameCompressedSize(src)
+		if err != nil {
+			t.Fatalf("cannot find frame size: %s", err)
+		}
+		if n != frameSize {
+			t.Fatalf("unexpected frame size in pzstd skippable frame; got %d; want %d", frameSize, n)
+		}
+		src = src[n:]
+		frames++
+	}
+	if frames != 17 {
+		t.Fatalf("unexpected number of frames; got %d; want %d", frames, 17)
+	}
+
+	plainData, err := Decompress(nil, cd)
+	if err != nil {
+		t.Fatalf("cannot decompress data: %s", err)
+	}
+	if !bytes.Equal(plainData, data) {
+		t.Fatalf("unexpected data decompressed; got %d bytes; want %d bytes", len(plainData), len(data))
+	}
+	for _, maxFrameSize := range []int{0, 1000} {
+		testParallelReader(t, cd, data, &ParallelReaderParams{
+			MaxFrameSize: maxFrameSize,
+		})
+	}
+
+	// Verify truncated data.
+	truncated := cd[:len(cd)-1]
+	pr := NewParallelReader(bytes.NewReader(truncated), nil)
+	defer pr.Release()
+	if _, err := ioutil.ReadAll(pr); err != io.ErrUnexpectedEOF {
+		t.Fatalf("unexpected error for truncated data; got %v; want %v", err, io.ErrUnexpectedEOF)
+	}
+}
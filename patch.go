@@ -0,0 +1,304 @@
+package gozstd
+
+/*
+#define ZSTD_STATIC_LINKING_ONLY
+#include "zstd.h"
+
+// patchNeedsLDM returns non-zero if long distance matching must be enabled
+// for the patch, since the regular match finder cannot cover the window.
+// This is the same logic as in zstd --patch-from.
+static int patchNeedsLDM(int compressionLevel, unsigned long long srcSize, size_t oldSize, int windowLog) {
+    ZSTD_compressionParameters cParams = ZSTD_getCParams(compressionLevel, srcSize, oldSize);
+    unsigned cycleLog = cParams.chainLog - (cParams.strategy >= ZSTD_btlazy2 ? 1 : 0);
+    return (unsigned)windowLog > cycleLog;
+}
+*/
+import "C"
+
+import (
+	"fmt"
+	"io"
+	"math/bits"
+	"strconv"
+)
+
+// CreatePatch appends the patch for transforming oldData into newData to dst
+// and returns the result.
+//
+// The patch is zstd frame containing newData compressed with oldData used
+// as raw-content dictionary and with the window covering oldData.
+// This is the same as zstd --patch-from does. The patch is compact
+// if newData shares a lot of data with oldData.
+//
+// Use ApplyPatch for restoring newData from oldData and the patch.
+func CreatePatch(dst, oldData, newData []byte) ([]byte, error) {
+	return CreatePatchLevel(dst, oldData, newData, DefaultCompressionLevel)
+}
+
+// CreatePatchLevel appends the patch for transforming oldData into newData to dst
+// and returns the result.
+//
+// The given compressionLevel is used for the compression.
+// oldData is copied into DictBuffer on every call. Use CreatePatchDict
+// for creating multiple patches from the same old data.
+// See CreatePatch for details.
+func CreatePatchLevel(dst, oldData, newData []byte, compressionLevel int) ([]byte, error) {
+	db, err := newPatchDictBuffer(oldData)
+	if err != nil {
+		return dst, err
+	}
+	dst, err = createPatch(dst, db, newData, compressionLevel)
+	if db != nil {
+		db.Release()
+	}
+	return dst, err
+}
+
+// CreatePatchDict appends the patch for transforming the old data from db
+// into newData to dst and returns the result.
+//
+// The given compressionLevel is used for the compression.
+// db may be shared among multiple patches. See CreatePatch for details.
+func CreatePatchDict(dst []byte, db *DictBuffer, newData []byte, compressionLevel int) ([]byte, error) {
+	if db == nil {
+		return dst, fmt.Errorf("db cannot be nil")
+	}
+	return createPatch(dst, db, newData, compressionLevel)
+}
+
+func createPatch(dst []byte, db *DictBuffer, newData []byte, compressionLevel int) ([]byte, error) {
+	params, err := newPatchWriterParams(db, len(newData), compressionLevel)
+	if err != nil {
+		return dst, err
+	}
+	// Use a dedicated context, since contexts with big windows
+	// occupy a lot of memory, so they shouldn't be pooled.
+	c := NewCompressor()
+	err = c.SetParams(params)
+	if err == nil {
+		dst, err = c.Compress(dst, newData)
+	}
+	c.Release()
+	if params.Dict != nil {
+		params.Dict.Release()
+	}
+	if err != nil {
+		return dst, fmt.Errorf("cannot create patch with WindowLog=%d: %w", params.WindowLog, err)
+	}
+	return dst, nil
+}
+
+// ApplyPatch appends newData restored from oldData and the patch to dst
+// and returns the result.
+//
+// The patch must be created by CreatePatch* or NewPatchWriter from the same oldData.
+// oldData is copied into DictBuffer on every call. Use ApplyPatchDict
+// for applying multiple patches to the same old data.
+//
+// The window size required for the patch is limited by PatchWindowLog
+// for the sizes of oldData and newData. Use NewPatchReader
+// for applying patches without the content size.
+func ApplyPatch(dst, oldData, patch []byte) ([]byte, error) {
+	db, err := newPatchDictBuffer(oldData)
+	if err != nil {
+		return dst, err
+	}
+	dst, err = applyPatch(dst, db, patch)
+	if db != nil {
+		db.Release()
+	}
+	return dst, err
+}
+
+// ApplyPatchDict appends the new data restored from the old data in db
+// and the patch to dst and returns the result.
+//
+// db may be shared among multiple patches. See ApplyPatch for details.
+func ApplyPatchDict(dst []byte, db *DictBuffer, patch []byte) ([]byte, error) {
+	if db == nil {
+		return dst, fmt.Errorf("db cannot be nil")
+	}
+	return applyPatch(dst, db, patch)
+}
+
+func applyPatch(dst []byte, db *DictBuffer, patch []byte) ([]byte, error) {
+	newSize := 0
+	if fh, err := ParseFrameHeader(patch); err == nil && !fh.Skippable && fh.ContentSize != ContentSizeUnknown {
+		newSize = int(fh.ContentSize)
+	}
+	params, err := newPatchReaderParams(db, newSize)
+	if err != nil {
+		return dst, err
+	}
+	// Use a dedicated context for the same reason as in createPatch.
+	d := NewDecompressor()
+	err = d.SetParams(params)
+	if err == nil {
+		dst, err = d.Decompress(dst, patch)
+	}
+	d.Release()
+	if params.Dict != nil {
+		params.Dict.Release()
+	}
+	if err != nil {
+		return dst, fmt.Errorf("cannot apply patch: %w", err)
+	}
+	return dst, nil
+}
+
+// newPatchDictBuffer returns DictBuffer with a copy of oldData.
+//
+// nil is returned for empty oldData, since there is nothing to reference.
+func newPatchDictBuffer(oldData []byte) (*DictBuffer, error) {
+	if len(oldData) == 0 {
+		return nil, nil
+	}
+	db, err := NewDictBuffer(oldData)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create DictBuffer for the old data: %w", err)
+	}
+	return db, nil
+}
+
+// NewPatchWriter returns new Writer writing the patch for transforming
+// the old data from db into the new data written to the Writer.
+//
+// This is a streaming counterpart to CreatePatchDict for big new data.
+// The old data is used as raw-content dictionary loaded by reference,
+// so db may be shared among multiple writers and readers.
+// newSize is the expected size of the new data. It is used for sizing
+// the window, so the patch may reference any part of the old data.
+// The patch doesn't contain the new data size, so it must be applied
+// with NewPatchReader.
+//
+// The returned writer must be closed with Close call in order
+// to finalize the patch. Call Release when the Writer is no longer needed.
+func NewPatchWriter(w io.Writer, db *DictBuffer, newSize, compressionLevel int) (*Writer, error) {
+	if db == nil {
+		return nil, fmt.Errorf("db cannot be nil")
+	}
+	params, err := newPatchWriterParams(db, newSize, compressionLevel)
+	if err != nil {
+		return nil, err
+	}
+	zw, err := TryNewWriterParams(w, params)
+	if err != nil {
+		params.Dict.Release()
+		return nil, fmt.Errorf("cannot create patch writer with WindowLog=%d: %w", params.WindowLog, err)
+	}
+	zw.patchDict = params.Dict
+	return zw, nil
+}
+
+// NewPatchReader returns new Reader reading the new data restored
+// from the old data in db and the patch read from r.
+//
+// The patch must be created by NewPatchWriter or CreatePatch* from the same
+// old data. newSize must be at least the new data size. It limits the window
+// size accepted by the Reader in the same way as ApplyPatch does.
+//
+// Call Release when the Reader is no longer needed.
+func NewPatchReader(r io.Reader, db *DictBuffer, newSize int) (*Reader, error) {
+	if db == nil {
+		return nil, fmt.Errorf("db cannot be nil")
+	}
+	params, err := newPatchReaderParams(db, newSize)
+	if err != nil {
+		return nil, err
+	}
+	zr := NewReaderParams(r, params)
+	if zr.err != nil {
+		err := zr.err
+		zr.Release()
+		params.Dict.Release()
+		return nil, fmt.Errorf("cannot create patch reader with WindowLogMax=%d: %w", params.WindowLogMax, err)
+	}
+	zr.patchDict = params.Dict
+	return zr, nil
+}
+
+// newPatchWriterParams returns the params for creating the patch for transforming
+// the old data from db into the new data with the given newSize.
+//
+// db may be nil for empty old data. params.Dict must be released
+// when it is no longer needed.
+func newPatchWriterParams(db *DictBuffer, newSize, compressionLevel int) (*WriterParams, error) {
+	oldSize := 0
+	if db != nil {
+		oldSize = db.Len()
+	}
+	windowLog := PatchWindowLog(oldSize, newSize)
+	params := &WriterParams{
+		CompressionLevel: compressionLevel,
+		WindowLog:        windowLog,
+		SrcSizeHint:      newSize,
+	}
+	if C.patchNeedsLDM(C.int(compressionLevel), C.ulonglong(newSize), C.size_t(oldSize), C.int(windowLog)) != 0 {
+		params.LongDistanceMatching = ParamSwitchEnable
+	}
+	if db == nil {
+		return params, nil
+	}
+	cd, err := NewCDictByRef(db, compressionLevel, DictContentRaw)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create CDict for the old data: %w", err)
+	}
+	params.Dict = cd
+	// Index the whole old data with the writer parameters
+	// including long distance matching.
+	params.DictAttachPref = DictAttachForceLoad
+	return params, nil
+}
+
+// newPatchReaderParams returns the params for applying the patch to the old data
+// from db. newSize must be at least the new data size.
+//
+// db may be nil for empty old data. params.Dict must be released
+// when it is no longer needed.
+func newPatchReaderParams(db *DictBuffer, newSize int) (*ReaderParams, error) {
+	oldSize := 0
+	if db != nil {
+		oldSize = db.Len()
+	}
+	windowLogMax := PatchWindowLog(oldSize, newSize)
+	if windowLogMax < DefaultWindowLogMax {
+		windowLogMax = DefaultWindowLogMax
+	}
+	params := &ReaderParams{
+		WindowLogMax: windowLogMax,
+	}
+	if db == nil {
+		return params, nil
+	}
+	dd, err := NewDDictByRef(db, DictContentRaw)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create DDict for the old data: %w", err)
+	}
+	params.Dict = dd
+	return params, nil
+}
+
+// PatchWindowLog returns the windowLog required for creating and applying
+// patches between data with the given sizes.
+//
+// The result may be passed to ReaderParams.WindowLogMax when applying
+// patches with Reader. It is clamped to the range supported by zstd
+// on the current architecture.
+func PatchWindowLog(oldSize, newSize int) int {
+	n := oldSize
+	if newSize > n {
+		n = newSize
+	}
+	windowLog := bits.Len(uint(n))
+	if windowLog < WindowLogMin {
+		windowLog = WindowLogMin
+	}
+	windowLogMax := WindowLogMax32
+	if strconv.IntSize == 64 {
+		windowLogMax = WindowLogMax64
+	}
+	if windowLog > windowLogMax {
+		windowLog = windowLogMax
+	}
+	return windowLog
+}
@@ -0,0 +1,284 @@
+package gozstd
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+)
+
+func TestPatch(t *testing.T) {
+	oldData := newTestDocument(4 * 1024 * 1024)
+
+	// Create newData by inserting and modifying chunks in oldData.
+	var newData []byte
+	for off := 0; off < len(oldData); off += 64 * 1024 {
+		chunk := oldData[off:]
+		if len(chunk) > 64*1024 {
+			chunk = chunk[:64*1024]
+		}
+		newData = append(newData, chunk...)
+		newData = append(newData, newTestDocument(100)...)
+	}
+	newData[rand.Intn(len(newData))]++
+
+	for _, level := range []int{1, 3, 10} {
+		patch, err := CreatePatchLevel([]byte("prefix"), oldData, newData, level)
+		if err != nil {
+			t.Fatalf("cannot create patch at level %d: %s", level, err)
+		}
+		if string(patch[:len("prefix")]) != "prefix" {
+			t.Fatalf("unexpected patch prefix; got %q; want %q", patch[:len("prefix")], "prefix")
+		}
+		patch = patch[len("prefix"):]
+		if len(patch) > len(newData)/100 {
+			t.Fatalf("too big patch at level %d; got %d bytes; want up to %d bytes", level, len(patch), len(newData)/100)
+		}
+		fh, err := ParseFrameHeader(patch)
+		if err != nil {
+			t.Fatalf("cannot parse patch header: %s", err)
+		}
+		if fh.WindowSize < uint64(len(oldData)) {
+			t.Fatalf("too small patch window; got %d; want at least %d", fh.WindowSize, len(oldData))
+		}
+
+		data, err := ApplyPatch(nil, oldData, patch)
+		if err != nil {
+			t.Fatalf("cannot apply patch at level %d: %s", level, err)
+		}
+		if !bytes.Equal(data, newData) {
+			t.Fatalf("unexpected data restored from patch at level %d; got %d bytes; want %d bytes", level, len(data), len(newData))
+		}
+
+		// The patch must be applicable with Reader.
+		zr := NewReaderParams(bytes.NewReader(patch), &ReaderParams{
+			WindowLogMax: PatchWindowLog(len(oldData), len(newData)),
+		})
+		if err := zr.SetPrefix(oldData); err != nil {
+			t.Fatalf("cannot set prefix: %s", err)
+		}
+		data, err = ioutil.ReadAll(zr)
+		zr.Release()
+		if err != nil {
+			t.Fatalf("cannot read patched data: %s", err)
+		}
+		if !bytes.Equal(data, newData) {
+			t.Fatalf("unexpected data read from patch at level %d; got %d bytes; want %d bytes", level, len(data), len(newData))
+		}
+	}
+}
+
+func TestPatchWriterReader(t *testing.T) {
+	oldData := newTestDocument(4 * 1024 * 1024)
+
+	// Create newData by inserting and modifying chunks in oldData.
+	var newData []byte
+	for off := 0; off < len(oldData); off += 64 * 1024 {
+		chunk := oldData[off:]
+		if len(chunk) > 64*1024 {
+			chunk = chunk[:64*1024]
+		}
+		newData = append(newData, chunk...)
+		newData = append(newData, newTestDocument(100)...)
+	}
+	newData[rand.Intn(len(newData))]++
+
+	db, err := NewDictBuffer(oldData)
+	if err != nil {
+		t.Fatalf("cannot create DictBuffer: %s", err)
+	}
+	defer db.Release()
+
+	for _, level := range []int{1, 3, 10} {
+		var bb bytes.Buffer
+		zw, err := NewPatchWriter(&bb, db, len(newData), level)
+		if err != nil {
+			t.Fatalf("cannot create patch writer at level %d: %s", level, err)
+		}
+		if _, err := zw.ReadFrom(bytes.NewReader(newData)); err != nil {
+			t.Fatalf("cannot write new data at level %d: %s", level, err)
+		}
+		if err := zw.Close(); err != nil {
+			t.Fatalf("cannot close patch writer at level %d: %s", level, err)
+		}
+		zw.Release()
+		patch := bb.Bytes()
+		if len(patch) > len(newData)/100 {
+			t.Fatalf("too big patch at level %d; got %d bytes; want up to %d bytes", level, len(patch), len(newData)/100)
+		}
+
+		zr, err := NewPatchReader(bytes.NewReader(patch), db, len(newData))
+		if err != nil {
+			t.Fatalf("cannot create patch reader: %s", err)
+		}
+		data, err := ioutil.ReadAll(zr)
+		zr.Release()
+		if err != nil {
+			t.Fatalf("cannot read patched data at level %d: %s", level, err)
+		}
+		if !bytes.Equal(data, newData) {
+			t.Fatalf("unexpected data read from patch at level %d; got %d bytes; want %d bytes", level, len(data), len(newData))
+		}
+
+		// The patch must be applicable with ApplyPatch.
+		data, err = ApplyPatch(nil, oldData, patch)
+		if err != nil {
+			t.Fatalf("cannot apply patch at level %d: %s", level, err)
+		}
+		if !bytes.Equal(data, newData) {
+			t.Fatalf("unexpected data restored from patch at level %d; got %d bytes; want %d bytes", level, len(data), len(newData))
+		}
+	}
+
+	// NewPatchReader must read patches created by CreatePatch.
+	patch, err := CreatePatch(nil, oldData, newData)
+	if err != nil {
+		t.Fatalf("cannot create patch: %s", err)
+	}
+	zr, err := NewPatchReader(bytes.NewReader(patch), db, len(newData))
+	if err != nil {
+		t.Fatalf("cannot create patch reader: %s", err)
+	}
+	defer zr.Release()
+	data, err := ioutil.ReadAll(zr)
+	if err != nil {
+		t.Fatalf("cannot read patched data: %s", err)
+	}
+	if !bytes.Equal(data, newData) {
+		t.Fatalf("unexpected data read from patch; got %d bytes; want %d bytes", len(data), len(newData))
+	}
+}
+
+func TestPatchWriterReaderReleasedDictBuffer(t *testing.T) {
+	db, err := NewDictBuffer([]byte("old data"))
+	if err != nil {
+		t.Fatalf("cannot create DictBuffer: %s", err)
+	}
+	var bb bytes.Buffer
+	zw, err := NewPatchWriter(&bb, db, 0, DefaultCompressionLevel)
+	if err != nil {
+		t.Fatalf("cannot create patch writer: %s", err)
+	}
+	defer zw.Release()
+
+	// The writer must remain usable after db release.
+	db.Release()
+	if _, err := zw.Write([]byte("new data")); err != nil {
+		t.Fatalf("cannot write new data: %s", err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("cannot close patch writer: %s", err)
+	}
+	data, err := ApplyPatch(nil, []byte("old data"), bb.Bytes())
+	if err != nil {
+		t.Fatalf("cannot apply patch: %s", err)
+	}
+	if string(data) != "new data" {
+		t.Fatalf("unexpected data restored from patch; got %q; want %q", data, "new data")
+	}
+
+	if _, err := NewPatchWriter(&bb, db, 0, DefaultCompressionLevel); !errors.Is(err, errReleasedDictBuffer) {
+		t.Fatalf("unexpected error; got %v; want %v", err, errReleasedDictBuffer)
+	}
+	if _, err := NewPatchReader(&bb, db, 0); !errors.Is(err, errReleasedDictBuffer) {
+		t.Fatalf("unexpected error; got %v; want %v", err, errReleasedDictBuffer)
+	}
+}
+
+func TestPatchDict(t *testing.T) {
+	oldData := newTestDocument(256 * 1024)
+	db, err := NewDictBuffer(oldData)
+	if err != nil {
+		t.Fatalf("cannot create DictBuffer: %s", err)
+	}
+	defer db.Release()
+
+	for i := 0; i < 3; i++ {
+		newData := append(append([]byte{}, oldData[i*1000:]...), newTestDocument(100)...)
+		patch, err := CreatePatchDict(nil, db, newData, DefaultCompressionLevel)
+		if err != nil {
+			t.Fatalf("cannot create patch: %s", err)
+		}
+		data, err := ApplyPatchDict(nil, db, patch)
+		if err != nil {
+			t.Fatalf("cannot apply patch: %s", err)
+		}
+		if !bytes.Equal(data, newData) {
+			t.Fatalf("unexpected data restored from patch; got %d bytes; want %d bytes", len(data), len(newData))
+		}
+
+		// The patch must be compatible with ApplyPatch.
+		data, err = ApplyPatch(nil, oldData, patch)
+		if err != nil {
+			t.Fatalf("cannot apply patch: %s", err)
+		}
+		if !bytes.Equal(data, newData) {
+			t.Fatalf("unexpected data restored from patch; got %d bytes; want %d bytes", len(data), len(newData))
+		}
+	}
+
+	if _, err := CreatePatchDict(nil, nil, []byte("foo"), DefaultCompressionLevel); err == nil {
+		t.Fatalf("expecting non-nil error for nil DictBuffer")
+	}
+	if _, err := ApplyPatchDict(nil, nil, []byte("foo")); err == nil {
+		t.Fatalf("expecting non-nil error for nil DictBuffer")
+	}
+}
+
+func TestPatchEmpty(t *testing.T) {
+	for _, tc := range []struct {
+		oldData []byte
+		newData []byte
+	}{
+		{nil, nil},
+		{nil, []byte("foobar")},
+		{[]byte("foobar"), nil},
+		{[]byte("foobar"), []byte("foobar")},
+	} {
+		patch, err := CreatePatch(nil, tc.oldData, tc.newData)
+		if err != nil {
+			t.Fatalf("cannot create patch for old=%q, new=%q: %s", tc.oldData, tc.newData, err)
+		}
+		data, err := ApplyPatch(nil, tc.oldData, patch)
+		if err != nil {
+			t.Fatalf("cannot apply patch for old=%q, new=%q: %s", tc.oldData, tc.newData, err)
+		}
+		if !bytes.Equal(data, tc.newData) {
+			t.Fatalf("unexpected data restored from patch; got %q; want %q", data, tc.newData)
+		}
+	}
+}
+
+func TestApplyPatchInvalid(t *testing.T) {
+	oldData := newTestDocument(64 * 1024)
+	newData := append(append([]byte{}, oldData[1000:]...), "foobar"...)
+	patch, err := CreatePatch(nil, oldData, newData)
+	if err != nil {
+		t.Fatalf("cannot create patch: %s", err)
+	}
+	if data, err := ApplyPatch(nil, newTestDocument(64*1024), patch); err == nil && bytes.Equal(data, newData) {
+		t.Fatalf("expecting failure when applying patch to distinct data")
+	}
+	if _, err := ApplyPatch(nil, oldData, patch[:len(patch)-1]); err == nil {
+		t.Fatalf("expecting non-nil error for truncated patch")
+	}
+	if _, err := ApplyPatch(nil, oldData, []byte("invalid patch")); err == nil {
+		t.Fatalf("expecting non-nil error for invalid patch")
+	}
+}
+
+func TestPatchWindowLog(t *testing.T) {
+	f := func(oldSize, newSize, windowLogExpected int) {
+		t.Helper()
+		windowLog := PatchWindowLog(oldSize, newSize)
+		if windowLog != windowLogExpected {
+			t.Fatalf("unexpected windowLog for oldSize=%d, newSize=%d; got %d; want %d", oldSize, newSize, windowLog, windowLogExpected)
+		}
+	}
+	f(0, 0, WindowLogMin)
+	f(1000, 10, WindowLogMin)
+	f(1<<20, 10, 21)
+	f(10, 1<<20-1, 20)
+	f(100<<20, 200<<20, 28)
+}
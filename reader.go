@@ -14,15 +14,41 @@ package gozstd
 // durting calls from Go.
 // See https://github.com/golang/go/issues/24450 .
 
-static size_t ZSTD_initDStream_usingDDict_wrapper(uintptr_t ds, uintptr_t dict) {
+static size_t ZSTD_initDStream_usingDDict_wrapper(uintptr_t ds, uintptr_t dict, int windowLogMax, int format) {
     ZSTD_DStream *zds = (ZSTD_DStream *)ds;
-    size_t rv = ZSTD_DCtx_reset(zds, ZSTD_reset_session_only);
-    if (rv != 0) {
+    size_t rv = ZSTD_DCtx_reset(zds, ZSTD_reset_session_and_parameters);
+    if (ZSTD_isError(rv)) {
+        return rv;
+    }
+    rv = ZSTD_DCtx_setParameter(zds, ZSTD_d_windowLogMax, windowLogMax);
+    if (ZSTD_isError(rv)) {
+        return rv;
+    }
+    rv = ZSTD_DCtx_setParameter(zds, ZSTD_d_format, format);
+    if (ZSTD_isError(rv)) {
         return rv;
     }
     return ZSTD_DCtx_refDDict(zds, (ZSTD_DDict *)dict);
 }
 
+static size_t ZSTD_DCtx_refFrameDDict_wrapper(uintptr_t ds, uintptr_t dict) {
+    // The previous frame is complete, so reset the session
+    // in order to allow changing the dictionary.
+    size_t rv = ZSTD_DCtx_reset((ZSTD_DStream *)ds, ZSTD_reset_session_only);
+    if (ZSTD_isError(rv)) {
+        return rv;
+    }
+    return ZSTD_DCtx_refDDict((ZSTD_DStream *)ds, (ZSTD_DDict *)dict);
+}
+
+static size_t ZSTD_DCtx_refPrefix_wrapper(uintptr_t ds, uintptr_t prefix, size_t prefixSize) {
+    return ZSTD_DCtx_refPrefix((ZSTD_DStream *)ds, (const void*)prefix, prefixSize);
+}
+
+static size_t ZSTD_frameHeaderSize_wrapper(uintptr_t src, size_t srcSize) {
+    return ZSTD_frameHeaderSize((const void*)src, srcSize);
+}
+
 static size_t ZSTD_freeDStream_wrapper(uintptr_t ds) {
     return ZSTD_freeDStream((ZSTD_DStream*)ds);
 }
@@ -34,6 +60,8 @@ static size_t ZSTD_decompressStream_wrapper(uintptr_t ds, uintptr_t output, uint
 import "C"
 
 import (
+	"bytes"
+	"encoding/binary"
 	"fmt"
 	"io"
 	"runtime"
@@ -47,15 +75,40 @@ var (
 
 // Reader implements zstd reader.
 type Reader struct {
-	r  io.Reader
-	ds *C.ZSTD_DStream
-	dd *DDict
+	r      io.Reader
+	ds     *C.ZSTD_DStream
+	params ReaderParams
+	err    error
+
+	// decompressedSize is the number of bytes decompressed since the last reset.
+	decompressedSize int
+
+	// inFrame is set when the last ZSTD_decompressStream call
+	// didn't complete the current frame.
+	inFrame bool
+
+	// skippablePayload is a buffer for skippable frame payload
+	// passed to params.SkippableFrameHandler.
+	skippablePayload []byte
+
+	// frameDict is the dictionary referenced by ds when params.Dicts is set.
+	frameDict *DDict
+
+	// prefix is the prefix set via SetPrefix.
+	prefix prefixBuf
 
 	inBuf  *C.ZSTD_inBuffer
 	outBuf *C.ZSTD_outBuffer
 
 	inBufGo  cMemPtr
 	outBufGo cMemPtr
+
+	// memSize is the size of zr accounted in Stats.
+	memSize int
+
+	// patchDict is the dictionary created by NewPatchReader.
+	// It is released together with zr.
+	patchDict *DDict
 }
 
 // NewReader returns new zstd reader reading compressed data from r.
@@ -70,8 +123,82 @@ func NewReader(r io.Reader) *Reader {
 //
 // Call Release when the Reader is no longer needed.
 func NewReaderDict(r io.Reader, dd *DDict) *Reader {
+	params := &ReaderParams{
+		Dict: dd,
+	}
+	return NewReaderParams(r, params)
+}
+
+const (
+	// DefaultWindowLogMax is the default value of the windowLogMax parameter.
+	//
+	// Frames requiring bigger window are rejected by Reader unless
+	// ReaderParams.WindowLogMax is increased.
+	DefaultWindowLogMax = 27 // from zstd.h
+)
+
+// A ReaderParams allows users to specify decompression parameters by calling
+// NewReaderParams.
+//
+// Calling NewReaderParams with a nil ReaderParams is equivalent to calling
+// NewReader.
+type ReaderParams struct {
+	// WindowLogMax is the maximum windowLog accepted by the decompressor.
+	// Must be clamped between WindowLogMin and WindowLogMax32/64.
+	// Special value 0 means 'use DefaultWindowLogMax'.
+	//
+	// Frames compressed with WriterParams.WindowLog greater than
+	// DefaultWindowLogMax can be decompressed only if WindowLogMax
+	// is set to at least the same value. Note that bigger windows
+	// increase memory usage of the decompressor.
+	WindowLogMax int
+
+	// MaxDecompressedSize limits the number of bytes the Reader may produce.
+	// Reading fails with ErrSizeLimitExceeded as soon as the decompressed
+	// data exceeds the limit. This protects from decompression bombs
+	// when reading untrusted data.
+	// Special value 0 means 'no limit'.
+	MaxDecompressedSize int
+
+	// Dict is optional dictionary used for decompression.
+	Dict *DDict
+
+	// Dicts is optional registry of dictionaries used for decompression.
+	//
+	// The dictionary for every frame is selected by the dictionary id
+	// from the frame header. MissingDictError is returned if Dicts
+	// doesn't contain the needed dictionary. Dict is used for frames
+	// without dictionary id.
+	//
+	// Dicts is supported only in FormatZstd1.
+	Dicts *DictRegistry
+
+	// Format is the expected format of frames.
+	// It must match WriterParams.Format used for the compression.
+	Format Format
+
+	// SkippableFrameHandler is called for every skippable frame
+	// found in the stream. Skippable frames are silently ignored
+	// if SkippableFrameHandler isn't set.
+	//
+	// The payload is valid only during the call. The error returned
+	// by SkippableFrameHandler is returned by Read and WriteTo.
+	//
+	// Skippable frames aren't supported in FormatZstd1Magicless.
+	SkippableFrameHandler func(magicVariant uint32, payload []byte) error
+}
+
+// NewReaderParams returns new zstd reader reading compressed data from r
+// using the given set of parameters.
+//
+// Call Release when the Reader is no longer needed.
+func NewReaderParams(r io.Reader, params *ReaderParams) *Reader {
+	if params == nil {
+		params = &ReaderParams{}
+	}
+
 	ds := C.ZSTD_createDStream()
-	initDStream(ds, dd)
+	err := initDStream(ds, *params)
 
 	inBuf := (*C.ZSTD_inBuffer)(C.calloc(1, C.sizeof_ZSTD_inBuffer))
 	inBuf.src = C.calloc(1, dstreamInBufSize)
@@ -86,7 +213,8 @@ func NewReaderDict(r io.Reader, dd *DDict) *Reader {
 	zr := &Reader{
 		r:      r,
 		ds:     ds,
-		dd:     dd,
+		params: *params,
+		err:    err,
 		inBuf:  inBuf,
 		outBuf: outBuf,
 	}
@@ -94,32 +222,61 @@ func NewReaderDict(r io.Reader, dd *DDict) *Reader {
 	zr.inBufGo = cMemPtr(zr.inBuf.src)
 	zr.outBufGo = cMemPtr(zr.outBuf.dst)
 
+	dstreamMem.track(&zr.memSize, zr.sizeOf())
 	runtime.SetFinalizer(zr, freeDStream)
 	return zr
 }
 
 // Reset resets zr to read from r using the given dictionary dd.
+// Use ResetReaderParams if you wish to change other parameters
+// that were set via ReaderParams.
 func (zr *Reader) Reset(r io.Reader, dd *DDict) {
+	params := zr.params
+	params.Dict = dd
+	zr.ResetReaderParams(r, &params)
+}
+
+// ResetReaderParams resets zr to read from r using the given set of parameters.
+//
+// An error is returned if params are invalid. The same error is returned
+// by subsequent Read and WriteTo calls until the next successful reset.
+func (zr *Reader) ResetReaderParams(r io.Reader, params *ReaderParams) error {
 	zr.inBuf.size = 0
 	zr.inBuf.pos = 0
 	zr.outBuf.size = 0
 	zr.outBuf.pos = 0
 
-	zr.dd = dd
-	initDStream(zr.ds, zr.dd)
+	zr.params = *params
+	zr.err = initDStream(zr.ds, zr.params)
+	zr.decompressedSize = 0
+	zr.inFrame = false
+	zr.frameDict = zr.params.Dict
 
 	zr.r = r
+	return zr.err
 }
 
-func initDStream(ds *C.ZSTD_DStream, dd *DDict) {
+func initDStream(ds *C.ZSTD_DStream, params ReaderParams) error {
 	var ddict *C.ZSTD_DDict
-	if dd != nil {
-		ddict = dd.p
+	if params.Dict != nil {
+		ddict = params.Dict.p
+	}
+	// Do not use ZSTD_d_refMultipleDDicts for params.Dicts, since ds would retain
+	// pointers to all the referenced dictionaries until it is freed, while
+	// the dictionaries may be released earlier. The dictionary for every frame
+	// is referenced by Reader.selectFrameDict instead.
+	if params.Dicts != nil && params.Format != FormatZstd1 {
+		return fmt.Errorf("cannot use Dicts with Format=%d", params.Format)
 	}
 	result := C.ZSTD_initDStream_usingDDict_wrapper(
 		C.uintptr_t(uintptr(unsafe.Pointer(ds))),
-		C.uintptr_t(uintptr(unsafe.Pointer(ddict))))
-	ensureNoError("ZSTD_initDStream_usingDDict", result)
+		C.uintptr_t(uintptr(unsafe.Pointer(ddict))),
+		C.int(params.WindowLogMax),
+		C.int(params.Format))
+	if C.ZSTD_getErrorCode(result) != 0 {
+		return fmt.Errorf("cannot initialize decompressor with WindowLogMax=%d, Format=%d: %w", params.WindowLogMax, params.Format, newError(result))
+	}
+	return nil
 }
 
 func freeDStream(v interface{}) {
@@ -147,14 +304,43 @@ func (zr *Reader) Release() {
 	C.free(unsafe.Pointer(zr.outBuf))
 	zr.outBuf = nil
 
+	zr.prefix.free()
+
+	if zr.patchDict != nil {
+		zr.patchDict.Release()
+		zr.patchDict = nil
+	}
+
 	zr.r = nil
-	zr.dd = nil
+	zr.params = ReaderParams{}
+	zr.err = nil
+	zr.skippablePayload = nil
+	zr.frameDict = nil
+
+	dstreamMem.untrack(&zr.memSize)
+}
+
+// sizeOf returns the size of C memory occupied by zr.
+func (zr *Reader) sizeOf() int {
+	return int(C.ZSTD_sizeof_DStream(zr.ds) + dstreamInBufSize + dstreamOutBufSize + zr.prefix.cap)
+}
+
+// updateMemSize updates the size of zr accounted in Stats,
+// since zstd allocates memory lazily during the decompression.
+func (zr *Reader) updateMemSize() {
+	dstreamMem.update(&zr.memSize, zr.sizeOf())
 }
 
 // WriteTo writes all the data from zr to w.
 //
 // It returns the number of bytes written to w.
+//
+// io.ErrUnexpectedEOF is returned if the underlying reader ends
+// in the middle of a frame.
 func (zr *Reader) WriteTo(w io.Writer) (int64, error) {
+	if zr.err != nil {
+		return 0, zr.err
+	}
 	nn := int64(0)
 	for {
 		if zr.outBuf.pos == zr.outBuf.size {
@@ -175,10 +361,16 @@ func (zr *Reader) WriteTo(w io.Writer) (int64, error) {
 }
 
 // Read reads up to len(p) bytes from zr to p.
+//
+// io.ErrUnexpectedEOF is returned if the underlying reader ends
+// in the middle of a frame.
 func (zr *Reader) Read(p []byte) (int, error) {
 	if len(p) == 0 {
 		return 0, nil
 	}
+	if zr.err != nil {
+		return 0, zr.err
+	}
 
 	if zr.outBuf.pos == zr.outBuf.size {
 		if err := zr.fillOutBuf(); err != nil {
@@ -203,6 +395,20 @@ func (zr *Reader) fillOutBuf() error {
 	}
 
 tryDecompressAgain:
+	if !zr.inFrame && zr.params.SkippableFrameHandler != nil && zr.params.Format == FormatZstd1 {
+		// inBuf starts with a new frame. Pass skippable frames to the handler
+		// before ZSTD_decompressStream silently drops them.
+		if err := zr.readSkippableFrames(); err != nil {
+			return err
+		}
+	}
+	if !zr.inFrame && zr.params.Dicts != nil {
+		// inBuf starts with a new frame. Select the dictionary for it.
+		if err := zr.selectFrameDict(); err != nil {
+			return err
+		}
+	}
+
 	// Try decompressing inBuf into outBuf.
 	zr.outBuf.size = dstreamOutBufSize
 	zr.outBuf.pos = 0
@@ -215,11 +421,30 @@ tryDecompressAgain:
 	zr.outBuf.pos = 0
 
 	if C.ZSTD_getErrorCode(result) != 0 {
-		return fmt.Errorf("cannot decompress data: %s", errStr(result))
+		return fmt.Errorf("cannot decompress data: %w", newError(result))
+	}
+	if zr.outBuf.size > 0 || zr.inBuf.pos != prevInBufPos {
+		// ZSTD_decompressStream returns 0 only when the frame is completely
+		// decoded and fully flushed. Ignore the result if no progress
+		// has been made, since it is non-zero at frame start.
+		zr.inFrame = result != 0
+		if !zr.inFrame {
+			// The decompression may allocate memory in ds, so update its size
+			// at the end of every frame.
+			zr.updateMemSize()
+		}
 	}
 
 	if zr.outBuf.size > 0 {
 		// Something has been decompressed to outBuf. Return it.
+		if limit := zr.params.MaxDecompressedSize; limit > 0 {
+			zr.decompressedSize += int(zr.outBuf.size)
+			if zr.decompressedSize > limit {
+				zr.outBuf.size = 0
+				zr.err = ErrSizeLimitExceeded
+				return zr.err
+			}
+		}
 		return nil
 	}
 
@@ -240,6 +465,128 @@ tryDecompressAgain:
 	goto tryDecompressAgain
 }
 
+func (zr *Reader) selectFrameDict() error {
+	if err := zr.fillInBufAtLeast(frameHeaderSizePrefix); err != nil {
+		return err
+	}
+	src := zr.inBufGo[zr.inBuf.pos:zr.inBuf.size]
+	if isSkippableFrameMagic(binary.LittleEndian.Uint32(src)) {
+		// Skippable frames do not need dictionaries.
+		return nil
+	}
+	result := C.ZSTD_frameHeaderSize_wrapper(
+		C.uintptr_t(uintptr(unsafe.Pointer(&src[0]))),
+		C.size_t(len(src)))
+	if C.ZSTD_getErrorCode(result) != 0 {
+		// Let ZSTD_decompressStream return the error for invalid frame.
+		return nil
+	}
+	if err := zr.fillInBufAtLeast(int(result)); err != nil {
+		return err
+	}
+	dictID := DictIDFromFrame(zr.inBufGo[zr.inBuf.pos:zr.inBuf.size])
+
+	dd := zr.params.Dict
+	if dictID != 0 {
+		dd = zr.params.Dicts.Get(dictID)
+		if dd == nil {
+			zr.err = &MissingDictError{
+				DictID: dictID,
+			}
+			return zr.err
+		}
+	}
+	var ddict *C.ZSTD_DDict
+	if dd != nil {
+		if dd.p == nil {
+			zr.err = fmt.Errorf("cannot use dictionary with id=%d: %w", dictID, errReleasedDDict)
+			return zr.err
+		}
+		ddict = dd.p
+	}
+	if dd == zr.frameDict {
+		return nil
+	}
+	result = C.ZSTD_DCtx_refFrameDDict_wrapper(
+		C.uintptr_t(uintptr(unsafe.Pointer(zr.ds))),
+		C.uintptr_t(uintptr(unsafe.Pointer(ddict))))
+	if C.ZSTD_getErrorCode(result) != 0 {
+		zr.err = fmt.Errorf("cannot use dictionary with id=%d: %w", dictID, newError(result))
+		return zr.err
+	}
+	zr.frameDict = dd
+	return nil
+}
+
+const maxInt = int(^uint(0) >> 1)
+
+// frameHeaderSizePrefix is the minimum size required for determining the frame header size.
+const frameHeaderSizePrefix = 5 // ZSTD_FRAMEHEADERSIZE_PREFIX(ZSTD_f_zstd1) from zstd.h
+
+func (zr *Reader) readSkippableFrames() error {
+	for {
+		if err := zr.fillInBufAtLeast(SkippableFrameHeaderSize); err != nil {
+			return err
+		}
+		header := zr.inBufGo[zr.inBuf.pos : zr.inBuf.pos+SkippableFrameHeaderSize]
+		magic := binary.LittleEndian.Uint32(header)
+		if !isSkippableFrameMagic(magic) {
+			return nil
+		}
+		// Do not trust the payload size from the header - the stream may be malicious.
+		payloadSize64 := uint64(binary.LittleEndian.Uint32(header[4:]))
+		if limit := zr.params.MaxDecompressedSize; limit > 0 && payloadSize64 > uint64(limit) {
+			zr.err = fmt.Errorf("too big skippable frame payload size: %d bytes: %w", payloadSize64, ErrSizeLimitExceeded)
+			return zr.err
+		}
+		if payloadSize64 > uint64(maxInt) {
+			zr.err = fmt.Errorf("too big skippable frame payload size: %d bytes; it cannot exceed %d bytes", payloadSize64, maxInt)
+			return zr.err
+		}
+		payloadSize := int(payloadSize64)
+		zr.inBuf.pos += SkippableFrameHeaderSize
+
+		// Read the payload from inBuf and then from the underlying reader.
+		payload := zr.skippablePayload[:0]
+		n := payloadSize
+		if remaining := int(zr.inBuf.size - zr.inBuf.pos); n > remaining {
+			n = remaining
+		}
+		payload = append(payload, zr.inBufGo[zr.inBuf.pos:zr.inBuf.pos+C.size_t(n)]...)
+		zr.inBuf.pos += C.size_t(n)
+		if n < payloadSize {
+			// Grow the payload while reading it, so truncated streams
+			// with big payload sizes do not allocate big amounts of memory.
+			bb := bytes.NewBuffer(payload)
+			_, err := io.CopyN(bb, zr.r, int64(payloadSize-n))
+			payload = bb.Bytes()
+			if err != nil {
+				if err == io.EOF {
+					err = io.ErrUnexpectedEOF
+				}
+				zr.skippablePayload = payload[:0]
+				return fmt.Errorf("cannot read skippable frame payload from the underlying reader: %w", err)
+			}
+		}
+		zr.skippablePayload = payload
+
+		if err := zr.params.SkippableFrameHandler(magic-skippableFrameMagicStart, payload); err != nil {
+			zr.err = fmt.Errorf("error in SkippableFrameHandler: %w", err)
+			return zr.err
+		}
+	}
+}
+
+// fillInBufAtLeast reads data into inBuf until it contains at least n unread bytes.
+func (zr *Reader) fillInBufAtLeast(n int) error {
+	for int(zr.inBuf.size-zr.inBuf.pos) < n {
+		if err := zr.fillInBuf(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (zr *Reader) fillInBuf() error {
 	// Copy the remaining data to the start of inBuf.
 	copy(zr.inBufGo[:dstreamInBufSize], zr.inBufGo[zr.inBuf.pos:zr.inBuf.size])
@@ -262,8 +609,46 @@ readAgain:
 		return nil
 	}
 	if err == io.EOF {
+		if zr.inFrame || zr.inBuf.size > 0 {
+			// The underlying reader ended in the middle of a frame.
+			return io.ErrUnexpectedEOF
+		}
 		// Do not wrap io.EOF, so the caller may notify the end of stream.
 		return err
 	}
-	return fmt.Errorf("cannot read data from the underlying reader: %s", err)
+	return fmt.Errorf("cannot read data from the underlying reader: %w", err)
+}
+
+// SetPrefix sets the prefix for the next frame read by zr.
+//
+// The prefix must be the same as the one passed to Writer.SetPrefix
+// or CompressWithPrefix* when writing the frame. Subsequent frames
+// are decompressed without the prefix unless SetPrefix is called again.
+//
+// SetPrefix must be called before reading the frame, i.e. after New*
+// or Reset* calls or after the previous frame is completely read.
+// It cannot be used together with ReaderParams.Dict and ReaderParams.Dicts.
+//
+// The prefix is copied, so it may be modified after the call.
+func (zr *Reader) SetPrefix(prefix []byte) error {
+	if zr.err != nil {
+		return zr.err
+	}
+	if zr.inFrame {
+		return fmt.Errorf("cannot set prefix in the middle of the frame")
+	}
+	if zr.params.Dict != nil || zr.params.Dicts != nil {
+		return fmt.Errorf("cannot set prefix when ReaderParams.Dict or ReaderParams.Dicts is set")
+	}
+
+	zr.prefix.set(prefix)
+	zr.updateMemSize()
+	result := C.ZSTD_DCtx_refPrefix_wrapper(
+		C.uintptr_t(uintptr(unsafe.Pointer(zr.ds))),
+		C.uintptr_t(uintptr(zr.prefix.p)),
+		zr.prefix.size)
+	if C.ZSTD_getErrorCode(result) != 0 {
+		return fmt.Errorf("cannot set prefix: %w", newError(result))
+	}
+	return nil
 }
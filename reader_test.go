@@ -2,10 +2,12 @@ package gozstd
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"math/rand"
+	"runtime"
 	"strings"
 	"testing"
 	"time"
@@ -317,3 +319,295 @@ func testReaderExt(zr *Reader, s string) error {
 	}
 	return nil
 }
+
+func TestReaderParamsWindowLogMax(t *testing.T) {
+	const wlog = DefaultWindowLogMax + 1
+
+	var bb bytes.Buffer
+	zw := NewWriterParams(&bb, &WriterParams{
+		WindowLog: wlog,
+	})
+	defer zw.Release()
+	data := newTestString(64*1024, 3)
+	if _, err := zw.Write([]byte(data)); err != nil {
+		t.Fatalf("cannot compress data: %s", err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("cannot close zw: %s", err)
+	}
+	compressedData := bb.Bytes()
+
+	// The default windowLogMax must reject the frame.
+	zr := NewReader(bytes.NewReader(compressedData))
+	defer zr.Release()
+	if _, err := ioutil.ReadAll(zr); err == nil {
+		t.Fatalf("expecting error when decompressing frame with windowLog=%d", wlog)
+	}
+	if _, err := Decompress(nil, compressedData); err == nil {
+		t.Fatalf("expecting error when decompressing frame with windowLog=%d", wlog)
+	}
+
+	// Increased windowLogMax must accept the frame.
+	params := &ReaderParams{
+		WindowLogMax: wlog,
+	}
+	zr.ResetReaderParams(bytes.NewReader(compressedData), params)
+	plainData, err := ioutil.ReadAll(zr)
+	if err != nil {
+		t.Fatalf("cannot decompress data with WindowLogMax=%d: %s", wlog, err)
+	}
+	if string(plainData) != data {
+		t.Fatalf("unexpected data decompressed; got\n%X; want\n%X", plainData, data)
+	}
+
+	// Reset must preserve WindowLogMax.
+	zr.Reset(bytes.NewReader(compressedData), nil)
+	plainData, err = ioutil.ReadAll(zr)
+	if err != nil {
+		t.Fatalf("cannot decompress data after Reset: %s", err)
+	}
+	if string(plainData) != data {
+		t.Fatalf("unexpected data decompressed after Reset; got\n%X; want\n%X", plainData, data)
+	}
+
+	plainData, err = DecompressParams(nil, compressedData, params)
+	if err != nil {
+		t.Fatalf("cannot decompress data via DecompressParams: %s", err)
+	}
+	if string(plainData) != data {
+		t.Fatalf("unexpected data decompressed via DecompressParams; got\n%X; want\n%X", plainData, data)
+	}
+
+	// The pooled decompressor mustn't leak WindowLogMax to Decompress.
+	if _, err := Decompress(nil, compressedData); err == nil {
+		t.Fatalf("expecting error when decompressing frame with windowLog=%d after DecompressParams", wlog)
+	}
+}
+
+func TestDecompressParamsWindowLogMaxKnownContentSize(t *testing.T) {
+	data := []byte(newTestString(64*1024, 3))
+	compressedData, err := CompressParams(nil, data, &WriterParams{
+		WindowLog: 12,
+	})
+	if err != nil {
+		t.Fatalf("cannot compress data: %s", err)
+	}
+	if n, err := FrameContentSize(compressedData); err != nil || n != uint64(len(data)) {
+		t.Fatalf("expecting frame with known content size %d; got %d, err=%v", len(data), n, err)
+	}
+
+	// The one-shot path must reject the frame in the same way as the Reader does.
+	params := &ReaderParams{
+		WindowLogMax: 11,
+	}
+	for _, dst := range [][]byte{nil, make([]byte, 0, 2*len(data))} {
+		if _, err := DecompressParams(dst, compressedData, params); !errors.Is(err, ErrFrameParameterWindowTooLarge) {
+			t.Fatalf("unexpected error; got %v; want %v", err, ErrFrameParameterWindowTooLarge)
+		}
+	}
+	d := NewDecompressor()
+	defer d.Release()
+	if err := d.SetParams(params); err != nil {
+		t.Fatalf("cannot set params: %s", err)
+	}
+	if _, err := d.Decompress(nil, compressedData); !errors.Is(err, ErrFrameParameterWindowTooLarge) {
+		t.Fatalf("unexpected error; got %v; want %v", err, ErrFrameParameterWindowTooLarge)
+	}
+
+	params.WindowLogMax = 12
+	plainData, err := DecompressParams(nil, compressedData, params)
+	if err != nil {
+		t.Fatalf("cannot decompress data with WindowLogMax=%d: %s", params.WindowLogMax, err)
+	}
+	if !bytes.Equal(plainData, data) {
+		t.Fatalf("unexpected data decompressed; got %d bytes; want %d bytes", len(plainData), len(data))
+	}
+}
+
+func TestReaderParamsInvalidWindowLogMax(t *testing.T) {
+	compressedData := Compress(nil, []byte("foobar"))
+	zr := NewReaderParams(bytes.NewReader(compressedData), &ReaderParams{
+		WindowLogMax: WindowLogMax64 + 1,
+	})
+	defer zr.Release()
+	if _, err := ioutil.ReadAll(zr); err == nil {
+		t.Fatalf("expecting error for invalid WindowLogMax")
+	}
+
+	// Valid params must clear the error.
+	zr.ResetReaderParams(bytes.NewReader(compressedData), &ReaderParams{})
+	plainData, err := ioutil.ReadAll(zr)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if string(plainData) != "foobar" {
+		t.Fatalf("unexpected data decompressed; got %q; want %q", plainData, "foobar")
+	}
+}
+
+func TestReaderMaxDecompressedSize(t *testing.T) {
+	data := newTestString(int(3*dstreamOutBufSize), 3)
+	cd := Compress(nil, []byte(data))
+
+	zr := NewReaderParams(bytes.NewReader(cd), &ReaderParams{
+		MaxDecompressedSize: len(data) - 1,
+	})
+	defer zr.Release()
+	if _, err := ioutil.ReadAll(zr); err != ErrSizeLimitExceeded {
+		t.Fatalf("unexpected error; got %v; want %v", err, ErrSizeLimitExceeded)
+	}
+
+	// The error must be sticky.
+	buf := make([]byte, 10)
+	if _, err := zr.Read(buf); err != ErrSizeLimitExceeded {
+		t.Fatalf("unexpected error on subsequent Read; got %v; want %v", err, ErrSizeLimitExceeded)
+	}
+
+	// Reset must preserve the limit and clear the error.
+	zr.Reset(bytes.NewReader(cd), nil)
+	if _, err := zr.WriteTo(ioutil.Discard); err != ErrSizeLimitExceeded {
+		t.Fatalf("unexpected error after Reset; got %v; want %v", err, ErrSizeLimitExceeded)
+	}
+
+	zr.ResetReaderParams(bytes.NewReader(cd), &ReaderParams{
+		MaxDecompressedSize: len(data),
+	})
+	plainData, err := ioutil.ReadAll(zr)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if string(plainData) != data {
+		t.Fatalf("unexpected data decompressed; got\n%X; want\n%X", plainData, data)
+	}
+}
+
+func TestReaderTruncatedStream(t *testing.T) {
+	var bb bytes.Buffer
+	zw := NewWriter(&bb)
+	defer zw.Release()
+	data := newTestString(3*128*1024, 3)
+	if _, err := zw.Write([]byte(data)); err != nil {
+		t.Fatalf("cannot compress data: %s", err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("cannot close zw: %s", err)
+	}
+	cd := bb.Bytes()
+
+	zr := NewReader(nil)
+	defer zr.Release()
+
+	step := len(cd)/100 + 1
+	for n := 1; n < len(cd); n += step {
+		truncated := cd[:n]
+
+		zr.Reset(bytes.NewReader(truncated), nil)
+		if _, err := ioutil.ReadAll(zr); err != io.ErrUnexpectedEOF {
+			t.Fatalf("unexpected error in Read for %d out of %d bytes; got %v; want %v", n, len(cd), err, io.ErrUnexpectedEOF)
+		}
+
+		zr.Reset(bytes.NewReader(truncated), nil)
+		if _, err := zr.WriteTo(ioutil.Discard); err != io.ErrUnexpectedEOF {
+			t.Fatalf("unexpected error in WriteTo for %d out of %d bytes; got %v; want %v", n, len(cd), err, io.ErrUnexpectedEOF)
+		}
+
+		if err := StreamDecompress(ioutil.Discard, bytes.NewReader(truncated)); err != io.ErrUnexpectedEOF {
+			t.Fatalf("unexpected error in StreamDecompress for %d out of %d bytes; got %v; want %v", n, len(cd), err, io.ErrUnexpectedEOF)
+		}
+
+		if _, err := Decompress(nil, truncated); err == nil {
+			t.Fatalf("expecting error in Decompress for %d out of %d bytes", n, len(cd))
+		}
+	}
+
+	// Truncation at the frame boundary must result in clean EOF.
+	multiFrame := append(append([]byte{}, cd...), cd[:len(cd)/2]...)
+	zr.Reset(bytes.NewReader(multiFrame[:len(cd)]), nil)
+	plainData, err := ioutil.ReadAll(zr)
+	if err != nil {
+		t.Fatalf("unexpected error when reading the first frame: %s", err)
+	}
+	if string(plainData) != data {
+		t.Fatalf("unexpected data decompressed; got\n%X; want\n%X", plainData, data)
+	}
+
+	// Truncation inside the second frame must be detected.
+	zr.Reset(bytes.NewReader(multiFrame), nil)
+	if _, err := ioutil.ReadAll(zr); err != io.ErrUnexpectedEOF {
+		t.Fatalf("unexpected error for truncated second frame; got %v; want %v", err, io.ErrUnexpectedEOF)
+	}
+}
+
+func TestReaderSkippableFrameHandlerError(t *testing.T) {
+	cd, err := WriteSkippableFrame(nil, 5, []byte("metadata"))
+	if err != nil {
+		t.Fatalf("cannot write skippable frame: %s", err)
+	}
+	cd = Compress(cd, []byte("foobar"))
+
+	errHandler := errors.New("handler error")
+	zr := NewReaderParams(bytes.NewReader(cd), &ReaderParams{
+		SkippableFrameHandler: func(magicVariant uint32, payload []byte) error {
+			return errHandler
+		},
+	})
+	defer zr.Release()
+	if _, err := ioutil.ReadAll(zr); !errors.Is(err, errHandler) {
+		t.Fatalf("unexpected error; got %v; want %v", err, errHandler)
+	}
+
+	// The error must be sticky.
+	buf := make([]byte, 10)
+	if _, err := zr.Read(buf); !errors.Is(err, errHandler) {
+		t.Fatalf("unexpected error on subsequent Read; got %v; want %v", err, errHandler)
+	}
+
+	// The payload size must be limited by MaxDecompressedSize.
+	zr.ResetReaderParams(bytes.NewReader(cd), &ReaderParams{
+		MaxDecompressedSize: len("metadata") - 1,
+		SkippableFrameHandler: func(magicVariant uint32, payload []byte) error {
+			return nil
+		},
+	})
+	if _, err := ioutil.ReadAll(zr); !errors.Is(err, ErrSizeLimitExceeded) {
+		t.Fatalf("unexpected error; got %v; want %v", err, ErrSizeLimitExceeded)
+	}
+
+	// Truncated skippable frame.
+	zr.ResetReaderParams(bytes.NewReader(cd[:len("metadata")]), &ReaderParams{
+		SkippableFrameHandler: func(magicVariant uint32, payload []byte) error {
+			return nil
+		},
+	})
+	if _, err := ioutil.ReadAll(zr); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("unexpected error; got %v; want %v", err, io.ErrUnexpectedEOF)
+	}
+}
+
+func TestReaderSkippableFrameTruncatedBigPayload(t *testing.T) {
+	// The header declares 4GiB payload, while the stream contains only 1MiB.
+	cd := []byte{0x50, 0x2a, 0x4d, 0x18, 0xff, 0xff, 0xff, 0xff}
+	cd = append(cd, make([]byte, 1024*1024)...)
+
+	var payloadLen int
+	zr := NewReaderParams(bytes.NewReader(cd), &ReaderParams{
+		SkippableFrameHandler: func(magicVariant uint32, payload []byte) error {
+			payloadLen = len(payload)
+			return nil
+		},
+	})
+	defer zr.Release()
+
+	var msBefore, msAfter runtime.MemStats
+	runtime.ReadMemStats(&msBefore)
+	if _, err := ioutil.ReadAll(zr); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("unexpected error; got %v; want %v", err, io.ErrUnexpectedEOF)
+	}
+	runtime.ReadMemStats(&msAfter)
+	if n := msAfter.TotalAlloc - msBefore.TotalAlloc; n > 64*1024*1024 {
+		t.Fatalf("too much memory allocated for truncated skippable frame: %d bytes", n)
+	}
+	if payloadLen != 0 {
+		t.Fatalf("SkippableFrameHandler mustn't be called for truncated frame; got payload with %d bytes", payloadLen)
+	}
+}
@@ -0,0 +1,550 @@
+package gozstd
+
+/*
+#include "zstd/lib/common/xxhash.h"
+
+#include <stdint.h>  // for uintptr_t
+
+// The following *_wrapper functions allow avoiding memory allocations
+// durting calls from Go.
+// See https://github.com/golang/go/issues/24450 .
+
+static uint64_t XXH64_wrapper(uintptr_t src, size_t srcSize) {
+    return XXH64((const void*)src, srcSize, 0);
+}
+
+static uintptr_t XXH64_createState_wrapper() {
+    XXH64_state_t *state = XXH64_createState();
+    if (state != NULL) {
+        XXH64_reset(state, 0);
+    }
+    return (uintptr_t)state;
+}
+
+static void XXH64_freeState_wrapper(uintptr_t state) {
+    XXH64_freeState((XXH64_state_t*)state);
+}
+
+static void XXH64_reset_wrapper(uintptr_t state) {
+    XXH64_reset((XXH64_state_t*)state, 0);
+}
+
+static void XXH64_update_wrapper(uintptr_t state, uintptr_t src, size_t srcSize) {
+    XXH64_update((XXH64_state_t*)state, (const void*)src, srcSize);
+}
+
+static uint64_t XXH64_digest_wrapper(uintptr_t state) {
+    return XXH64_digest((const XXH64_state_t*)state);
+}
+*/
+import "C"
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"runtime"
+	"sort"
+	"sync"
+	"unsafe"
+)
+
+// The constants below are from zstd/contrib/seekable_format/zstd_seekable.h .
+// See zstd/contrib/seekable_format/zstd_seekable_compression_format.md
+// for the seekable format description.
+const (
+	seekTableFooterSize     = 9
+	seekTableMagicVariant   = 0xE // Skippable_Magic_Number is 0x184D2A5E
+	seekableMagicNumber     = 0x8F92EAB1
+	seekableMaxFrames       = 0x8000000
+	seekTableChecksumFlag   = 1 << 7
+	seekTableReservedBits   = 0x7c
+	seekTableEntrySize      = 8
+	seekTableEntrySizeCksum = 12
+)
+
+const (
+	// DefaultSeekableFrameSize is the default maximum number
+	// of uncompressed bytes per frame written by SeekableWriter.
+	DefaultSeekableFrameSize = 1024 * 1024
+
+	// MaxSeekableFrameSize is the maximum number of uncompressed bytes
+	// per frame in the seekable format.
+	MaxSeekableFrameSize = 0x40000000 // from zstd_seekable.h
+)
+
+// ErrInvalidSeekTable is returned by NewSeekableReader if the data
+// doesn't end with valid seek table. It is also returned by SeekableReader
+// if the seek table mismatches the frame being read.
+var ErrInvalidSeekTable = errors.New("invalid seek table")
+
+// SeekableWriterParams allows users to specify parameters
+// for NewSeekableWriter.
+type SeekableWriterParams struct {
+	// WriterParams are the parameters used for compressing frames.
+	WriterParams WriterParams
+
+	// FrameSize is the maximum number of uncompressed bytes per frame.
+	// Smaller frames give faster random access at the cost of worse
+	// compression ratio.
+	// Special value 0 means 'use DefaultSeekableFrameSize'.
+	// Must not exceed MaxSeekableFrameSize.
+	FrameSize int
+
+	// DisableChecksum disables storing checksums of the uncompressed frames
+	// in the seek table.
+	DisableChecksum bool
+}
+
+// SeekableWriter implements zstd seekable format writer.
+//
+// The written data is split into independently compressed frames
+// followed by a seek table, so it may be read at random offsets
+// with SeekableReader. The written data may be decompressed
+// by any zstd decompressor.
+//
+// See https://github.com/facebook/zstd/blob/dev/contrib/seekable_format/zstd_seekable_compression_format.md
+type SeekableWriter struct {
+	zw  *Writer
+	cw  countingWriter
+	err error
+
+	frameSize int
+	checksum  bool
+
+	// frameOffset is the offset of the current frame in the compressed stream.
+	frameOffset int64
+
+	// frameLen is the number of uncompressed bytes in the current frame.
+	frameLen int
+
+	// xxh is XXH64 state for the current frame.
+	xxh C.uintptr_t
+
+	// seekTable contains the seek table entries for the written frames.
+	seekTable []byte
+	numFrames int
+}
+
+// NewSeekableWriter returns new seekable writer writing compressed data to w
+// using the given params.
+//
+// Calling NewSeekableWriter with nil params is equivalent to calling it
+// with zero SeekableWriterParams.
+//
+// An error on invalid params is returned by subsequent SeekableWriter calls.
+//
+// Call Release when the SeekableWriter is no longer needed.
+func NewSeekableWriter(w io.Writer, params *SeekableWriterParams) *SeekableWriter {
+	if params == nil {
+		params = &SeekableWriterParams{}
+	}
+	sw := &SeekableWriter{
+		frameSize: params.FrameSize,
+		checksum:  !params.DisableChecksum,
+		xxh:       C.XXH64_createState_wrapper(),
+	}
+	sw.cw.w = w
+	if sw.xxh == 0 {
+		panic(fmt.Errorf("BUG: cannot allocate XXH64 state"))
+	}
+	if sw.frameSize == 0 {
+		sw.frameSize = DefaultSeekableFrameSize
+	}
+	if sw.frameSize < 0 || sw.frameSize > MaxSeekableFrameSize {
+		sw.err = fmt.Errorf("invalid FrameSize=%d; it must be in the range [1..%d]", params.FrameSize, MaxSeekableFrameSize)
+	}
+	sw.zw = NewWriterParams(&sw.cw, &params.WriterParams)
+	if sw.err == nil {
+		sw.err = sw.zw.err
+	}
+
+	runtime.SetFinalizer(sw, freeSeekableWriter)
+	return sw
+}
+
+func freeSeekableWriter(v interface{}) {
+	v.(*SeekableWriter).Release()
+}
+
+// Release releases all the resources occupied by sw.
+//
+// sw cannot be used after the release.
+func (sw *SeekableWriter) Release() {
+	if sw.zw == nil {
+		return
+	}
+	sw.zw.Release()
+	sw.zw = nil
+	C.XXH64_freeState_wrapper(sw.xxh)
+	sw.xxh = 0
+	sw.cw.w = nil
+	sw.seekTable = nil
+}
+
+// Write writes p to sw.
+//
+// Write doesn't flush the compressed data to the underlying writer
+// due to performance reasons.
+// Call Flush or Close when the compressed data must propagate
+// to the underlying writer.
+func (sw *SeekableWriter) Write(p []byte) (int, error) {
+	if sw.err != nil {
+		return 0, sw.err
+	}
+	pLen := len(p)
+	for len(p) > 0 {
+		n := sw.frameSize - sw.frameLen
+		if n > len(p) {
+			n = len(p)
+		}
+		if _, err := sw.zw.Write(p[:n]); err != nil {
+			sw.err = err
+			return pLen - len(p), err
+		}
+		if sw.checksum {
+			C.XXH64_update_wrapper(sw.xxh,
+				C.uintptr_t(uintptr(unsafe.Pointer(&p[0]))),
+				C.size_t(n))
+			// Prevent from GC'ing of p during CGO call above.
+			runtime.KeepAlive(p)
+		}
+		sw.frameLen += n
+		p = p[n:]
+		if sw.frameLen == sw.frameSize {
+			if err := sw.endFrame(); err != nil {
+				return pLen - len(p), err
+			}
+		}
+	}
+	return pLen, nil
+}
+
+// Flush flushes the remaining data from sw to the underlying writer.
+//
+// Flush doesn't finalize the current frame.
+func (sw *SeekableWriter) Flush() error {
+	if sw.err != nil {
+		return sw.err
+	}
+	if err := sw.zw.Flush(); err != nil {
+		sw.err = err
+		return err
+	}
+	return nil
+}
+
+// Close finalizes the current frame, writes the seek table and flushes
+// all the compressed data to the underlying writer.
+//
+// It doesn't close the underlying writer passed to NewSeekableWriter.
+// Subsequent writes to sw start new seekable stream.
+func (sw *SeekableWriter) Close() error {
+	if sw.err != nil {
+		return sw.err
+	}
+	if err := sw.endFrame(); err != nil {
+		return err
+	}
+
+	descriptor := byte(0)
+	if sw.checksum {
+		descriptor |= seekTableChecksumFlag
+	}
+	var footer [seekTableFooterSize]byte
+	binary.LittleEndian.PutUint32(footer[:], uint32(sw.numFrames))
+	footer[4] = descriptor
+	binary.LittleEndian.PutUint32(footer[5:], seekableMagicNumber)
+	sw.seekTable = append(sw.seekTable, footer[:]...)
+
+	frame, err := WriteSkippableFrame(nil, seekTableMagicVariant, sw.seekTable)
+	if err != nil {
+		sw.err = err
+		return err
+	}
+	if _, err := sw.cw.Write(frame); err != nil {
+		sw.err = fmt.Errorf("cannot write seek table to the underlying writer: %w", err)
+		return sw.err
+	}
+
+	sw.seekTable = sw.seekTable[:0]
+	sw.numFrames = 0
+	sw.cw.n = 0
+	sw.frameOffset = 0
+	return nil
+}
+
+func (sw *SeekableWriter) endFrame() error {
+	if sw.frameLen == 0 {
+		return nil
+	}
+	if sw.numFrames >= seekableMaxFrames {
+		sw.err = fmt.Errorf("too many frames in seekable stream; the maximum number of frames is %d", seekableMaxFrames)
+		return sw.err
+	}
+	if err := sw.zw.Close(); err != nil {
+		sw.err = err
+		return err
+	}
+
+	var entry [seekTableEntrySizeCksum]byte
+	binary.LittleEndian.PutUint32(entry[:], uint32(sw.cw.n-sw.frameOffset))
+	binary.LittleEndian.PutUint32(entry[4:], uint32(sw.frameLen))
+	if sw.checksum {
+		binary.LittleEndian.PutUint32(entry[8:], uint32(C.XXH64_digest_wrapper(sw.xxh)))
+		sw.seekTable = append(sw.seekTable, entry[:seekTableEntrySizeCksum]...)
+		C.XXH64_reset_wrapper(sw.xxh)
+	} else {
+		sw.seekTable = append(sw.seekTable, entry[:seekTableEntrySize]...)
+	}
+	sw.numFrames++
+	sw.frameOffset = sw.cw.n
+	sw.frameLen = 0
+	return nil
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+// SeekableReader reads data in zstd seekable format at random offsets.
+//
+// It implements io.ReaderAt and io.ReadSeeker. ReadAt may be called
+// from multiple goroutines, but concurrent calls are serialized, since
+// they share the buffer with the last decompressed frame. Use distinct
+// SeekableReader objects for decompressing the data in parallel.
+//
+// See SeekableWriter for details.
+type SeekableReader struct {
+	r      io.ReaderAt
+	params ReaderParams
+
+	// cOffsets and dOffsets contain compressed and decompressed offsets
+	// for every frame plus the offsets past the last frame.
+	cOffsets []int64
+	dOffsets []int64
+
+	// checksums contain the lowest 32 bits of XXH64 digests of decompressed frames.
+	// It is nil if the seek table has no checksums.
+	checksums []uint32
+
+	// offset is the offset for Read and Seek.
+	offset int64
+
+	// mu protects the fields below.
+	mu sync.Mutex
+
+	// frameIdx is the index of the frame decompressed into frameBuf.
+	frameIdx int
+	frameBuf []byte
+	cBuf     []byte
+}
+
+// NewSeekableReader returns new SeekableReader for size bytes
+// of compressed data in seekable format read from r.
+//
+// params are used for decompressing frames. params may be nil.
+func NewSeekableReader(r io.ReaderAt, size int64, params *ReaderParams) (*SeekableReader, error) {
+	if params == nil {
+		params = &ReaderParams{}
+	}
+	var footer [seekTableFooterSize]byte
+	if size < SkippableFrameHeaderSize+seekTableFooterSize {
+		return nil, fmt.Errorf("too small size=%d for seekable format: %w", size, ErrInvalidSeekTable)
+	}
+	if err := readFullAt(r, footer[:], size-seekTableFooterSize); err != nil {
+		return nil, fmt.Errorf("cannot read seek table footer: %w", err)
+	}
+	if magic := binary.LittleEndian.Uint32(footer[5:]); magic != seekableMagicNumber {
+		return nil, fmt.Errorf("unexpected seekable magic number 0x%08X; want 0x%08X: %w", magic, seekableMagicNumber, ErrInvalidSeekTable)
+	}
+	numFrames := int64(binary.LittleEndian.Uint32(footer[:]))
+	descriptor := footer[4]
+	if descriptor&seekTableReservedBits != 0 {
+		return nil, fmt.Errorf("unexpected reserved bits set in seek table descriptor 0x%02X: %w", descriptor, ErrInvalidSeekTable)
+	}
+	entrySize := int64(seekTableEntrySize)
+	hasChecksum := descriptor&seekTableChecksumFlag != 0
+	if hasChecksum {
+		entrySize = seekTableEntrySizeCksum
+	}
+	tableSize := numFrames*entrySize + seekTableFooterSize
+	tableOffset := size - tableSize - SkippableFrameHeaderSize
+	if numFrames > seekableMaxFrames || tableOffset < 0 {
+		return nil, fmt.Errorf("too big number of frames in seek table: %d: %w", numFrames, ErrInvalidSeekTable)
+	}
+
+	table := make([]byte, SkippableFrameHeaderSize+tableSize-seekTableFooterSize)
+	if err := readFullAt(r, table, tableOffset); err != nil {
+		return nil, fmt.Errorf("cannot read seek table: %w", err)
+	}
+	if magic := binary.LittleEndian.Uint32(table); magic != skippableFrameMagicStart+seekTableMagicVariant {
+		return nil, fmt.Errorf("unexpected seek table magic number 0x%08X; want 0x%08X: %w",
+			magic, skippableFrameMagicStart+seekTableMagicVariant, ErrInvalidSeekTable)
+	}
+	if n := int64(binary.LittleEndian.Uint32(table[4:])); n != tableSize {
+		return nil, fmt.Errorf("unexpected seek table frame size %d; want %d: %w", n, tableSize, ErrInvalidSeekTable)
+	}
+	table = table[SkippableFrameHeaderSize:]
+
+	sr := &SeekableReader{
+		r:        r,
+		params:   *params,
+		cOffsets: make([]int64, numFrames+1),
+		dOffsets: make([]int64, numFrames+1),
+		frameIdx: -1,
+	}
+	if hasChecksum {
+		sr.checksums = make([]uint32, numFrames)
+	}
+	for i := int64(0); i < numFrames; i++ {
+		entry := table[i*entrySize:]
+		// Empty frames have zero decompressed size. They are never loaded by ReadAt,
+		// since they don't contain data at any offset.
+		sr.cOffsets[i+1] = sr.cOffsets[i] + int64(binary.LittleEndian.Uint32(entry))
+		sr.dOffsets[i+1] = sr.dOffsets[i] + int64(binary.LittleEndian.Uint32(entry[4:]))
+		if hasChecksum {
+			sr.checksums[i] = binary.LittleEndian.Uint32(entry[8:])
+		}
+	}
+	if sr.cOffsets[numFrames] != tableOffset {
+		return nil, fmt.Errorf("the sum of compressed frame sizes in seek table must be equal to %d; got %d: %w",
+			tableOffset, sr.cOffsets[numFrames], ErrInvalidSeekTable)
+	}
+	return sr, nil
+}
+
+// Size returns the decompressed size of the data.
+func (sr *SeekableReader) Size() int64 {
+	return sr.dOffsets[len(sr.dOffsets)-1]
+}
+
+// ReadAt reads len(p) decompressed bytes starting at the given offset into p.
+//
+// It implements io.ReaderAt.
+func (sr *SeekableReader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset: %d", off)
+	}
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+
+	nn := 0
+	for len(p) > 0 {
+		if off >= sr.Size() {
+			return nn, io.EOF
+		}
+		idx := sort.Search(len(sr.dOffsets)-1, func(i int) bool {
+			return sr.dOffsets[i+1] > off
+		})
+		if err := sr.loadFrame(idx); err != nil {
+			return nn, err
+		}
+		n := copy(p, sr.frameBuf[off-sr.dOffsets[idx]:])
+		p = p[n:]
+		off += int64(n)
+		nn += n
+	}
+	return nn, nil
+}
+
+func (sr *SeekableReader) loadFrame(idx int) error {
+	if idx == sr.frameIdx {
+		return nil
+	}
+	sr.frameIdx = -1
+
+	cOffset := sr.cOffsets[idx]
+	cSize := sr.cOffsets[idx+1] - cOffset
+	dSize := int(sr.dOffsets[idx+1] - sr.dOffsets[idx])
+	if cap(sr.cBuf) < int(cSize) {
+		sr.cBuf = make([]byte, cSize)
+	}
+	sr.cBuf = sr.cBuf[:cSize]
+	if err := readFullAt(sr.r, sr.cBuf, cOffset); err != nil {
+		return fmt.Errorf("cannot read frame #%d: %w", idx, err)
+	}
+
+	if fh, err := ParseFrameHeader(sr.cBuf); err == nil && fh.ContentSize != ContentSizeUnknown && fh.ContentSize != uint64(dSize) {
+		return fmt.Errorf("unexpected content size in the header of frame #%d; got %d bytes; want %d bytes: %w",
+			idx, fh.ContentSize, dSize, ErrInvalidSeekTable)
+	}
+
+	// dSize is always positive here, so the limit is always set.
+	params := sr.params
+	params.MaxDecompressedSize = dSize
+	data, err := DecompressParams(sr.frameBuf[:0], sr.cBuf, &params)
+	sr.frameBuf = data
+	if err != nil {
+		return fmt.Errorf("cannot decompress frame #%d: %w", idx, err)
+	}
+	if len(data) != dSize {
+		return fmt.Errorf("unexpected decompressed size for frame #%d; got %d bytes; want %d bytes: %w", idx, len(data), dSize, ErrCorruption)
+	}
+	if sr.checksums != nil {
+		var dataPtr uintptr
+		if len(data) > 0 {
+			dataPtr = uintptr(unsafe.Pointer(&data[0]))
+		}
+		checksum := uint32(C.XXH64_wrapper(C.uintptr_t(dataPtr), C.size_t(len(data))))
+		// Prevent from GC'ing of data during CGO call above.
+		runtime.KeepAlive(data)
+		if checksum != sr.checksums[idx] {
+			return fmt.Errorf("unexpected checksum for frame #%d; got 0x%08X; want 0x%08X: %w", idx, checksum, sr.checksums[idx], ErrChecksumWrong)
+		}
+	}
+	sr.frameIdx = idx
+	return nil
+}
+
+// Read reads up to len(p) decompressed bytes from sr into p.
+//
+// It implements io.Reader.
+func (sr *SeekableReader) Read(p []byte) (int, error) {
+	n, err := sr.ReadAt(p, sr.offset)
+	sr.offset += int64(n)
+	if n > 0 && err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+// Seek sets the offset for the next Read.
+//
+// It implements io.Seeker.
+func (sr *SeekableReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += sr.offset
+	case io.SeekEnd:
+		offset += sr.Size()
+	default:
+		return sr.offset, fmt.Errorf("invalid whence=%d", whence)
+	}
+	if offset < 0 {
+		return sr.offset, fmt.Errorf("negative offset: %d", offset)
+	}
+	sr.offset = offset
+	return offset, nil
+}
+
+func readFullAt(r io.ReaderAt, p []byte, off int64) error {
+	n, err := r.ReadAt(p, off)
+	if n == len(p) {
+		// io.ReaderAt may return io.EOF when reading the last bytes.
+		return nil
+	}
+	if err == nil || err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,358 @@
+package gozstd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"sync"
+	"testing"
+)
+
+func TestSeekableReaderReferenceData(t *testing.T) {
+	// The data has been created by zstd/contrib/seekable_format/examples/seekable_compression
+	// with frameSize=200 from "line 0\n" ... "line 99\n".
+	cd := mustUnhex("28b52ffd000015020044026c696e6520300a31323334353637383931313133343536373839323031323334350a6c6919a820b89b01a013eb1012ce0f24edc2ed" +
+		"9861cb84f290a38b15682928b52ffd0000e5010064026e652032360a6c693738393330313233343536373839343031323334353637383935300a6c6918a810e8" +
+		"ee06e0d7101001f20108aeb5207720a528b52ffd0000dd010054026e652035310a6c6932333435363738393630313233343536373839373031323334350a6c69" +
+		"18a810e8ee06e0d7101001f201c16a8e087520a528b52ffd0000c5010024026e652037360a6c6937383938303132333435363738393930313233343536373839" +
+		"0a17a810e0ed06f0d5101801f201bb65ea26d895325e2a4d18390000004b000000c8000000f400ca0b45000000c8000000bf9476f444000000c80000002d7c97" +
+		"fe41000000be000000b873419e0400000080b1ea928f")
+	var bb bytes.Buffer
+	for i := 0; i < 100; i++ {
+		fmt.Fprintf(&bb, "line %d\n", i)
+	}
+	data := bb.Bytes()
+
+	sr, err := NewSeekableReader(bytes.NewReader(cd), int64(len(cd)), nil)
+	if err != nil {
+		t.Fatalf("cannot create SeekableReader: %s", err)
+	}
+	testSeekableReader(t, sr, data)
+}
+
+func TestSeekableWriterReader(t *testing.T) {
+	data := []byte(newTestString(300*1024, 3))
+	for _, frameSize := range []int{0, 1, 1000, 64 * 1024, 1024 * 1024} {
+		for _, disableChecksum := range []bool{false, true} {
+			params := &SeekableWriterParams{
+				WriterParams: WriterParams{
+					CompressionLevel: 5,
+					EnableChecksum:   disableChecksum,
+				},
+				FrameSize:       frameSize,
+				DisableChecksum: disableChecksum,
+			}
+			src := data
+			if frameSize == 1 {
+				src = data[:3000]
+			}
+			testSeekableWriterReader(t, src, params)
+		}
+	}
+}
+
+func testSeekableWriterReader(t *testing.T, data []byte, params *SeekableWriterParams) {
+	t.Helper()
+
+	var bb bytes.Buffer
+	sw := NewSeekableWriter(&bb, params)
+	defer sw.Release()
+
+	// Write the data in random chunks.
+	src := data
+	for len(src) > 0 {
+		n := rand.Intn(3*len(src)/2 + 1)
+		if n > len(src) {
+			n = len(src)
+		}
+		if _, err := sw.Write(src[:n]); err != nil {
+			t.Fatalf("cannot write data: %s", err)
+		}
+		src = src[n:]
+	}
+	if err := sw.Close(); err != nil {
+		t.Fatalf("cannot close SeekableWriter: %s", err)
+	}
+	cd := bb.Bytes()
+
+	// The data must be readable by regular decompressor.
+	plainData, err := Decompress(nil, cd)
+	if err != nil {
+		t.Fatalf("cannot decompress seekable data: %s", err)
+	}
+	if !bytes.Equal(plainData, data) {
+		t.Fatalf("unexpected data decompressed; got %d bytes; want %d bytes", len(plainData), len(data))
+	}
+
+	sr, err := NewSeekableReader(bytes.NewReader(cd), int64(len(cd)), nil)
+	if err != nil {
+		t.Fatalf("cannot create SeekableReader: %s", err)
+	}
+	testSeekableReader(t, sr, data)
+}
+
+func testSeekableReader(t *testing.T, sr *SeekableReader, data []byte) {
+	t.Helper()
+
+	if sr.Size() != int64(len(data)) {
+		t.Fatalf("unexpected size; got %d; want %d", sr.Size(), len(data))
+	}
+
+	// Read the whole data.
+	plainData, err := ioutil.ReadAll(sr)
+	if err != nil {
+		t.Fatalf("cannot read data: %s", err)
+	}
+	if !bytes.Equal(plainData, data) {
+		t.Fatalf("unexpected data read; got %d bytes; want %d bytes", len(plainData), len(data))
+	}
+
+	// Read random ranges.
+	for i := 0; i < 100; i++ {
+		off := rand.Intn(len(data))
+		n := rand.Intn(len(data) - off + 1)
+		buf := make([]byte, n)
+		if _, err := sr.ReadAt(buf, int64(off)); err != nil {
+			t.Fatalf("cannot read %d bytes at offset %d: %s", n, off, err)
+		}
+		if !bytes.Equal(buf, data[off:off+n]) {
+			t.Fatalf("unexpected data read at offset %d; got\n%q; want\n%q", off, buf, data[off:off+n])
+		}
+	}
+
+	// Read past the end.
+	buf := make([]byte, 10)
+	n, err := sr.ReadAt(buf, int64(len(data)-5))
+	if err != io.EOF {
+		t.Fatalf("unexpected error when reading past the end; got %v; want %v", err, io.EOF)
+	}
+	if !bytes.Equal(buf[:n], data[len(data)-5:]) {
+		t.Fatalf("unexpected data read at the end; got %q; want %q", buf[:n], data[len(data)-5:])
+	}
+
+	// Seek and read.
+	off, err := sr.Seek(-7, io.SeekEnd)
+	if err != nil {
+		t.Fatalf("cannot seek: %s", err)
+	}
+	if off != int64(len(data)-7) {
+		t.Fatalf("unexpected offset; got %d; want %d", off, len(data)-7)
+	}
+	plainData, err = ioutil.ReadAll(sr)
+	if err != nil {
+		t.Fatalf("cannot read data: %s", err)
+	}
+	if !bytes.Equal(plainData, data[len(data)-7:]) {
+		t.Fatalf("unexpected data read after seek; got %q; want %q", plainData, data[len(data)-7:])
+	}
+	if _, err := sr.Seek(-1, io.SeekStart); err == nil {
+		t.Fatalf("expecting non-nil error when seeking to negative offset")
+	}
+
+	// Concurrent reads.
+	var wg sync.WaitGroup
+	errCh := make(chan error, 5)
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				off := rand.Intn(len(data))
+				buf := make([]byte, len(data)-off)
+				if _, err := sr.ReadAt(buf, int64(off)); err != nil {
+					errCh <- err
+					return
+				}
+				if !bytes.Equal(buf, data[off:]) {
+					errCh <- fmt.Errorf("unexpected data read at offset %d", off)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errCh)
+	for err := range errCh {
+		t.Fatalf("unexpected error in concurrent ReadAt: %s", err)
+	}
+}
+
+func TestSeekableWriterSkippedFrames(t *testing.T) {
+	var bb bytes.Buffer
+	sw := NewSeekableWriter(&bb, &SeekableWriterParams{
+		FrameSize: 100,
+	})
+	defer sw.Release()
+
+	// Close without data must write empty seek table.
+	if err := sw.Close(); err != nil {
+		t.Fatalf("cannot close SeekableWriter: %s", err)
+	}
+	cd := bb.Bytes()
+	sr, err := NewSeekableReader(bytes.NewReader(cd), int64(len(cd)), nil)
+	if err != nil {
+		t.Fatalf("cannot create SeekableReader: %s", err)
+	}
+	if sr.Size() != 0 {
+		t.Fatalf("unexpected size; got %d; want 0", sr.Size())
+	}
+	if _, err := sr.ReadAt(make([]byte, 1), 0); err != io.EOF {
+		t.Fatalf("unexpected error; got %v; want %v", err, io.EOF)
+	}
+
+	// Flush must not finalize the frame, and subsequent writes
+	// after Close must start new seekable stream.
+	bb.Reset()
+	data := []byte(newTestString(1000, 3))
+	if _, err := sw.Write(data[:50]); err != nil {
+		t.Fatalf("cannot write data: %s", err)
+	}
+	if err := sw.Flush(); err != nil {
+		t.Fatalf("cannot flush SeekableWriter: %s", err)
+	}
+	if _, err := sw.Write(data[50:]); err != nil {
+		t.Fatalf("cannot write data: %s", err)
+	}
+	if err := sw.Close(); err != nil {
+		t.Fatalf("cannot close SeekableWriter: %s", err)
+	}
+	cd = bb.Bytes()
+	sr, err = NewSeekableReader(bytes.NewReader(cd), int64(len(cd)), nil)
+	if err != nil {
+		t.Fatalf("cannot create SeekableReader: %s", err)
+	}
+	if n := len(sr.dOffsets) - 1; n != 10 {
+		t.Fatalf("unexpected number of frames; got %d; want 10", n)
+	}
+	testSeekableReader(t, sr, data)
+}
+
+func TestSeekableWriterInvalidParams(t *testing.T) {
+	for _, params := range []*SeekableWriterParams{
+		{FrameSize: -1},
+		{FrameSize: MaxSeekableFrameSize + 1},
+		{WriterParams: WriterParams{WindowLog: 100}},
+	} {
+		sw := NewSeekableWriter(ioutil.Discard, params)
+		if _, err := sw.Write([]byte("foobar")); err == nil {
+			t.Fatalf("expecting non-nil error for params %+v", params)
+		}
+		if err := sw.Close(); err == nil {
+			t.Fatalf("expecting non-nil error on Close for params %+v", params)
+		}
+		sw.Release()
+	}
+}
+
+func TestSeekableReaderInvalidData(t *testing.T) {
+	var bb bytes.Buffer
+	sw := NewSeekableWriter(&bb, &SeekableWriterParams{
+		FrameSize: 1000,
+	})
+	defer sw.Release()
+	data := []byte(newTestString(10000, 3))
+	if _, err := sw.Write(data); err != nil {
+		t.Fatalf("cannot write data: %s", err)
+	}
+	if err := sw.Close(); err != nil {
+		t.Fatalf("cannot close SeekableWriter: %s", err)
+	}
+	cd := bb.Bytes()
+
+	// Missing seek table.
+	cdRegular := Compress(nil, data)
+	if _, err := NewSeekableReader(bytes.NewReader(cdRegular), int64(len(cdRegular)), nil); !errors.Is(err, ErrInvalidSeekTable) {
+		t.Fatalf("unexpected error; got %v; want %v", err, ErrInvalidSeekTable)
+	}
+
+	// Truncated data.
+	for _, n := range []int{0, 5, len(cd) - 1} {
+		if _, err := NewSeekableReader(bytes.NewReader(cd[:n]), int64(n), nil); err == nil {
+			t.Fatalf("expecting non-nil error for data truncated to %d bytes", n)
+		}
+	}
+
+	// Extra data before the seekable stream.
+	cdPrefixed := append([]byte("foobar"), cd...)
+	if _, err := NewSeekableReader(bytes.NewReader(cdPrefixed), int64(len(cdPrefixed)), nil); !errors.Is(err, ErrInvalidSeekTable) {
+		t.Fatalf("unexpected error; got %v; want %v", err, ErrInvalidSeekTable)
+	}
+
+	// Invalid checksum for the first frame.
+	cdCorrupted := append([]byte{}, cd...)
+	checksumOffset := len(cd) - seekTableFooterSize - 10*seekTableEntrySizeCksum + 8
+	cdCorrupted[checksumOffset]++
+	sr, err := NewSeekableReader(bytes.NewReader(cdCorrupted), int64(len(cdCorrupted)), nil)
+	if err != nil {
+		t.Fatalf("cannot create SeekableReader: %s", err)
+	}
+	if _, err := sr.ReadAt(make([]byte, 10), 0); !errors.Is(err, ErrChecksumWrong) {
+		t.Fatalf("unexpected error; got %v; want %v", err, ErrChecksumWrong)
+	}
+	if _, err := sr.ReadAt(make([]byte, 10), 1000); err != nil {
+		t.Fatalf("unexpected error when reading the second frame: %s", err)
+	}
+
+	// Decompressed size in seek table mismatches the content size in the frame header.
+	frame := Compress(nil, data)
+	var table [seekTableEntrySize + seekTableFooterSize]byte
+	binary.LittleEndian.PutUint32(table[:], uint32(len(frame)))
+	binary.LittleEndian.PutUint32(table[4:], uint32(len(data)+1))
+	binary.LittleEndian.PutUint32(table[8:], 1)
+	binary.LittleEndian.PutUint32(table[13:], seekableMagicNumber)
+	cdMismatch, err := WriteSkippableFrame(frame, seekTableMagicVariant, table[:])
+	if err != nil {
+		t.Fatalf("cannot write seek table: %s", err)
+	}
+	sr, err = NewSeekableReader(bytes.NewReader(cdMismatch), int64(len(cdMismatch)), nil)
+	if err != nil {
+		t.Fatalf("cannot create SeekableReader: %s", err)
+	}
+	if _, err := sr.ReadAt(make([]byte, 10), 0); !errors.Is(err, ErrInvalidSeekTable) {
+		t.Fatalf("unexpected error; got %v; want %v", err, ErrInvalidSeekTable)
+	}
+}
+
+func TestSeekableReaderEmptyFrames(t *testing.T) {
+	// The reference implementation writes empty frames with zero
+	// decompressed size into the seek table for empty frames.
+	var emptyFrame bytes.Buffer
+	zw := NewWriter(&emptyFrame)
+	if err := zw.Close(); err != nil {
+		t.Fatalf("cannot close Writer: %s", err)
+	}
+	zw.Release()
+
+	data := []byte(newTestString(3000, 3))
+	chunks := [][]byte{data[:1000], nil, data[1000:2000], nil, nil, data[2000:]}
+	var cd, table []byte
+	for _, chunk := range chunks {
+		frame := emptyFrame.Bytes()
+		if len(chunk) > 0 {
+			frame = Compress(nil, chunk)
+		}
+		cd = append(cd, frame...)
+		var entry [seekTableEntrySize]byte
+		binary.LittleEndian.PutUint32(entry[:], uint32(len(frame)))
+		binary.LittleEndian.PutUint32(entry[4:], uint32(len(chunk)))
+		table = append(table, entry[:]...)
+	}
+	var footer [seekTableFooterSize]byte
+	binary.LittleEndian.PutUint32(footer[:], uint32(len(chunks)))
+	binary.LittleEndian.PutUint32(footer[5:], seekableMagicNumber)
+	table = append(table, footer[:]...)
+	cd, err := WriteSkippableFrame(cd, seekTableMagicVariant, table)
+	if err != nil {
+		t.Fatalf("cannot write seek table: %s", err)
+	}
+
+	sr, err := NewSeekableReader(bytes.NewReader(cd), int64(len(cd)), nil)
+	if err != nil {
+		t.Fatalf("cannot create SeekableReader: %s", err)
+	}
+	testSeekableReader(t, sr, data)
+}
@@ -0,0 +1,230 @@
+package gozstd
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// MemStats contains statistics for the C memory occupied by gozstd objects.
+//
+// The C memory isn't visible to the Go GC, so it isn't accounted
+// in runtime.MemStats.
+type MemStats struct {
+	// CCtxs is the number of live compression contexts.
+	// It includes Compressor objects and the contexts
+	// pooled by Compress* functions.
+	CCtxs int64
+
+	// CCtxBytes is the size of live compression contexts in bytes.
+	CCtxBytes int64
+
+	// DCtxs is the number of live decompression contexts.
+	// It includes Decompressor objects and the contexts
+	// pooled by Decompress* functions.
+	DCtxs int64
+
+	// DCtxBytes is the size of live decompression contexts in bytes.
+	DCtxBytes int64
+
+	// CStreams is the number of live Writer objects.
+	// It includes writers pooled by StreamCompress* functions.
+	CStreams int64
+
+	// CStreamBytes is the size of live Writer objects in bytes
+	// including their buffers.
+	CStreamBytes int64
+
+	// DStreams is the number of live Reader objects.
+	// It includes readers pooled by StreamDecompress* and Decompress* functions.
+	DStreams int64
+
+	// DStreamBytes is the size of live Reader objects in bytes
+	// including their buffers.
+	DStreamBytes int64
+
+	// CDicts is the number of live CDict objects.
+	CDicts int64
+
+	// CDictBytes is the size of live CDict objects in bytes.
+	CDictBytes int64
+
+	// DDicts is the number of live DDict objects.
+	DDicts int64
+
+	// DDictBytes is the size of live DDict objects in bytes.
+	DDictBytes int64
+}
+
+// TotalBytes returns the total size of the C memory accounted in ms.
+func (ms *MemStats) TotalBytes() int64 {
+	return ms.CCtxBytes + ms.DCtxBytes + ms.CStreamBytes + ms.DStreamBytes + ms.CDictBytes + ms.DDictBytes
+}
+
+// Stats returns statistics for the C memory occupied by gozstd objects.
+//
+// Contexts and streams may allocate memory during compression
+// and decompression. Their sizes are updated lazily in order to avoid
+// the overhead on every operation: periodically for contexts and at the end
+// of every frame for streams. So Stats may lag behind the actual sizes.
+func Stats() MemStats {
+	var ms MemStats
+	ms.CCtxs, ms.CCtxBytes = cctxMem.load()
+	ms.DCtxs, ms.DCtxBytes = dctxMem.load()
+	ms.CStreams, ms.CStreamBytes = cstreamMem.load()
+	ms.DStreams, ms.DStreamBytes = dstreamMem.load()
+	ms.CDicts, ms.CDictBytes = cdictMem.load()
+	ms.DDicts, ms.DDictBytes = ddictMem.load()
+	return ms
+}
+
+// SetPoolMemoryLimit limits the C memory retained by the internal pools
+// of contexts and streams.
+//
+// Contexts and streams are released instead of returning them to the pools
+// while the total C memory reported by Stats exceeds maxBytes.
+// The already pooled objects are released by the GC as usual.
+// Call DrainPools for releasing them immediately.
+// Special value maxBytes=0 means 'no limit', which is the default.
+func SetPoolMemoryLimit(maxBytes int) {
+	atomic.StoreInt64(&poolMemoryLimit, int64(maxBytes))
+}
+
+var poolMemoryLimit int64
+
+// DrainPools releases the contexts and streams kept in the internal pools.
+//
+// The pooled objects unused during the last two garbage collection cycles
+// are released automatically, so DrainPools is needed only for returning
+// the C memory without waiting for the GC, for instance, after a burst of activity.
+//
+// DrainPools is best-effort: objects cached by other goroutines at the moment
+// of the call may remain in the pools until they are released by the GC.
+func DrainPools() {
+	forEachCPool(func(cp *cPool) {
+		cp.drain()
+	})
+}
+
+// memCounter accounts the number of live objects of a particular kind
+// and their size in bytes.
+type memCounter struct {
+	count int64
+	bytes int64
+}
+
+// track starts accounting new object with the given size.
+//
+// The accounted size of the object is stored in *memSize.
+func (mc *memCounter) track(memSize *int, size int) {
+	atomic.AddInt64(&mc.count, 1)
+	mc.update(memSize, size)
+}
+
+// update updates the accounted size of the object from *memSize to size.
+func (mc *memCounter) update(memSize *int, size int) {
+	if n := size - *memSize; n != 0 {
+		atomic.AddInt64(&mc.bytes, int64(n))
+		*memSize = size
+	}
+}
+
+// untrack stops accounting the object with the given *memSize.
+func (mc *memCounter) untrack(memSize *int) {
+	mc.update(memSize, 0)
+	atomic.AddInt64(&mc.count, -1)
+}
+
+func (mc *memCounter) load() (int64, int64) {
+	return atomic.LoadInt64(&mc.count), atomic.LoadInt64(&mc.bytes)
+}
+
+var (
+	cctxMem    memCounter
+	dctxMem    memCounter
+	cstreamMem memCounter
+	dstreamMem memCounter
+	cdictMem   memCounter
+	ddictMem   memCounter
+)
+
+func totalMemBytes() int64 {
+	return atomic.LoadInt64(&cctxMem.bytes) + atomic.LoadInt64(&dctxMem.bytes) +
+		atomic.LoadInt64(&cstreamMem.bytes) + atomic.LoadInt64(&dstreamMem.bytes) +
+		atomic.LoadInt64(&cdictMem.bytes) + atomic.LoadInt64(&ddictMem.bytes)
+}
+
+// memSizeRefreshInterval is the number of operations between updates
+// of the context size accounted in Stats.
+//
+// ZSTD_sizeof_* calls are expensive comparing to compression
+// and decompression of small blocks, while the context size
+// rarely changes after the first few operations.
+const memSizeRefreshInterval = 64
+
+// cPool is a pool of objects holding C memory.
+//
+// Unlike sync.Pool, it doesn't retain objects while the limit set
+// via SetPoolMemoryLimit is exceeded, and it may be drained via DrainPools.
+type cPool struct {
+	p sync.Pool
+}
+
+type pooledObject interface {
+	// Release releases the C memory occupied by the object.
+	Release()
+
+	// refreshMemSize updates the size of the object accounted in Stats.
+	refreshMemSize()
+}
+
+// newCPool returns new cPool.
+//
+// It must be called only for global pools, since the returned pool
+// is registered for DrainPools forever.
+func newCPool() *cPool {
+	cp := &cPool{}
+	cPoolsLock.Lock()
+	cPools = append(cPools, cp)
+	cPoolsLock.Unlock()
+	return cp
+}
+
+var (
+	cPoolsLock sync.Mutex
+	cPools     []*cPool
+)
+
+func forEachCPool(f func(cp *cPool)) {
+	cPoolsLock.Lock()
+	pools := append([]*cPool{}, cPools...)
+	cPoolsLock.Unlock()
+	for _, cp := range pools {
+		f(cp)
+	}
+}
+
+// Get returns an object from cp or nil if cp is empty.
+func (cp *cPool) Get() interface{} {
+	return cp.p.Get()
+}
+
+// Put returns v to cp or releases it if the pool memory limit is exceeded.
+func (cp *cPool) Put(v pooledObject) {
+	v.refreshMemSize()
+	if limit := atomic.LoadInt64(&poolMemoryLimit); limit > 0 && totalMemBytes() > limit {
+		v.Release()
+		return
+	}
+	cp.p.Put(v)
+}
+
+// drain releases the objects in cp, which are available to the current goroutine.
+func (cp *cPool) drain() {
+	for {
+		v := cp.p.Get()
+		if v == nil {
+			return
+		}
+		v.(pooledObject).Release()
+	}
+}
@@ -0,0 +1,187 @@
+package gozstd
+
+import (
+	"bytes"
+	"io/ioutil"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestStatsCompressorDecompressor(t *testing.T) {
+	c := NewCompressor()
+	d := NewDecompressor()
+	ms := Stats()
+	if ms.CCtxs < 1 || ms.DCtxs < 1 {
+		t.Fatalf("unexpected number of contexts; got CCtxs=%d, DCtxs=%d; want at least 1", ms.CCtxs, ms.DCtxs)
+	}
+	if ms.CCtxBytes < int64(c.memSize) || ms.DCtxBytes < int64(d.memSize) {
+		t.Fatalf("unexpected size of contexts; got CCtxBytes=%d, DCtxBytes=%d; want at least %d and %d",
+			ms.CCtxBytes, ms.DCtxBytes, c.memSize, d.memSize)
+	}
+
+	// Compressor allocates memory during the first call.
+	cMemSize := c.memSize
+	data := newTestDocument(128 * 1024)
+	cd, err := c.Compress(nil, data)
+	if err != nil {
+		t.Fatalf("cannot compress data: %s", err)
+	}
+	if _, err := d.Decompress(nil, cd); err != nil {
+		t.Fatalf("cannot decompress data: %s", err)
+	}
+	if c.memSize <= cMemSize {
+		t.Fatalf("expecting Compressor size growth after compression; got %d bytes; initial size %d bytes", c.memSize, cMemSize)
+	}
+	if d.memSize <= 0 {
+		t.Fatalf("unexpected Decompressor size; got %d bytes; want positive value", d.memSize)
+	}
+
+	c.Release()
+	d.Release()
+	if c.memSize != 0 || d.memSize != 0 {
+		t.Fatalf("unexpected size of released contexts; got %d and %d bytes; want 0", c.memSize, d.memSize)
+	}
+}
+
+func TestStatsWriterReader(t *testing.T) {
+	var bb bytes.Buffer
+	zw := NewWriter(&bb)
+	memSize := zw.memSize
+	if memSize < int(cstreamInBufSize+cstreamOutBufSize) {
+		t.Fatalf("Writer size must include buffers; got %d bytes; want at least %d bytes", memSize, cstreamInBufSize+cstreamOutBufSize)
+	}
+	data := newTestDocument(256 * 1024)
+	if _, err := zw.Write(data); err != nil {
+		t.Fatalf("cannot write data: %s", err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("cannot close Writer: %s", err)
+	}
+	if zw.memSize <= memSize {
+		t.Fatalf("expecting Writer size growth after compression; got %d bytes; initial size %d bytes", zw.memSize, memSize)
+	}
+	if ms := Stats(); ms.CStreams < 1 || ms.CStreamBytes < int64(zw.memSize) {
+		t.Fatalf("unexpected Writer stats; got CStreams=%d, CStreamBytes=%d; want at least 1 and %d", ms.CStreams, ms.CStreamBytes, zw.memSize)
+	}
+	zw.Release()
+	if zw.memSize != 0 {
+		t.Fatalf("unexpected size of released Writer; got %d bytes; want 0", zw.memSize)
+	}
+
+	zr := NewReader(&bb)
+	memSize = zr.memSize
+	if _, err := ioutil.ReadAll(zr); err != nil {
+		t.Fatalf("cannot read data: %s", err)
+	}
+	if zr.memSize <= memSize {
+		t.Fatalf("expecting Reader size growth after decompression; got %d bytes; initial size %d bytes", zr.memSize, memSize)
+	}
+	if ms := Stats(); ms.DStreams < 1 || ms.DStreamBytes < int64(zr.memSize) {
+		t.Fatalf("unexpected Reader stats; got DStreams=%d, DStreamBytes=%d; want at least 1 and %d", ms.DStreams, ms.DStreamBytes, zr.memSize)
+	}
+	zr.Release()
+	if zr.memSize != 0 {
+		t.Fatalf("unexpected size of released Reader; got %d bytes; want 0", zr.memSize)
+	}
+}
+
+func TestStatsDict(t *testing.T) {
+	dict := newTestDocument(16 * 1024)
+	cd, err := NewCDict(dict)
+	if err != nil {
+		t.Fatalf("cannot create CDict: %s", err)
+	}
+	dd, err := NewDDict(dict)
+	if err != nil {
+		t.Fatalf("cannot create DDict: %s", err)
+	}
+	if cd.memSize < len(dict) || dd.memSize < len(dict) {
+		t.Fatalf("dictionaries must include the dict copy; got CDict size %d bytes, DDict size %d bytes; want at least %d bytes",
+			cd.memSize, dd.memSize, len(dict))
+	}
+	ms := Stats()
+	if ms.CDicts < 1 || ms.CDictBytes < int64(cd.memSize) || ms.DDicts < 1 || ms.DDictBytes < int64(dd.memSize) {
+		t.Fatalf("unexpected dictionary stats: %+v", ms)
+	}
+	if n := ms.TotalBytes(); n < ms.CDictBytes+ms.DDictBytes {
+		t.Fatalf("unexpected total size; got %d bytes; want at least %d bytes", n, ms.CDictBytes+ms.DDictBytes)
+	}
+	cd.Release()
+	dd.Release()
+	if cd.memSize != 0 || dd.memSize != 0 {
+		t.Fatalf("unexpected size of released dictionaries; got %d and %d bytes; want 0", cd.memSize, dd.memSize)
+	}
+}
+
+func TestDrainPools(t *testing.T) {
+	DrainPools()
+	data := newTestDocument(64 * 1024)
+	ms := Stats()
+	cd := Compress(nil, data)
+	if _, err := Decompress(nil, cd); err != nil {
+		t.Fatalf("cannot decompress data: %s", err)
+	}
+	msPooled := Stats()
+	if msPooled.CCtxs <= ms.CCtxs || msPooled.DCtxs <= ms.DCtxs {
+		t.Fatalf("expecting pooled contexts; got CCtxs=%d, DCtxs=%d; want more than CCtxs=%d, DCtxs=%d",
+			msPooled.CCtxs, msPooled.DCtxs, ms.CCtxs, ms.DCtxs)
+	}
+	DrainPools()
+	msDrained := Stats()
+	if msDrained.CCtxs >= msPooled.CCtxs || msDrained.DCtxs >= msPooled.DCtxs || msDrained.TotalBytes() >= msPooled.TotalBytes() {
+		t.Fatalf("pooled contexts must be released by DrainPools; got CCtxs=%d, DCtxs=%d, TotalBytes=%d; want less than CCtxs=%d, DCtxs=%d, TotalBytes=%d",
+			msDrained.CCtxs, msDrained.DCtxs, msDrained.TotalBytes(), msPooled.CCtxs, msPooled.DCtxs, msPooled.TotalBytes())
+	}
+
+	// The pools must work after draining.
+	plainData, err := Decompress(nil, Compress(nil, data))
+	if err != nil {
+		t.Fatalf("cannot decompress data: %s", err)
+	}
+	if !bytes.Equal(plainData, data) {
+		t.Fatalf("unexpected data decompressed; got %d bytes; want %d bytes", len(plainData), len(data))
+	}
+}
+
+func TestSetPoolMemoryLimit(t *testing.T) {
+	SetPoolMemoryLimit(1)
+	defer SetPoolMemoryLimit(0)
+	DrainPools()
+
+	// Contexts must be released instead of pooling.
+	data := newTestDocument(64 * 1024)
+	ms := Stats()
+	for i := 0; i < 10; i++ {
+		cd := CompressLevel(nil, data, 5)
+		if _, err := Decompress(nil, cd); err != nil {
+			t.Fatalf("cannot decompress data: %s", err)
+		}
+	}
+	msLimited := Stats()
+	if msLimited.CCtxs > ms.CCtxs || msLimited.DCtxs > ms.DCtxs {
+		t.Fatalf("unexpected contexts retained in pools; got CCtxs=%d, DCtxs=%d; want at most CCtxs=%d, DCtxs=%d",
+			msLimited.CCtxs, msLimited.DCtxs, ms.CCtxs, ms.DCtxs)
+	}
+}
+
+func TestCPoolCleanupOnGC(t *testing.T) {
+	DrainPools()
+	data := newTestDocument(64 * 1024)
+	ms := Stats()
+	if _, err := Decompress(nil, Compress(nil, data)); err != nil {
+		t.Fatalf("cannot decompress data: %s", err)
+	}
+	if n := Stats().CCtxs; n <= ms.CCtxs {
+		t.Fatalf("expecting pooled contexts; got CCtxs=%d; want more than %d", n, ms.CCtxs)
+	}
+
+	// Unused pooled objects must be released after a few GC cycles.
+	for i := 0; i < 100 && Stats().CCtxs > ms.CCtxs; i++ {
+		runtime.GC()
+		time.Sleep(time.Millisecond)
+	}
+	if n := Stats().CCtxs; n > ms.CCtxs {
+		t.Fatalf("expecting released contexts after GC; got CCtxs=%d; want at most %d", n, ms.CCtxs)
+	}
+}
@@ -32,10 +32,36 @@ func StreamCompressDict(dst io.Writer, src io.Reader, cd *CDict) error {
 	return streamCompressDictLevel(dst, src, cd, 0)
 }
 
+// StreamCompressParams compresses src into dst using the given params.
+//
+// Set params.Workers for compressing src in parallel by multiple threads.
+//
+// This function doesn't work with interactive network streams, since data read
+// from src may be buffered before passing to dst for performance reasons.
+// Use Writer.Flush for interactive network streams.
+func StreamCompressParams(dst io.Writer, src io.Reader, params *WriterParams) error {
+	if params == nil {
+		params = &WriterParams{}
+	}
+	return streamCompressParams(dst, src, params)
+}
+
 func streamCompressDictLevel(dst io.Writer, src io.Reader, cd *CDict, compressionLevel int) error {
-	sc := getSCompressor(compressionLevel)
-	sc.zw.Reset(dst, cd, compressionLevel)
-	_, err := sc.zw.ReadFrom(src)
+	params := &WriterParams{
+		CompressionLevel: compressionLevel,
+		Dict:             cd,
+	}
+	return streamCompressParams(dst, src, params)
+}
+
+func streamCompressParams(dst io.Writer, src io.Reader, params *WriterParams) error {
+	sc := getSCompressor(params.CompressionLevel)
+	// The params are applied on every call, so pooled compressors
+	// may be shared among distinct params with the same compression level.
+	err := sc.zw.TryResetWriterParams(dst, params)
+	if err == nil {
+		_, err = sc.zw.ReadFrom(src)
+	}
 	if err == nil {
 		err = sc.zw.Close()
 	}
@@ -60,19 +86,29 @@ func getSCompressor(compressionLevel int) *sCompressor {
 	return v.(*sCompressor)
 }
 
+// Release releases sc.zw.
+func (sc *sCompressor) Release() {
+	sc.zw.Release()
+}
+
+func (sc *sCompressor) refreshMemSize() {
+	sc.zw.updateMemSize()
+}
+
 func putSCompressor(sc *sCompressor) {
+	// Drop the references to dst and params.Dict.
 	sc.zw.Reset(nil, nil, sc.compressionLevel)
 	p := getSCompressorPool(sc.compressionLevel)
 	p.Put(sc)
 }
 
-func getSCompressorPool(compressionLevel int) *sync.Pool {
+func getSCompressorPool(compressionLevel int) *cPool {
 	// Use per-level compressor pools, since Writer.Reset is expensive
 	// between distinct compression levels.
 	sCompressorPoolLock.Lock()
 	p := sCompressorPool[compressionLevel]
 	if p == nil {
-		p = &sync.Pool{}
+		p = newCPool()
 		sCompressorPool[compressionLevel] = p
 	}
 	sCompressorPoolLock.Unlock()
@@ -81,7 +117,7 @@ func getSCompressorPool(compressionLevel int) *sync.Pool {
 
 var (
 	sCompressorPoolLock sync.Mutex
-	sCompressorPool     = make(map[int]*sync.Pool)
+	sCompressorPool     = make(map[int]*cPool)
 )
 
 // StreamDecompress decompresses src into dst.
@@ -120,9 +156,18 @@ func getSDecompressor() *sDecompressor {
 	return v.(*sDecompressor)
 }
 
+// Release releases sd.zr.
+func (sd *sDecompressor) Release() {
+	sd.zr.Release()
+}
+
+func (sd *sDecompressor) refreshMemSize() {
+	sd.zr.updateMemSize()
+}
+
 func putSDecompressor(sd *sDecompressor) {
 	sd.zr.Reset(nil, nil)
 	sDecompressorPool.Put(sd)
 }
 
-var sDecompressorPool sync.Pool
+var sDecompressorPool = newCPool()
@@ -3,6 +3,7 @@ package gozstd
 import (
 	"bytes"
 	"fmt"
+	"io/ioutil"
 	"testing"
 	"time"
 )
@@ -188,3 +189,80 @@ func testStreamCompressDecompressDictSerial(cd *CDict, dd *DDict, data []byte) e
 	}
 	return nil
 }
+
+func TestStreamCompressParams(t *testing.T) {
+	var bbOrig bytes.Buffer
+	for bbOrig.Len() < 2*1024*1024 {
+		fmt.Fprintf(&bbOrig, "stream compress params data %d, ", bbOrig.Len())
+	}
+	src := bbOrig.Bytes()
+
+	for _, params := range []*WriterParams{
+		nil,
+		{CompressionLevel: 5},
+		{Workers: 2, JobSize: 512 * 1024},
+		{Workers: 4, EnableChecksum: true},
+	} {
+		var results [][]byte
+		for i := 0; i < 2; i++ {
+			var bb bytes.Buffer
+			if err := StreamCompressParams(&bb, bytes.NewReader(src), params); err != nil {
+				t.Fatalf("cannot compress data with params %+v: %s", params, err)
+			}
+			var bbDecompressed bytes.Buffer
+			if err := StreamDecompress(&bbDecompressed, &bb); err != nil {
+				t.Fatalf("cannot decompress data compressed with params %+v: %s", params, err)
+			}
+			if !bytes.Equal(bbDecompressed.Bytes(), src) {
+				t.Fatalf("unexpected data decompressed for params %+v", params)
+			}
+			results = append(results, bb.Bytes())
+		}
+		if !bytes.Equal(results[0], results[1]) {
+			t.Fatalf("compressed output differs between runs for params %+v", params)
+		}
+	}
+
+	if err := StreamCompressParams(ioutil.Discard, bytes.NewReader(src), &WriterParams{HashLog: 100}); err == nil {
+		t.Fatalf("expecting error for invalid params")
+	}
+}
+
+func TestStreamCompressParamsPerLevelPools(t *testing.T) {
+	data := []byte(newTestString(1024, 3))
+	for level := 0; level < 10; level++ {
+		StreamCompressParams(ioutil.Discard, bytes.NewReader(data), &WriterParams{
+			CompressionLevel: level,
+		})
+	}
+
+	cPoolsLock.Lock()
+	poolsCount := len(cPools)
+	cPoolsLock.Unlock()
+
+	// Distinct params with the same compression levels mustn't create distinct pools.
+	for i := 0; i < 100; i++ {
+		params := &WriterParams{
+			CompressionLevel: i % 10,
+			SrcSizeHint:      1000 + i,
+		}
+		var bb bytes.Buffer
+		if err := StreamCompressParams(&bb, bytes.NewReader(data), params); err != nil {
+			t.Fatalf("cannot compress data with params %+v: %s", params, err)
+		}
+		plainData, err := Decompress(nil, bb.Bytes())
+		if err != nil {
+			t.Fatalf("cannot decompress data: %s", err)
+		}
+		if !bytes.Equal(plainData, data) {
+			t.Fatalf("unexpected data decompressed for params %+v", params)
+		}
+	}
+
+	cPoolsLock.Lock()
+	n := len(cPools)
+	cPoolsLock.Unlock()
+	if n != poolsCount {
+		t.Fatalf("unexpected number of pools; got %d; want %d", n, poolsCount)
+	}
+}
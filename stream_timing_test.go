@@ -34,6 +34,32 @@ func benchmarkStreamCompress(b *testing.B, blockSize, level int) {
 	})
 }
 
+func BenchmarkStreamCompressMixedLevels(b *testing.B) {
+	for _, blockSize := range benchBlockSizes {
+		b.Run(fmt.Sprintf("blockSize_%d", blockSize), func(b *testing.B) {
+			benchmarkStreamCompressMixedLevels(b, blockSize)
+		})
+	}
+}
+
+func benchmarkStreamCompressMixedLevels(b *testing.B, blockSize int) {
+	block := newBenchString(blockSize * benchBlocksPerStream)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(block)))
+	b.RunParallel(func(pb *testing.PB) {
+		r := bytes.NewReader(block)
+		n := 0
+		for pb.Next() {
+			level := benchCompressionLevels[n%len(benchCompressionLevels)]
+			if err := StreamCompressLevel(ioutil.Discard, r, level); err != nil {
+				panic(fmt.Errorf("unexpected error: %s", err))
+			}
+			r.Reset(block)
+			n++
+		}
+	})
+}
+
 func BenchmarkStreamDecompress(b *testing.B) {
 	for _, blockSize := range benchBlockSizes {
 		b.Run(fmt.Sprintf("blockSize_%d", blockSize), func(b *testing.B) {
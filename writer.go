@@ -18,14 +18,18 @@ static size_t ZSTD_CCtx_setParameter_wrapper(uintptr_t cs, ZSTD_cParameter param
     return ZSTD_CCtx_setParameter((ZSTD_CStream*)cs, param, value);
 }
 
-static size_t ZSTD_initCStream_wrapper(uintptr_t cs, int compressionLevel) {
-    return ZSTD_initCStream((ZSTD_CStream*)cs, compressionLevel);
+static size_t ZSTD_CCtx_reset_wrapper(uintptr_t cs, ZSTD_ResetDirective reset) {
+    return ZSTD_CCtx_reset((ZSTD_CStream*)cs, reset);
 }
 
 static size_t ZSTD_CCtx_refCDict_wrapper(uintptr_t cc, uintptr_t dict) {
     return ZSTD_CCtx_refCDict((ZSTD_CCtx*)cc, (ZSTD_CDict*)dict);
 }
 
+static size_t ZSTD_CCtx_refPrefix_wrapper(uintptr_t cc, uintptr_t prefix, size_t prefixSize) {
+    return ZSTD_CCtx_refPrefix((ZSTD_CCtx*)cc, (const void*)prefix, prefixSize);
+}
+
 static size_t ZSTD_freeCStream_wrapper(uintptr_t cs) {
     return ZSTD_freeCStream((ZSTD_CStream*)cs);
 }
@@ -61,17 +65,29 @@ type cMemPtr *[1 << 30]byte
 
 // Writer implements zstd writer.
 type Writer struct {
-	w                io.Writer
-	compressionLevel int
-	wlog             int
-	cs               *C.ZSTD_CStream
-	cd               *CDict
+	w      io.Writer
+	params WriterParams
+	cs     *C.ZSTD_CStream
+	err    error
+
+	// frameStarted is set when data has been written to the current frame.
+	frameStarted bool
+
+	// prefix is the prefix set via SetPrefix.
+	prefix prefixBuf
 
 	inBuf  *C.ZSTD_inBuffer
 	outBuf *C.ZSTD_outBuffer
 
 	inBufGo  cMemPtr
 	outBufGo cMemPtr
+
+	// memSize is the size of zw accounted in Stats.
+	memSize int
+
+	// patchDict is the dictionary created by NewPatchWriter.
+	// It is released together with zw.
+	patchDict *CDict
 }
 
 // NewWriter returns new zstd writer writing compressed data to w.
@@ -138,19 +154,188 @@ type WriterParams struct {
 	//
 	// Note: enabling log distance matching increases memory usage for both
 	// compressor and decompressor. When set to a value greater than 27, the
-	// decompressor requires special treatment.
+	// decompressor requires special treatment - see ReaderParams.WindowLogMax.
 	WindowLog int
 
 	// Dict is optional dictionary used for compression.
 	Dict *CDict
+
+	// DictAttachPref controls how Dict contents is used by the compressor.
+	DictAttachPref DictAttachPref
+
+	// The following parameters tune the compression.
+	// Special value 0 means 'use the default value', which depends
+	// on CompressionLevel and on the size of the compressed data if it is known.
+	// Non-zero values override the values selected via CompressionLevel.
+	// See ZSTD_cParameter description in zstd.h for details.
+	//
+	// All the parameters except CompressionLevel are validated against
+	// the bounds supported by zstd.
+	//
+	// These parameters are superseded by the parameters of Dict if it is set.
+
+	// Strategy is compression strategy.
+	Strategy Strategy
+
+	// HashLog is the size of the initial probe table, as a power of 2.
+	HashLog int
+
+	// ChainLog is the size of the multi-probe search table, as a power of 2.
+	ChainLog int
+
+	// SearchLog is the number of search attempts, as a power of 2.
+	SearchLog int
+
+	// MinMatch is the minimum size of searched matches.
+	MinMatch int
+
+	// TargetLength impact depends on Strategy.
+	TargetLength int
+
+	// TargetCBlockSize is the approximate target size for compressed blocks.
+	TargetCBlockSize int
+
+	// SrcSizeHint is the guess of the size of the compressed data.
+	SrcSizeHint int
+
+	// LiteralCompressionMode controls the compression of literals.
+	LiteralCompressionMode ParamSwitch
+
+	// LongDistanceMatching controls long distance matching, which improves
+	// compression ratio for big inputs with matches at long distances.
+	// It increases memory usage and the default WindowLog.
+	LongDistanceMatching ParamSwitch
+
+	// LDMHashLog is the size of the table for long distance matching, as a power of 2.
+	LDMHashLog int
+
+	// LDMMinMatch is the minimum match size for long distance matcher.
+	LDMMinMatch int
+
+	// LDMBucketSizeLog is the log size of each bucket in the LDM hash table.
+	LDMBucketSizeLog int
+
+	// LDMHashRateLog is the frequency of inserting/looking up entries
+	// into the LDM hash table.
+	LDMHashRateLog int
+
+	// EnableChecksum enables writing 32-bit checksum of the original data
+	// at the end of every frame. The checksum is verified during decompression.
+	EnableChecksum bool
+
+	// DisableContentSize disables writing the original data size
+	// into frame headers when the size is known.
+	DisableContentSize bool
+
+	// DisableDictID disables writing the dictionary ID into frame headers.
+	DisableDictID bool
+
+	// Workers is the number of threads spawned for compressing the data
+	// in parallel. Special value 0 means 'compress in the calling goroutine'.
+	//
+	// Write, ReadFrom and Flush calls become non-blocking when Workers > 0:
+	// the data is passed to worker threads, while the compressed data
+	// is written to the underlying writer as soon as it is ready.
+	// The compressed output is identical for all the Workers > 0.
+	//
+	// Multithreading requires libzstd built with ZSTD_MULTITHREAD.
+	// The bundled libzstd for linux/amd64 supports it, while the bundled
+	// libzstd for freebsd/amd64, illumos/amd64 and windows/amd64 doesn't.
+	// Workers, JobSize and OverlapLog are ignored on platforms without
+	// multithreading support, i.e. when MaxWorkers returns 0, so the data
+	// is compressed in the calling goroutine there.
+	Workers int
+
+	// JobSize is the size of the data compressed by every worker thread
+	// when Workers > 0. Special value 0 means 'automatic job size'.
+	JobSize int
+
+	// OverlapLog controls the size of data reloaded from the previous job
+	// when Workers > 0. It is expressed as a fraction of window size:
+	// 9 means 'full window', 8 means 'half window', etc. down to 1.
+	// Special value 0 means 'default overlap'.
+	OverlapLog int
+
+	// Format is the format of the produced frames.
+	//
+	// Frames in FormatZstd1Magicless can be decompressed only
+	// with ReaderParams.Format set to the same value.
+	Format Format
 }
 
+// Strategy is compression strategy.
+//
+// Strategies are listed from the fastest to the strongest.
+type Strategy int
+
+// The supported compression strategies.
+const (
+	StrategyDefault  Strategy = 0
+	StrategyFast     Strategy = 1 // from zstd.h
+	StrategyDFast    Strategy = 2 // from zstd.h
+	StrategyGreedy   Strategy = 3 // from zstd.h
+	StrategyLazy     Strategy = 4 // from zstd.h
+	StrategyLazy2    Strategy = 5 // from zstd.h
+	StrategyBTLazy2  Strategy = 6 // from zstd.h
+	StrategyBTOpt    Strategy = 7 // from zstd.h
+	StrategyBTUltra  Strategy = 8 // from zstd.h
+	StrategyBTUltra2 Strategy = 9 // from zstd.h
+)
+
+// DictAttachPref controls how CDict contents is used by the compressor.
+type DictAttachPref int
+
+// The supported DictAttachPref values.
+const (
+	// DictAttachDefault lets zstd choose between DictAttachForceAttach
+	// and DictAttachForceCopy depending on the size of the compressed data.
+	DictAttachDefault DictAttachPref = 0 // from zstd.h
+	// DictAttachForceAttach uses CDict tables in place.
+	DictAttachForceAttach DictAttachPref = 1 // from zstd.h
+	// DictAttachForceCopy copies CDict tables into the working context.
+	DictAttachForceCopy DictAttachPref = 2 // from zstd.h
+	// DictAttachForceLoad re-indexes CDict contents with the working context
+	// parameters, including long distance matching. This is the slowest mode,
+	// which may give the best compression ratio for big dictionaries.
+	DictAttachForceLoad DictAttachPref = 3 // from zstd.h
+)
+
+// ParamSwitch controls optional zstd features.
+type ParamSwitch int
+
+// The supported ParamSwitch values.
+const (
+	// ParamSwitchAuto lets zstd decide whether to enable the feature.
+	ParamSwitchAuto ParamSwitch = 0 // from zstd.h
+	// ParamSwitchEnable force-enables the feature.
+	ParamSwitchEnable ParamSwitch = 1 // from zstd.h
+	// ParamSwitchDisable disables the feature.
+	ParamSwitchDisable ParamSwitch = 2 // from zstd.h
+)
+
+// Format is zstd frame format.
+type Format int
+
+// The supported frame formats.
+const (
+	// FormatZstd1 is the standard zstd frame format.
+	FormatZstd1 Format = 0 // from zstd.h
+	// FormatZstd1Magicless is the standard zstd frame format without
+	// the initial 4-byte magic number. It saves 4 bytes per frame,
+	// but such frames cannot be recognized by other zstd decoders.
+	FormatZstd1Magicless Format = 1 // from zstd.h
+)
+
 // NewWriterParams returns new zstd writer writing compressed data to w
 // using the given set of parameters.
 //
 // The returned writer must be closed with Close call in order
 // to finalize the compressed stream.
 //
+// Invalid params are reported by the first Write, ReadFrom, Flush or Close
+// call on the returned writer. Use TryNewWriterParams if params must be
+// validated when creating the writer.
+//
 // Call Release when the Writer is no longer needed.
 func NewWriterParams(w io.Writer, params *WriterParams) *Writer {
 	if params == nil {
@@ -158,7 +343,7 @@ func NewWriterParams(w io.Writer, params *WriterParams) *Writer {
 	}
 
 	cs := C.ZSTD_createCStream()
-	initCStream(cs, *params)
+	err := initCStream(cs, *params)
 
 	inBuf := (*C.ZSTD_inBuffer)(C.calloc(1, C.sizeof_ZSTD_inBuffer))
 	inBuf.src = C.calloc(1, cstreamInBufSize)
@@ -171,65 +356,192 @@ func NewWriterParams(w io.Writer, params *WriterParams) *Writer {
 	outBuf.pos = 0
 
 	zw := &Writer{
-		w:                w,
-		compressionLevel: params.CompressionLevel,
-		wlog:             params.WindowLog,
-		cs:               cs,
-		cd:               params.Dict,
-		inBuf:            inBuf,
-		outBuf:           outBuf,
+		w:      w,
+		params: *params,
+		cs:     cs,
+		err:    err,
+		inBuf:  inBuf,
+		outBuf: outBuf,
 	}
 
 	zw.inBufGo = cMemPtr(zw.inBuf.src)
 	zw.outBufGo = cMemPtr(zw.outBuf.dst)
 
+	cstreamMem.track(&zw.memSize, zw.sizeOf())
 	runtime.SetFinalizer(zw, freeCStream)
 	return zw
 }
 
+// TryNewWriterParams returns new zstd writer writing compressed data to w
+// using the given set of parameters.
+//
+// Unlike NewWriterParams, it returns an error if params are invalid.
+//
+// Call Release when the Writer is no longer needed.
+func TryNewWriterParams(w io.Writer, params *WriterParams) (*Writer, error) {
+	zw := NewWriterParams(w, params)
+	if zw.err != nil {
+		err := zw.err
+		zw.Release()
+		return nil, err
+	}
+	return zw, nil
+}
+
 // Reset resets zw to write to w using the given dictionary cd and the given
 // compressionLevel. Use ResetWriterParams if you wish to change other
 // parameters that were set via WriterParams.
+//
+// Errors are reported by subsequent Write, ReadFrom, Flush and Close calls.
 func (zw *Writer) Reset(w io.Writer, cd *CDict, compressionLevel int) {
-	params := WriterParams{
-		CompressionLevel: compressionLevel,
-		WindowLog:        zw.wlog,
-		Dict:             cd,
-	}
+	params := zw.params
+	params.CompressionLevel = compressionLevel
+	params.Dict = cd
 	zw.ResetWriterParams(w, &params)
 }
 
 // ResetWriterParams resets zw to write to w using the given set of parameters.
+//
+// Errors are reported by subsequent Write, ReadFrom, Flush and Close calls.
+// Use TryResetWriterParams if the error must be returned immediately.
 func (zw *Writer) ResetWriterParams(w io.Writer, params *WriterParams) {
+	zw.TryResetWriterParams(w, params)
+}
+
+// TryResetWriterParams resets zw to write to w using the given set of parameters.
+//
+// An error is returned if params are invalid. The same error is returned
+// by subsequent Write, ReadFrom, Flush and Close calls until the next
+// successful reset.
+func (zw *Writer) TryResetWriterParams(w io.Writer, params *WriterParams) error {
 	zw.inBuf.size = 0
 	zw.inBuf.pos = 0
 	zw.outBuf.size = cstreamOutBufSize
 	zw.outBuf.pos = 0
 
-	zw.cd = params.Dict
-	initCStream(zw.cs, *params)
+	zw.params = *params
+	zw.err = initCStream(zw.cs, zw.params)
+	zw.frameStarted = false
 
 	zw.w = w
+	return zw.err
 }
 
-func initCStream(cs *C.ZSTD_CStream, params WriterParams) {
+func initCStream(cs *C.ZSTD_CStream, params WriterParams) error {
+	result := C.ZSTD_CCtx_reset_wrapper(
+		C.uintptr_t(uintptr(unsafe.Pointer(cs))),
+		C.ZSTD_reset_session_and_parameters)
+	if C.ZSTD_getErrorCode(result) != 0 {
+		return fmt.Errorf("cannot reset compressor: %w", newError(result))
+	}
+
 	if params.Dict != nil {
+		if params.Dict.p == nil {
+			return errReleasedCDict
+		}
 		result := C.ZSTD_CCtx_refCDict_wrapper(
 			C.uintptr_t(uintptr(unsafe.Pointer(cs))),
 			C.uintptr_t(uintptr(unsafe.Pointer(params.Dict.p))))
-		ensureNoError("ZSTD_CCtx_refCDict", result)
+		if C.ZSTD_getErrorCode(result) != 0 {
+			return fmt.Errorf("cannot use CDict: %w", newError(result))
+		}
 	} else {
-		result := C.ZSTD_initCStream_wrapper(
+		// Do not validate the compression level, since zstd clamps it
+		// to the supported range.
+		result := C.ZSTD_CCtx_setParameter_wrapper(
 			C.uintptr_t(uintptr(unsafe.Pointer(cs))),
+			C.ZSTD_c_compressionLevel,
 			C.int(params.CompressionLevel))
-		ensureNoError("ZSTD_initCStream", result)
+		if C.ZSTD_getErrorCode(result) != 0 {
+			return fmt.Errorf("cannot set CompressionLevel=%d: %w", params.CompressionLevel, newError(result))
+		}
 	}
 
+	// Multithreading parameters are ignored if libzstd doesn't support them.
+	// See WriterParams.Workers for details.
+	mtSupported := (params.Workers != 0 || params.JobSize != 0 || params.OverlapLog != 0) && MaxWorkers() > 0
+
+	// All the parameters are set to default values after the reset above,
+	// so set only the parameters with non-default values.
+	cParams := [...]struct {
+		name  string
+		param C.ZSTD_cParameter
+		value int
+		set   bool
+	}{
+		{"WindowLog", C.ZSTD_c_windowLog, params.WindowLog, params.WindowLog != 0},
+		{"DictAttachPref", C.ZSTD_c_forceAttachDict, int(params.DictAttachPref), params.DictAttachPref != 0},
+		{"Strategy", C.ZSTD_c_strategy, int(params.Strategy), params.Strategy != 0},
+		{"HashLog", C.ZSTD_c_hashLog, params.HashLog, params.HashLog != 0},
+		{"ChainLog", C.ZSTD_c_chainLog, params.ChainLog, params.ChainLog != 0},
+		{"SearchLog", C.ZSTD_c_searchLog, params.SearchLog, params.SearchLog != 0},
+		{"MinMatch", C.ZSTD_c_minMatch, params.MinMatch, params.MinMatch != 0},
+		{"TargetLength", C.ZSTD_c_targetLength, params.TargetLength, params.TargetLength != 0},
+		{"TargetCBlockSize", C.ZSTD_c_targetCBlockSize, params.TargetCBlockSize, params.TargetCBlockSize != 0},
+		{"SrcSizeHint", C.ZSTD_c_srcSizeHint, params.SrcSizeHint, params.SrcSizeHint != 0},
+		{"LiteralCompressionMode", C.ZSTD_c_literalCompressionMode, int(params.LiteralCompressionMode), params.LiteralCompressionMode != 0},
+		{"LongDistanceMatching", C.ZSTD_c_enableLongDistanceMatching, int(params.LongDistanceMatching), params.LongDistanceMatching != 0},
+		{"LDMHashLog", C.ZSTD_c_ldmHashLog, params.LDMHashLog, params.LDMHashLog != 0},
+		{"LDMMinMatch", C.ZSTD_c_ldmMinMatch, params.LDMMinMatch, params.LDMMinMatch != 0},
+		{"LDMBucketSizeLog", C.ZSTD_c_ldmBucketSizeLog, params.LDMBucketSizeLog, params.LDMBucketSizeLog != 0},
+		{"LDMHashRateLog", C.ZSTD_c_ldmHashRateLog, params.LDMHashRateLog, params.LDMHashRateLog != 0},
+		{"EnableChecksum", C.ZSTD_c_checksumFlag, 1, params.EnableChecksum},
+		{"DisableContentSize", C.ZSTD_c_contentSizeFlag, 0, params.DisableContentSize},
+		{"DisableDictID", C.ZSTD_c_dictIDFlag, 0, params.DisableDictID},
+		{"Workers", C.ZSTD_c_nbWorkers, params.Workers, mtSupported && params.Workers != 0},
+		{"JobSize", C.ZSTD_c_jobSize, params.JobSize, mtSupported && params.JobSize != 0},
+		{"OverlapLog", C.ZSTD_c_overlapLog, params.OverlapLog, mtSupported && params.OverlapLog != 0},
+		{"Format", C.ZSTD_c_format, int(params.Format), params.Format != 0},
+	}
+	for _, p := range cParams {
+		if !p.set {
+			continue
+		}
+		if err := setCStreamParameter(cs, p.name, p.param, p.value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func setCStreamParameter(cs *C.ZSTD_CStream, name string, param C.ZSTD_cParameter, value int) error {
+	if err := checkCParamBounds(name, param, value); err != nil {
+		return err
+	}
 	result := C.ZSTD_CCtx_setParameter_wrapper(
 		C.uintptr_t(uintptr(unsafe.Pointer(cs))),
-		C.ZSTD_cParameter(C.ZSTD_c_windowLog),
-		C.int(params.WindowLog))
-	ensureNoError("ZSTD_CCtx_setParameter", result)
+		param,
+		C.int(value))
+	if C.ZSTD_getErrorCode(result) != 0 {
+		return fmt.Errorf("cannot set %s=%d: %w", name, value, newError(result))
+	}
+	return nil
+}
+
+// MaxWorkers returns the maximum value for WriterParams.Workers.
+//
+// It returns 0 if the bundled libzstd for the current platform
+// is built without multithreading support. WriterParams.Workers
+// is ignored in this case.
+func MaxWorkers() int {
+	bounds := C.ZSTD_cParam_getBounds(C.ZSTD_c_nbWorkers)
+	if C.ZSTD_getErrorCode(bounds.error) != 0 {
+		return 0
+	}
+	return int(bounds.upperBound)
+}
+
+// checkCParamBounds verifies whether the value is in the range supported by zstd for the given param.
+func checkCParamBounds(name string, param C.ZSTD_cParameter, value int) error {
+	bounds := C.ZSTD_cParam_getBounds(param)
+	if C.ZSTD_getErrorCode(bounds.error) != 0 {
+		return fmt.Errorf("cannot set %s=%d: %w", name, value, newError(bounds.error))
+	}
+	if value < int(bounds.lowerBound) || value > int(bounds.upperBound) {
+		return fmt.Errorf("invalid %s=%d; it must be in the range [%d..%d]: %w",
+			name, value, bounds.lowerBound, bounds.upperBound, ErrParameterOutOfBound)
+	}
+	return nil
 }
 
 func freeCStream(v interface{}) {
@@ -257,8 +569,29 @@ func (zw *Writer) Release() {
 	C.free(unsafe.Pointer(zw.outBuf))
 	zw.outBuf = nil
 
+	zw.prefix.free()
+
+	if zw.patchDict != nil {
+		zw.patchDict.Release()
+		zw.patchDict = nil
+	}
+
 	zw.w = nil
-	zw.cd = nil
+	zw.params = WriterParams{}
+	zw.err = nil
+
+	cstreamMem.untrack(&zw.memSize)
+}
+
+// sizeOf returns the size of C memory occupied by zw.
+func (zw *Writer) sizeOf() int {
+	return int(C.ZSTD_sizeof_CStream(zw.cs) + cstreamInBufSize + cstreamOutBufSize + zw.prefix.cap)
+}
+
+// updateMemSize updates the size of zw accounted in Stats,
+// since zstd allocates memory lazily during the compression.
+func (zw *Writer) updateMemSize() {
+	cstreamMem.update(&zw.memSize, zw.sizeOf())
 }
 
 // ReadFrom reads all the data from r and writes it to zw.
@@ -270,6 +603,9 @@ func (zw *Writer) Release() {
 // Call Flush or Close when the compressed data must propagate
 // to the underlying writer.
 func (zw *Writer) ReadFrom(r io.Reader) (int64, error) {
+	if zw.err != nil {
+		return 0, zw.err
+	}
 	nn := int64(0)
 	for {
 		// Fill the inBuf.
@@ -280,6 +616,9 @@ func (zw *Writer) ReadFrom(r io.Reader) (int64, error) {
 			// This is true especially if the error is io.EOF.
 			zw.inBuf.size += C.size_t(n)
 			nn += int64(n)
+			if n > 0 {
+				zw.frameStarted = true
+			}
 
 			if err != nil {
 				if err == io.EOF {
@@ -307,6 +646,10 @@ func (zw *Writer) Write(p []byte) (int, error) {
 	if pLen == 0 {
 		return 0, nil
 	}
+	if zw.err != nil {
+		return 0, zw.err
+	}
+	zw.frameStarted = true
 
 	for {
 		n := copy(zw.inBufGo[zw.inBuf.size:cstreamInBufSize], p)
@@ -328,7 +671,10 @@ func (zw *Writer) flushInBuf() error {
 		C.uintptr_t(uintptr(unsafe.Pointer(zw.cs))),
 		C.uintptr_t(uintptr(unsafe.Pointer(zw.outBuf))),
 		C.uintptr_t(uintptr(unsafe.Pointer(zw.inBuf))))
-	ensureNoError("ZSTD_compressStream", result)
+	if C.ZSTD_getErrorCode(result) != 0 {
+		zw.err = fmt.Errorf("cannot compress data: %w", newError(result))
+		return zw.err
+	}
 
 	// Move the remaining data to the start of inBuf.
 	copy(zw.inBufGo[:cstreamInBufSize], zw.inBufGo[zw.inBuf.pos:zw.inBuf.size])
@@ -356,7 +702,7 @@ func (zw *Writer) flushOutBuf() error {
 	n, err := zw.w.Write(outBuf)
 	zw.outBuf.pos = 0
 	if err != nil {
-		return fmt.Errorf("cannot flush internal buffer to the underlying writer: %s", err)
+		return fmt.Errorf("cannot flush internal buffer to the underlying writer: %w", err)
 	}
 	if n != len(outBuf) {
 		panic(fmt.Errorf("BUG: the underlying writer violated io.Writer contract and didn't return error after writing incomplete data; written %d bytes; want %d bytes",
@@ -367,6 +713,10 @@ func (zw *Writer) flushOutBuf() error {
 
 // Flush flushes the remaining data from zw to the underlying writer.
 func (zw *Writer) Flush() error {
+	if zw.err != nil {
+		return zw.err
+	}
+
 	// Flush inBuf.
 	for zw.inBuf.size > 0 {
 		if err := zw.flushInBuf(); err != nil {
@@ -379,7 +729,10 @@ func (zw *Writer) Flush() error {
 		result := C.ZSTD_flushStream_wrapper(
 			C.uintptr_t(uintptr(unsafe.Pointer(zw.cs))),
 			C.uintptr_t(uintptr(unsafe.Pointer(zw.outBuf))))
-		ensureNoError("ZSTD_flushStream", result)
+		if C.ZSTD_getErrorCode(result) != 0 {
+			zw.err = fmt.Errorf("cannot flush compressed data: %w", newError(result))
+			return zw.err
+		}
 		if err := zw.flushOutBuf(); err != nil {
 			return err
 		}
@@ -403,12 +756,80 @@ func (zw *Writer) Close() error {
 		result := C.ZSTD_endStream_wrapper(
 			C.uintptr_t(uintptr(unsafe.Pointer(zw.cs))),
 			C.uintptr_t(uintptr(unsafe.Pointer(zw.outBuf))))
-		ensureNoError("ZSTD_endStream", result)
+		if C.ZSTD_getErrorCode(result) != 0 {
+			zw.err = fmt.Errorf("cannot finalize compressed stream: %w", newError(result))
+			return zw.err
+		}
 		if err := zw.flushOutBuf(); err != nil {
 			return err
 		}
 		if result == 0 {
+			zw.frameStarted = false
+			zw.updateMemSize()
 			return nil
 		}
 	}
 }
+
+// WriteSkippableFrame writes skippable frame with the given magicVariant
+// and payload to the underlying writer.
+//
+// The current frame is finalized with Close if some data has been written
+// to it, so the skippable frame is put between regular frames.
+// Subsequent writes start a new frame.
+//
+// See WriteSkippableFrame function for details.
+func (zw *Writer) WriteSkippableFrame(magicVariant uint32, payload []byte) error {
+	if zw.err != nil {
+		return zw.err
+	}
+	if zw.frameStarted {
+		if err := zw.Close(); err != nil {
+			return err
+		}
+	}
+
+	frame, err := WriteSkippableFrame(nil, magicVariant, payload)
+	if err != nil {
+		return err
+	}
+	if _, err := zw.w.Write(frame); err != nil {
+		return fmt.Errorf("cannot write skippable frame to the underlying writer: %w", err)
+	}
+	return nil
+}
+
+// SetPrefix sets the prefix for the next frame written by zw.
+//
+// The prefix is used as a one-off raw-content dictionary until the frame
+// is finalized with Close. Subsequent frames are compressed without the prefix
+// unless SetPrefix is called again. An empty prefix removes the previously
+// set prefix. The same prefix must be passed to Reader.SetPrefix
+// when reading the frame.
+//
+// SetPrefix must be called before writing data to the frame, i.e. after
+// New*, Reset* or Close calls. It cannot be used together with WriterParams.Dict.
+//
+// The prefix is copied, so it may be modified after the call.
+func (zw *Writer) SetPrefix(prefix []byte) error {
+	if zw.err != nil {
+		return zw.err
+	}
+	if zw.frameStarted {
+		return fmt.Errorf("cannot set prefix in the middle of the frame; call Close before SetPrefix")
+	}
+	if zw.params.Dict != nil {
+		return fmt.Errorf("cannot set prefix when WriterParams.Dict is set")
+	}
+
+	zw.prefix.set(prefix)
+	zw.updateMemSize()
+	result := C.ZSTD_CCtx_refPrefix_wrapper(
+		C.uintptr_t(uintptr(unsafe.Pointer(zw.cs))),
+		C.uintptr_t(uintptr(zw.prefix.p)),
+		zw.prefix.size)
+	if C.ZSTD_getErrorCode(result) != 0 {
+		return fmt.Errorf("cannot set prefix: %w", newError(result))
+	}
+	return nil
+}
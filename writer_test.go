@@ -3,12 +3,14 @@ package gozstd
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"math/rand"
 	"strings"
 	"testing"
+	"testing/iotest"
 	"time"
 )
 
@@ -272,6 +274,257 @@ func TestWriterResetWriterParams(t *testing.T) {
 	}
 }
 
+func TestWriterAdvancedParams(t *testing.T) {
+	src := []byte(newTestString(256*1024, 3))
+	for _, params := range []*WriterParams{
+		{Strategy: StrategyFast},
+		{Strategy: StrategyBTUltra2, CompressionLevel: 1},
+		{Strategy: StrategyLazy2, HashLog: 16, ChainLog: 17, SearchLog: 3, MinMatch: 5, TargetLength: 32},
+		{TargetCBlockSize: 2048},
+		{SrcSizeHint: len(src)},
+		{LiteralCompressionMode: ParamSwitchDisable},
+		{LiteralCompressionMode: ParamSwitchEnable},
+		{LongDistanceMatching: ParamSwitchEnable, WindowLog: 20, LDMHashLog: 16, LDMMinMatch: 32, LDMBucketSizeLog: 4, LDMHashRateLog: 4},
+		{LongDistanceMatching: ParamSwitchDisable},
+		{EnableChecksum: true, DisableContentSize: true, DisableDictID: true},
+	} {
+		var bb bytes.Buffer
+		zw := NewWriterParams(&bb, params)
+		if _, err := zw.Write(src); err != nil {
+			t.Fatalf("cannot write data with params %+v: %s", params, err)
+		}
+		if err := zw.Close(); err != nil {
+			t.Fatalf("cannot close zw with params %+v: %s", params, err)
+		}
+		zw.Release()
+
+		plainData, err := Decompress(nil, bb.Bytes())
+		if err != nil {
+			t.Fatalf("cannot decompress data compressed with params %+v: %s", params, err)
+		}
+		if !bytes.Equal(plainData, src) {
+			t.Fatalf("unexpected data decompressed with params %+v", params)
+		}
+	}
+}
+
+func TestWriterInvalidAdvancedParams(t *testing.T) {
+	for _, params := range []*WriterParams{
+		{Strategy: 100},
+		{HashLog: 1},
+		{ChainLog: 100},
+		{SearchLog: -1},
+		{MinMatch: 100},
+		{TargetCBlockSize: 1},
+		{SrcSizeHint: -1},
+		{LiteralCompressionMode: 10},
+		{LongDistanceMatching: 10},
+		{LDMHashLog: 100},
+		{LDMMinMatch: 1},
+		{LDMBucketSizeLog: 100},
+		{LDMHashRateLog: 100},
+	} {
+		zw := NewWriterParams(ioutil.Discard, params)
+		if _, err := zw.Write([]byte("foobar")); !errors.Is(err, ErrParameterOutOfBound) {
+			t.Fatalf("unexpected error for params %+v; got %v; want %v", params, err, ErrParameterOutOfBound)
+		}
+		if err := zw.TryResetWriterParams(ioutil.Discard, params); !errors.Is(err, ErrParameterOutOfBound) {
+			t.Fatalf("unexpected error in TryResetWriterParams for params %+v; got %v; want %v", params, err, ErrParameterOutOfBound)
+		}
+		zw.Release()
+
+		zw, err := TryNewWriterParams(ioutil.Discard, params)
+		if !errors.Is(err, ErrParameterOutOfBound) {
+			t.Fatalf("unexpected error in TryNewWriterParams for params %+v; got %v; want %v", params, err, ErrParameterOutOfBound)
+		}
+		if zw != nil {
+			t.Fatalf("expecting nil Writer for invalid params %+v", params)
+		}
+	}
+}
+
+func TestWriterChecksum(t *testing.T) {
+	var bb bytes.Buffer
+	zw := NewWriterParams(&bb, &WriterParams{
+		EnableChecksum: true,
+	})
+	defer zw.Release()
+
+	// Reset must preserve the checksum flag.
+	zw.Reset(&bb, nil, 5)
+
+	src := []byte(newTestString(64*1024, 3))
+	if _, err := zw.Write(src); err != nil {
+		t.Fatalf("cannot write data: %s", err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("cannot close zw: %s", err)
+	}
+
+	cd := bb.Bytes()
+	cd[len(cd)-1]++
+	if _, err := Decompress(nil, cd); !errors.Is(err, ErrChecksumWrong) {
+		t.Fatalf("unexpected error for corrupted checksum; got %v; want %v", err, ErrChecksumWrong)
+	}
+}
+
+func TestWriterDisableDictID(t *testing.T) {
+	var samples [][]byte
+	for i := 0; i < 1000; i++ {
+		samples = append(samples, []byte(fmt.Sprintf("this is sample number %d", i)))
+	}
+	dict := BuildDict(samples, 8*1024)
+	cd, err := NewCDict(dict)
+	if err != nil {
+		t.Fatalf("cannot create CDict: %s", err)
+	}
+	defer cd.Release()
+
+	// The lowest two bits of the frame header descriptor contain the dict ID size.
+	// See https://github.com/facebook/zstd/blob/dev/doc/zstd_compression_format.md#frame_header_descriptor
+	for _, disableDictID := range []bool{false, true} {
+		var bb bytes.Buffer
+		zw := NewWriterParams(&bb, &WriterParams{
+			Dict:          cd,
+			DisableDictID: disableDictID,
+		})
+		if _, err := zw.Write([]byte("this is sample number 42")); err != nil {
+			t.Fatalf("cannot write data: %s", err)
+		}
+		if err := zw.Close(); err != nil {
+			t.Fatalf("cannot close zw: %s", err)
+		}
+		zw.Release()
+
+		hasDictID := bb.Bytes()[4]&3 != 0
+		if hasDictID == disableDictID {
+			t.Fatalf("unexpected dict ID presence in frame header for DisableDictID=%v", disableDictID)
+		}
+	}
+}
+
+func TestWriterWorkers(t *testing.T) {
+	var bbOrig bytes.Buffer
+	for bbOrig.Len() < 4*1024*1024 {
+		fmt.Fprintf(&bbOrig, "writer workers data %d, ", bbOrig.Len())
+	}
+	src := bbOrig.Bytes()
+
+	var results [][]byte
+	for i := 0; i < 3; i++ {
+		var bb bytes.Buffer
+		zw := NewWriterParams(&bb, &WriterParams{
+			Workers:    2,
+			JobSize:    512 * 1024,
+			OverlapLog: 6,
+		})
+		if _, err := zw.ReadFrom(bytes.NewReader(src)); err != nil {
+			t.Fatalf("cannot compress data: %s", err)
+		}
+		if err := zw.Close(); err != nil {
+			t.Fatalf("cannot close zw: %s", err)
+		}
+		zw.Release()
+		compressedData := append([]byte{}, bb.Bytes()...)
+
+		zr := NewReader(&bb)
+		plainData, err := ioutil.ReadAll(zr)
+		zr.Release()
+		if err != nil {
+			t.Fatalf("cannot decompress data: %s", err)
+		}
+		if !bytes.Equal(plainData, src) {
+			t.Fatalf("unexpected data decompressed; len(data)=%d, len(orig)=%d", len(plainData), len(src))
+		}
+		results = append(results, compressedData)
+	}
+	for i := 1; i < len(results); i++ {
+		if !bytes.Equal(results[i], results[0]) {
+			t.Fatalf("compressed output for run #%d differs from the output for run #0", i)
+		}
+	}
+
+	if MaxWorkers() == 0 {
+		// Workers must be ignored if libzstd is built without multithreading support.
+		var bb bytes.Buffer
+		zw := NewWriter(&bb)
+		if _, err := zw.ReadFrom(bytes.NewReader(src)); err != nil {
+			t.Fatalf("cannot compress data: %s", err)
+		}
+		if err := zw.Close(); err != nil {
+			t.Fatalf("cannot close zw: %s", err)
+		}
+		zw.Release()
+		if !bytes.Equal(results[0], bb.Bytes()) {
+			t.Fatalf("Workers must be ignored if MaxWorkers returns 0")
+		}
+	}
+}
+
+func TestWriterInvalidParams(t *testing.T) {
+	var bb bytes.Buffer
+	zw := NewWriterParams(&bb, &WriterParams{
+		WindowLog: WindowLogMax64 + 1,
+	})
+	defer zw.Release()
+
+	if _, err := zw.Write([]byte("foobar")); !errors.Is(err, ErrParameterOutOfBound) {
+		t.Fatalf("unexpected error in Write; got %v; want %v", err, ErrParameterOutOfBound)
+	}
+	if _, err := zw.ReadFrom(strings.NewReader("foobar")); !errors.Is(err, ErrParameterOutOfBound) {
+		t.Fatalf("unexpected error in ReadFrom; got %v; want %v", err, ErrParameterOutOfBound)
+	}
+	if err := zw.Flush(); !errors.Is(err, ErrParameterOutOfBound) {
+		t.Fatalf("unexpected error in Flush; got %v; want %v", err, ErrParameterOutOfBound)
+	}
+	if err := zw.Close(); !errors.Is(err, ErrParameterOutOfBound) {
+		t.Fatalf("unexpected error in Close; got %v; want %v", err, ErrParameterOutOfBound)
+	}
+	if bb.Len() > 0 {
+		t.Fatalf("unexpected data written with invalid params: %X", bb.Bytes())
+	}
+
+	// Reset with valid params must clear the error.
+	if err := zw.TryResetWriterParams(&bb, &WriterParams{}); err != nil {
+		t.Fatalf("unexpected error when resetting zw with valid params: %s", err)
+	}
+	if _, err := zw.Write([]byte("foobar")); err != nil {
+		t.Fatalf("unexpected error in Write: %s", err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("unexpected error in Close: %s", err)
+	}
+	plainData, err := Decompress(nil, bb.Bytes())
+	if err != nil {
+		t.Fatalf("cannot decompress data: %s", err)
+	}
+	if string(plainData) != "foobar" {
+		t.Fatalf("unexpected data decompressed; got %q; want %q", plainData, "foobar")
+	}
+
+	// TryResetWriterParams must return the error for invalid params.
+	if err := zw.TryResetWriterParams(&bb, &WriterParams{WindowLog: WindowLogMin - 1}); !errors.Is(err, ErrParameterOutOfBound) {
+		t.Fatalf("unexpected error in TryResetWriterParams; got %v; want %v", err, ErrParameterOutOfBound)
+	}
+}
+
+func TestWriterReleasedDict(t *testing.T) {
+	cd, err := NewCDict([]byte("foobar dictionary"))
+	if err != nil {
+		t.Fatalf("cannot create CDict: %s", err)
+	}
+	cd.Release()
+
+	zw := NewWriterDict(ioutil.Discard, cd)
+	defer zw.Release()
+	if _, err := zw.Write([]byte("foobar")); err == nil {
+		t.Fatalf("expecting error when writing with released CDict")
+	}
+	if _, err := TryCompressDict(nil, []byte("foobar"), cd); err == nil {
+		t.Fatalf("expecting error when compressing with released CDict")
+	}
+}
+
 func TestWriterMultiFrames(t *testing.T) {
 	var bb bytes.Buffer
 	var bbOrig bytes.Buffer
@@ -496,3 +749,208 @@ func TestWriterBig(t *testing.T) {
 		t.Fatalf("unequal writtenBB and readBB\nwrittenBB=\n%X\nreadBB=\n%X", writtenBB.Bytes(), readBB.Bytes())
 	}
 }
+
+func TestWriterSkippableFrame(t *testing.T) {
+	var bb bytes.Buffer
+	zw := NewWriter(&bb)
+	defer zw.Release()
+
+	// Skippable frame at the start of the stream.
+	meta1 := []byte("meta1")
+	if err := zw.WriteSkippableFrame(1, meta1); err != nil {
+		t.Fatalf("cannot write skippable frame: %s", err)
+	}
+	data1 := []byte(newTestString(64*1024, 3))
+	if _, err := zw.Write(data1); err != nil {
+		t.Fatalf("cannot write data: %s", err)
+	}
+
+	// Skippable frame between regular frames. Its payload exceeds the Reader buffer.
+	meta2 := []byte(newTestString(512*1024, 3))
+	if err := zw.WriteSkippableFrame(2, meta2); err != nil {
+		t.Fatalf("cannot write skippable frame: %s", err)
+	}
+	data2 := []byte(newTestString(64*1024, 3))
+	if _, err := zw.ReadFrom(bytes.NewReader(data2)); err != nil {
+		t.Fatalf("cannot write data: %s", err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("cannot close zw: %s", err)
+	}
+
+	// Skippable frame at the end of the stream.
+	if err := zw.WriteSkippableFrame(3, nil); err != nil {
+		t.Fatalf("cannot write skippable frame: %s", err)
+	}
+	cd := bb.Bytes()
+
+	// The skippable frames must be ignored by default.
+	plainData, err := Decompress(nil, cd)
+	if err != nil {
+		t.Fatalf("cannot decompress data: %s", err)
+	}
+	src := append(append([]byte{}, data1...), data2...)
+	if !bytes.Equal(plainData, src) {
+		t.Fatalf("unexpected data decompressed; got %d bytes; want %d bytes", len(plainData), len(src))
+	}
+
+	// The skippable frames must be passed to the handler.
+	type skippableFrame struct {
+		magicVariant uint32
+		payload      []byte
+	}
+	var frames []skippableFrame
+	params := &ReaderParams{
+		SkippableFrameHandler: func(magicVariant uint32, payload []byte) error {
+			frames = append(frames, skippableFrame{
+				magicVariant: magicVariant,
+				payload:      append([]byte{}, payload...),
+			})
+			return nil
+		},
+	}
+	checkFrames := func() {
+		t.Helper()
+		if len(frames) != 3 {
+			t.Fatalf("unexpected number of skippable frames; got %d; want 3", len(frames))
+		}
+		for i, payload := range [][]byte{meta1, meta2, nil} {
+			f := frames[i]
+			if f.magicVariant != uint32(i+1) {
+				t.Fatalf("unexpected magicVariant for frame #%d; got %d; want %d", i, f.magicVariant, i+1)
+			}
+			if !bytes.Equal(f.payload, payload) {
+				t.Fatalf("unexpected payload for frame #%d; got %d bytes; want %d bytes", i, len(f.payload), len(payload))
+			}
+		}
+		frames = frames[:0]
+	}
+
+	zr := NewReaderParams(iotest.HalfReader(bytes.NewReader(cd)), params)
+	defer zr.Release()
+	plainData, err = ioutil.ReadAll(zr)
+	if err != nil {
+		t.Fatalf("cannot read data: %s", err)
+	}
+	if !bytes.Equal(plainData, src) {
+		t.Fatalf("unexpected data read; got %d bytes; want %d bytes", len(plainData), len(src))
+	}
+	checkFrames()
+
+	plainData, err = DecompressParams(nil, cd, params)
+	if err != nil {
+		t.Fatalf("cannot decompress data: %s", err)
+	}
+	if !bytes.Equal(plainData, src) {
+		t.Fatalf("unexpected data decompressed; got %d bytes; want %d bytes", len(plainData), len(src))
+	}
+	checkFrames()
+}
+
+func TestWriterPrefix(t *testing.T) {
+	prefix1 := newTestDocument(32 * 1024)
+	prefix2 := newTestDocument(32 * 1024)
+	data1 := append(append([]byte{}, prefix1[100:]...), "foo"...)
+	data2 := append(append([]byte{}, prefix2[200:]...), "bar"...)
+	data3 := []byte(newTestString(1024, 3))
+
+	// Write the first frame with prefix1, the second frame with prefix2
+	// and the third frame without a prefix.
+	var bb bytes.Buffer
+	zw := NewWriterLevel(&bb, 5)
+	defer zw.Release()
+	var frames [][]byte
+	for _, fd := range []struct {
+		prefix []byte
+		data   []byte
+	}{
+		{prefix1, data1},
+		{prefix2, data2},
+		{nil, data3},
+	} {
+		if fd.prefix != nil {
+			if err := zw.SetPrefix(fd.prefix); err != nil {
+				t.Fatalf("cannot set prefix: %s", err)
+			}
+		}
+		if _, err := zw.Write(fd.data); err != nil {
+			t.Fatalf("cannot write data: %s", err)
+		}
+		if err := zw.SetPrefix(fd.prefix); err == nil {
+			t.Fatalf("expecting non-nil error when setting prefix in the middle of the frame")
+		}
+		if err := zw.Close(); err != nil {
+			t.Fatalf("cannot close writer: %s", err)
+		}
+		frames = append(frames, append([]byte{}, bb.Bytes()...))
+		bb.Reset()
+	}
+	if len(frames[0]) > len(data1)/10 {
+		t.Fatalf("too big frame compressed with prefix; got %d bytes; want up to %d bytes", len(frames[0]), len(data1)/10)
+	}
+
+	// Read the frames.
+	zr := NewReader(nil)
+	defer zr.Release()
+	for i, fd := range []struct {
+		prefix []byte
+		data   []byte
+	}{
+		{prefix1, data1},
+		{prefix2, data2},
+		{nil, data3},
+	} {
+		zr.Reset(bytes.NewReader(frames[i]), nil)
+		if fd.prefix != nil {
+			if err := zr.SetPrefix(fd.prefix); err != nil {
+				t.Fatalf("cannot set prefix: %s", err)
+			}
+		}
+		plainData, err := ioutil.ReadAll(zr)
+		if err != nil {
+			t.Fatalf("cannot read frame #%d: %s", i, err)
+		}
+		if !bytes.Equal(plainData, fd.data) {
+			t.Fatalf("unexpected data read from frame #%d; got %d bytes; want %d bytes", i, len(plainData), len(fd.data))
+		}
+	}
+
+	// The prefix must be used only for the first frame in the stream.
+	cd := append(append([]byte{}, frames[0]...), frames[2]...)
+	zr.Reset(bytes.NewReader(cd), nil)
+	if err := zr.SetPrefix(prefix1); err != nil {
+		t.Fatalf("cannot set prefix: %s", err)
+	}
+	plainData, err := ioutil.ReadAll(zr)
+	if err != nil {
+		t.Fatalf("cannot read frames: %s", err)
+	}
+	if !bytes.Equal(plainData, append(append([]byte{}, data1...), data3...)) {
+		t.Fatalf("unexpected data read from frames; got %d bytes; want %d bytes", len(plainData), len(data1)+len(data3))
+	}
+}
+
+func TestWriterPrefixWithDict(t *testing.T) {
+	dict := []byte(newTestString(32*1024, 3))
+	cd, err := NewCDict(dict)
+	if err != nil {
+		t.Fatalf("cannot create CDict: %s", err)
+	}
+	defer cd.Release()
+	zw := NewWriterDict(ioutil.Discard, cd)
+	defer zw.Release()
+	if err := zw.SetPrefix([]byte("foobar")); err == nil {
+		t.Fatalf("expecting non-nil error when setting prefix together with Dict")
+	}
+
+	dd, err := NewDDict(dict)
+	if err != nil {
+		t.Fatalf("cannot create DDict: %s", err)
+	}
+	defer dd.Release()
+	zr := NewReaderDict(nil, dd)
+	defer zr.Release()
+	if err := zr.SetPrefix([]byte("foobar")); err == nil {
+		t.Fatalf("expecting non-nil error when setting prefix together with Dict")
+	}
+}